@@ -0,0 +1,247 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import "sync"
+
+var _ Watcher = (*Subscription)(nil)
+
+// A Broadcaster fans the events and errors of one Watcher out to any number
+// of subscriptions, so that several consumers share one set of kernel
+// watches.
+//
+// Every subscription receives every event through its own queue, so a
+// subscription that is not received from holds up neither the others nor
+// the watcher. A subscription whose queue is full loses the events that do
+// not fit and receives ErrEventOverflow in their place.
+type Broadcaster struct {
+	w Watcher
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool // The channels of w are closed
+}
+
+// A Subscription receives the events and errors of a Broadcaster on its own
+// channels. It is a Watcher: Add and Remove change the watches shared by
+// all subscriptions, and Close ends the subscription only.
+type Subscription struct {
+	b       *Broadcaster
+	events  chan Event
+	errors  chan error
+	wake    chan struct{} // Signals a push to forward
+	done    chan struct{} // Closed by Close
+	stopped chan struct{} // Closed when forward exits
+	once    sync.Once
+
+	mu    sync.Mutex
+	queue []delivery
+	size  int  // Capacity of queue
+	lost  bool // Deliveries were dropped since the last ErrEventOverflow
+}
+
+// delivery is an event or an error queued for a subscription.
+type delivery struct {
+	ev  Event
+	err error
+}
+
+// NewBroadcaster starts broadcasting the events of w. The Broadcaster owns
+// the channels of w; closing it closes w.
+func NewBroadcaster(w Watcher) *Broadcaster {
+	b := &Broadcaster{w: w, subs: make(map[*Subscription]struct{})}
+	go b.run()
+	return b
+}
+
+// Subscribe returns a new subscription queueing up to buffer events and
+// errors besides the one being received. It receives what w reports from
+// now on. The channels of a subscription made after w was closed are
+// closed already.
+func (b *Broadcaster) Subscribe(buffer int) *Subscription {
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &Subscription{
+		b:       b,
+		events:  make(chan Event),
+		errors:  make(chan error),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		size:    buffer + 1,
+	}
+	go s.forward()
+	b.mu.Lock()
+	closed := b.closed
+	if !closed {
+		b.subs[s] = struct{}{}
+	}
+	b.mu.Unlock()
+	if closed {
+		s.Close()
+	}
+	return s
+}
+
+func (b *Broadcaster) Add(path string) error {
+	return b.w.Add(path)
+}
+
+func (b *Broadcaster) Remove(path string) error {
+	return b.w.Remove(path)
+}
+
+// Close closes the watcher. The channels of the subscriptions are closed
+// once the watcher's are; what they did not receive by then is dropped.
+func (b *Broadcaster) Close() error {
+	return b.w.Close()
+}
+
+func (b *Broadcaster) run() {
+	events, errs := b.w.EventChannel(), b.w.ErrorChannel()
+	for events != nil || errs != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			for _, s := range b.subscriptions() {
+				s.push(delivery{ev: ev})
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			for _, s := range b.subscriptions() {
+				s.push(delivery{err: err})
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+	for s := range subs {
+		s.Close()
+	}
+}
+
+func (b *Broadcaster) subscriptions() []*Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	return subs
+}
+
+// push queues d without waiting, or drops it if the queue is full.
+func (s *Subscription) push(d delivery) {
+	s.mu.Lock()
+	if s.lost && len(s.queue) < s.size {
+		s.queue = append(s.queue, delivery{err: ErrEventOverflow})
+		s.lost = false
+	}
+	if len(s.queue) < s.size {
+		s.queue = append(s.queue, d)
+	} else {
+		s.lost = true
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next delivery, if any.
+func (s *Subscription) next() (delivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) > 0 {
+		d := s.queue[0]
+		copy(s.queue, s.queue[1:])
+		s.queue = s.queue[:len(s.queue)-1]
+		return d, true
+	}
+	if s.lost {
+		s.lost = false
+		return delivery{err: ErrEventOverflow}, true
+	}
+	return delivery{}, false
+}
+
+// forward sends the queued deliveries on the channels of the subscription
+// until it is closed, and then closes them.
+func (s *Subscription) forward() {
+	defer close(s.stopped)
+	defer close(s.errors)
+	defer close(s.events)
+
+	for {
+		d, ok := s.next()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		if d.err != nil {
+			select {
+			case s.errors <- d.err:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		select {
+		case s.events <- d.ev:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// EventChannel returns the events of the subscription. It is closed when
+// the subscription or the broadcast watcher is closed.
+func (s *Subscription) EventChannel() <-chan Event {
+	return s.events
+}
+
+func (s *Subscription) ErrorChannel() <-chan error {
+	return s.errors
+}
+
+func (s *Subscription) Add(path string) error {
+	return s.b.Add(path)
+}
+
+func (s *Subscription) Remove(path string) error {
+	return s.b.Remove(path)
+}
+
+// Close ends the subscription and closes its channels. Events it did not
+// receive are dropped. The broadcast watcher is not closed.
+func (s *Subscription) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.b.mu.Lock()
+		delete(s.b.subs, s)
+		s.b.mu.Unlock()
+	})
+	<-s.stopped
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+func receiveSub(t *testing.T, s *Subscription) Event {
+	t.Helper()
+	select {
+	case ev := <-s.EventChannel():
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("Took too long to wait for event")
+	}
+	return Event{}
+}
+
+func TestBroadcaster(t *testing.T) {
+	before := runtime.NumGoroutine()
+	w := newChanWatcher()
+	b := NewBroadcaster(w)
+	s1, s2 := b.Subscribe(0), b.Subscribe(0)
+
+	w.events <- Event{Name: "a", Op: Create}
+	for _, s := range []*Subscription{s1, s2} {
+		if ev := receiveSub(t, s); ev.Name != "a" {
+			t.Errorf("Unexpected event: %v", ev)
+		}
+	}
+	w.errors <- ErrEventOverflow
+	for _, s := range []*Subscription{s1, s2} {
+		if err := <-s.ErrorChannel(); err != ErrEventOverflow {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+
+	// Closing a subscription leaves the others alone, even if events for
+	// it are pending.
+	s1.Close()
+	if _, ok := <-s1.EventChannel(); ok {
+		t.Error("events of a closed subscription not closed")
+	}
+	w.events <- Event{Name: "b", Op: Create}
+	if ev := receiveSub(t, s2); ev.Name != "b" {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+
+	b.Close()
+	if _, ok := <-s2.EventChannel(); ok {
+		t.Error("events of a subscription not closed with the broadcaster")
+	}
+	if _, ok := <-s2.ErrorChannel(); ok {
+		t.Error("errors of a subscription not closed with the broadcaster")
+	}
+	s3 := b.Subscribe(0)
+	if _, ok := <-s3.EventChannel(); ok {
+		t.Error("subscription after Close not closed")
+	}
+	checkGoroutines(t, before)
+}
+
+func TestBroadcasterSlowSubscriber(t *testing.T) {
+	before := runtime.NumGoroutine()
+	w := newChanWatcher()
+	b := NewBroadcaster(w)
+	slow, fast := b.Subscribe(0), b.Subscribe(0)
+
+	// A subscription nobody receives from holds up neither the watcher
+	// nor the other subscriptions.
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		w.events <- Event{Name: name, Op: Create}
+		if ev := receiveSub(t, fast); ev.Name != name {
+			t.Errorf("Unexpected event: %v", ev)
+		}
+	}
+
+	// It gets the events that fit in its queue, then an overflow for the
+	// ones it lost.
+	for _, name := range names[:2] {
+		if ev := receiveSub(t, slow); ev.Name != name {
+			t.Errorf("Unexpected event: %v", ev)
+		}
+	}
+	select {
+	case err := <-slow.ErrorChannel():
+		if err != ErrEventOverflow {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Took too long to wait for the overflow")
+	}
+	w.events <- Event{Name: "e", Op: Create}
+	if ev := receiveSub(t, slow); ev.Name != "e" {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+
+	// Closing a subscription with a delivery pending does not block.
+	w.events <- Event{Name: "f", Op: Create}
+	slow.Close()
+	w.events <- Event{Name: "g", Op: Create}
+	b.Close()
+	checkGoroutines(t, before)
+}
+
+func TestBroadcasterRun(t *testing.T) {
+	before := runtime.NumGoroutine()
+	fs := &vfs.MemMapFs{}
+	b := NewBroadcaster(NewMemWatcher(fs))
+	if err := b.Add("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each consumer runs its own loop over its own subscription.
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		mu   sync.Mutex
+		got  = make(map[int][]string)
+		wg   sync.WaitGroup
+		seen sync.WaitGroup
+	)
+	for i := 0; i < 3; i++ {
+		i := i
+		s := b.Subscribe(1)
+		wg.Add(1)
+		seen.Add(1)
+		go func() {
+			defer wg.Done()
+			Run(ctx, s, func(ev Event) error {
+				if ev.Op != Create {
+					return nil
+				}
+				mu.Lock()
+				got[i] = append(got[i], ev.Name)
+				mu.Unlock()
+				seen.Done()
+				return nil
+			}, nil)
+		}()
+	}
+	vfs.WriteFile(fs, "/file", nil, 0644)
+	seen.Wait()
+	cancel()
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		if len(got[i]) != 1 || got[i][0] != "/file" {
+			t.Errorf("Subscriber %d got %v", i, got[i])
+		}
+	}
+	b.Close()
+	checkGoroutines(t, before)
+}
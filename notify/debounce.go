@@ -0,0 +1,271 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by the helpers in notify. Tests replace
+// it to make timing deterministic.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
+
+// DebounceOptions configures a Debouncer.
+type DebounceOptions struct {
+	// Clock defaults to the system clock.
+	Clock Clock
+	// MaxWait bounds how long events are held while more keep arriving. A
+	// batch is sent once MaxWait has passed since its first event even if
+	// the window was never quiet. Zero means no bound.
+	MaxWait time.Duration
+}
+
+// A Debouncer collects the events of a Watcher until no event arrived for
+// a quiet window, and sends them as one batch with the events for each path
+// merged:
+//
+//	Create then Write or Chmod  Create
+//	Create then Remove          nothing
+//	Remove then Create          Write
+//	anything then Remove        Remove
+//
+// A Rename without OldName moves the file away from its name and merges
+// like Remove. A Rename with OldName set takes over what was pending for the
+// old name. Other ops on the same path are combined.
+type Debouncer struct {
+	w       Watcher
+	window  time.Duration
+	opts    DebounceOptions
+	batches chan []Event
+	errors  chan error
+	done    chan struct{} // Closed by Close
+	once    sync.Once
+}
+
+// Debounce starts debouncing the events of w. The Debouncer owns the
+// channels of w; closing it closes w.
+func Debounce(w Watcher, window time.Duration, opts DebounceOptions) *Debouncer {
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	d := &Debouncer{
+		w:       w,
+		window:  window,
+		opts:    opts,
+		batches: make(chan []Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Batches returns the channel the merged events are sent on. It is closed
+// once the channels of the watcher are. If they close on their own, the
+// last batch is sent first; after Close, batches not received are dropped.
+func (d *Debouncer) Batches() <-chan []Event {
+	return d.batches
+}
+
+// Errors returns the errors of the watcher.
+func (d *Debouncer) Errors() <-chan error {
+	return d.errors
+}
+
+func (d *Debouncer) Add(path string) error {
+	return d.w.Add(path)
+}
+
+func (d *Debouncer) Remove(path string) error {
+	return d.w.Remove(path)
+}
+
+// Close closes the watcher. Batches and errors not received yet are
+// dropped.
+func (d *Debouncer) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return d.w.Close()
+}
+
+func (d *Debouncer) run() {
+	defer close(d.errors)
+	defer close(d.batches)
+
+	var (
+		events = d.w.EventChannel()
+		errs   = d.w.ErrorChannel()
+		quiet  Timer
+		first  time.Time
+		batch  = newCoalescer()
+	)
+	// flush returns false if the Debouncer was closed while sending.
+	flush := func() bool {
+		if quiet != nil {
+			quiet.Stop()
+			quiet = nil
+		}
+		out := batch.events()
+		batch = newCoalescer()
+		if len(out) == 0 {
+			return true
+		}
+		select {
+		case d.batches <- out:
+			return true
+		case <-d.done:
+			return false
+		}
+	}
+
+	for events != nil || errs != nil {
+		var fire <-chan time.Time
+		if quiet != nil {
+			fire = quiet.C()
+		}
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			now := d.opts.Clock.Now()
+			if batch.empty() {
+				first = now
+			}
+			batch.add(ev)
+			if quiet != nil {
+				quiet.Stop()
+			}
+			wait := d.window
+			if d.opts.MaxWait > 0 {
+				if left := first.Add(d.opts.MaxWait).Sub(now); left < wait {
+					wait = left
+				}
+			}
+			quiet = d.opts.Clock.NewTimer(wait)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case d.errors <- err:
+			case <-d.done:
+				drain(d.w)
+				return
+			}
+		case <-fire:
+			if !flush() {
+				drain(d.w)
+				return
+			}
+		}
+	}
+	flush()
+}
+
+// coalescer merges the events of one batch by path.
+type coalescer struct {
+	order   []*pendingEvent // Events as their paths were first seen; dropped ones stay behind
+	pending map[string]*pendingEvent
+}
+
+type pendingEvent struct {
+	Event
+	created bool // The path did not exist before the batch
+	removed bool // The path existed before the batch and was removed
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{pending: make(map[string]*pendingEvent)}
+}
+
+func (c *coalescer) empty() bool {
+	return len(c.pending) == 0
+}
+
+func (c *coalescer) add(ev Event) {
+	if ev.OldName != "" {
+		if old, ok := c.pending[ev.OldName]; ok {
+			delete(c.pending, ev.OldName)
+			if old.created {
+				// Created and renamed within the batch: the new name was
+				// simply created.
+				created := ev
+				created.Op, created.OldName = Create, ""
+				c.add(created)
+				return
+			}
+			ev.Op |= old.Op &^ (Create | Remove | Rename)
+		}
+	}
+
+	p, ok := c.pending[ev.Name]
+	if !ok {
+		p = &pendingEvent{Event: Event{Name: ev.Name}}
+		c.order = append(c.order, p)
+		c.pending[ev.Name] = p
+	}
+	// The payload is that of the latest event.
+	p.Time, p.IsDir, p.Root, p.Info = ev.Time, ev.IsDir, ev.Root, ev.Info
+	switch {
+	case ev.Op&Remove != 0, ev.Op&Rename != 0 && ev.OldName == "":
+		// Removed, or moved away from this name.
+		if p.created {
+			delete(c.pending, ev.Name)
+			return
+		}
+		p.Op, p.OldName, p.removed = ev.Op&(Remove|Rename), "", true
+	case ev.Op&Create != 0 && p.removed:
+		p.Op, p.removed = Write|ev.Op&^Create, false
+	case ev.Op&Create != 0 && p.Op == 0:
+		p.Op, p.created = ev.Op, true
+	case p.created:
+		// Whatever happened after the creation is part of it.
+	default:
+		p.Op |= ev.Op
+		if ev.OldName != "" {
+			p.OldName = ev.OldName
+		}
+	}
+}
+
+// events returns the merged events in the order their paths were first
+// seen. A path whose events cancelled out counts from when it was seen
+// again.
+func (c *coalescer) events() []Event {
+	var out []Event
+	for _, p := range c.order {
+		if c.pending[p.Name] == p && p.Op != 0 {
+			out = append(out, p.Event)
+			delete(c.pending, p.Name)
+		}
+	}
+	return out
+}
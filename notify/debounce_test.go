@@ -0,0 +1,255 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanWatcher is a Watcher fed by the test.
+type chanWatcher struct {
+	events chan Event
+	errors chan error
+	once   sync.Once
+}
+
+func newChanWatcher() *chanWatcher {
+	return &chanWatcher{events: make(chan Event), errors: make(chan error)}
+}
+
+func (w *chanWatcher) Close() error {
+	w.once.Do(func() {
+		close(w.events)
+		close(w.errors)
+	})
+	return nil
+}
+
+func (w *chanWatcher) Add(path string) error      { return nil }
+func (w *chanWatcher) Remove(path string) error   { return nil }
+func (w *chanWatcher) EventChannel() <-chan Event { return w.events }
+func (w *chanWatcher) ErrorChannel() <-chan error { return w.errors }
+
+// fakeClock only moves when advanced. It counts the timers created so tests
+// can wait for the code under test to have handled an input.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	created int
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+	done  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.created++
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if !t.done && !t.at.After(c.now) {
+			t.done = true
+			t.c <- c.now
+		}
+	}
+}
+
+// waitTimers waits until n timers have been created.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		created := c.created
+		c.mu.Unlock()
+		if created >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d timers, %d created", n, created)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.done
+	t.done = true
+	return active
+}
+
+func TestCoalescer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []Event
+		want []Event
+	}{
+		{"create write chmod", []Event{{Name: "a", Op: Create}, {Name: "a", Op: Write}, {Name: "a", Op: Chmod}},
+			[]Event{{Name: "a", Op: Create}}},
+		{"create remove", []Event{{Name: "a", Op: Create}, {Name: "a", Op: Write}, {Name: "a", Op: Remove}},
+			nil},
+		{"remove create", []Event{{Name: "a", Op: Remove}, {Name: "a", Op: Create}},
+			[]Event{{Name: "a", Op: Write}}},
+		{"write remove", []Event{{Name: "a", Op: Write}, {Name: "a", Op: Remove}},
+			[]Event{{Name: "a", Op: Remove}}},
+		{"write chmod", []Event{{Name: "a", Op: Write}, {Name: "a", Op: Chmod}, {Name: "a", Op: Write}},
+			[]Event{{Name: "a", Op: Write | Chmod}}},
+		{"order", []Event{{Name: "b", Op: Write}, {Name: "a", Op: Create}, {Name: "b", Op: Chmod}},
+			[]Event{{Name: "b", Op: Write | Chmod}, {Name: "a", Op: Create}}},
+		{"editor save", []Event{{Name: "a~", Op: Create}, {Name: "a~", Op: Write}, {Name: "a", OldName: "a~", Op: Rename}},
+			[]Event{{Name: "a", Op: Create}}},
+		{"replaced", []Event{{Name: "a", Op: Rename}, {Name: "a", Op: Create}},
+			[]Event{{Name: "a", Op: Write}}},
+		{"created moved away", []Event{{Name: "a", Op: Create}, {Name: "a", Op: Rename}},
+			nil},
+		{"rename written", []Event{{Name: "a", Op: Write}, {Name: "b", OldName: "a", Op: Rename}},
+			[]Event{{Name: "b", OldName: "a", Op: Rename | Write}}},
+		{"cancelled created again", []Event{{Name: "a", Op: Create}, {Name: "b", Op: Write}, {Name: "a", Op: Remove}, {Name: "a", Op: Create}},
+			[]Event{{Name: "b", Op: Write}, {Name: "a", Op: Create}}},
+		{"editor save payload", []Event{{Name: "a~", Op: Create}, {Name: "a", OldName: "a~", Op: Rename, Time: time.Unix(1, 0), Root: "/r", IsDir: true}},
+			[]Event{{Name: "a", Op: Create, Time: time.Unix(1, 0), Root: "/r", IsDir: true}}},
+	} {
+		c := newCoalescer()
+		for _, ev := range tc.in {
+			c.add(ev)
+		}
+		if got := c.events(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func receiveBatch(t *testing.T, d *Debouncer) []Event {
+	select {
+	case b := <-d.Batches():
+		return b
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a batch")
+	}
+	return nil
+}
+
+func expectNoBatch(t *testing.T, d *Debouncer) {
+	select {
+	case b := <-d.Batches():
+		t.Fatalf("unexpected batch %v", b)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDebounceQuietWindow(t *testing.T) {
+	w := newChanWatcher()
+	clock := newFakeClock()
+	d := Debounce(w, 100*time.Millisecond, DebounceOptions{Clock: clock})
+	defer d.Close()
+
+	w.events <- Event{Name: "a", Op: Create}
+	clock.waitTimers(t, 1)
+	clock.Advance(60 * time.Millisecond)
+	w.events <- Event{Name: "a", Op: Write}
+	clock.waitTimers(t, 2)
+	clock.Advance(60 * time.Millisecond)
+	expectNoBatch(t, d)
+
+	clock.Advance(40 * time.Millisecond)
+	if b := receiveBatch(t, d); !reflect.DeepEqual(b, []Event{{Name: "a", Op: Create}}) {
+		t.Errorf("unexpected batch %v", b)
+	}
+}
+
+func TestDebounceMaxWait(t *testing.T) {
+	w := newChanWatcher()
+	clock := newFakeClock()
+	d := Debounce(w, 100*time.Millisecond, DebounceOptions{Clock: clock, MaxWait: 150 * time.Millisecond})
+	defer d.Close()
+
+	w.events <- Event{Name: "a", Op: Write}
+	clock.waitTimers(t, 1)
+	clock.Advance(80 * time.Millisecond)
+	w.events <- Event{Name: "b", Op: Write}
+	clock.waitTimers(t, 2)
+	clock.Advance(70 * time.Millisecond)
+
+	want := []Event{{Name: "a", Op: Write}, {Name: "b", Op: Write}}
+	if b := receiveBatch(t, d); !reflect.DeepEqual(b, want) {
+		t.Errorf("unexpected batch %v", b)
+	}
+}
+
+func TestDebounceClose(t *testing.T) {
+	w := newChanWatcher()
+	d := Debounce(w, time.Hour, DebounceOptions{Clock: newFakeClock()})
+
+	w.events <- Event{Name: "a", Op: Write}
+	w.errors <- ErrEventOverflow
+	if err := <-d.Errors(); err != ErrEventOverflow {
+		t.Errorf("unexpected error %v", err)
+	}
+	w.Close()
+
+	// The pending events are flushed before the channels close.
+	if b := receiveBatch(t, d); !reflect.DeepEqual(b, []Event{{Name: "a", Op: Write}}) {
+		t.Errorf("unexpected batch %v", b)
+	}
+	if _, ok := <-d.Batches(); ok {
+		t.Error("batches channel not closed")
+	}
+	if _, ok := <-d.Errors(); ok {
+		t.Error("errors channel not closed")
+	}
+}
+
+func TestDebounceCloseUnread(t *testing.T) {
+	before := runtime.NumGoroutine()
+	clock := newFakeClock()
+	w := newChanWatcher()
+	d := Debounce(w, time.Millisecond, DebounceOptions{Clock: clock})
+
+	// Neither an error nobody receives nor a batch nobody receives keeps
+	// Close from ending the Debouncer.
+	w.events <- Event{Name: "a", Op: Write}
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Second)
+	d.Close()
+	checkGoroutines(t, before)
+
+	w = newChanWatcher()
+	d = Debounce(w, time.Hour, DebounceOptions{Clock: clock})
+	w.errors <- ErrEventOverflow
+	d.Close()
+	checkGoroutines(t, before)
+}
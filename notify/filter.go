@@ -0,0 +1,291 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+// FilterOptions configures a Filter. Patterns have the syntax of vfs.Match.
+// A pattern starting with a separator is matched against the whole path as
+// the watcher reports it; others against the path relative to the watched
+// path, so *.tmp matches the files directly in it and **/node_modules
+// excludes node_modules directories anywhere below it.
+type FilterOptions struct {
+	// Include, if not empty, limits the reported files to those matching
+	// one of these patterns. Directories are not limited by it, so the
+	// files below them can still be reached.
+	Include []string
+	// Exclude drops the paths matching one of these patterns and
+	// everything below them.
+	Exclude []string
+	// IgnoreFiles are the names of .gitignore-style files, such as
+	// ".gitignore", to read from the watched directories. Their rules apply
+	// to the directory holding them and everything below it.
+	IgnoreFiles []string
+}
+
+func (o FilterOptions) empty() bool {
+	return len(o.Include) == 0 && len(o.Exclude) == 0 && len(o.IgnoreFiles) == 0
+}
+
+// A Filter decides which paths a watcher watches and reports. Watchers
+// consult it when installing watches, so that ignored directories are
+// skipped entirely, and when sending events.
+type Filter struct {
+	fs   vfs.Vfs
+	opts FilterOptions
+
+	mu    sync.Mutex
+	rules map[string][]ignoreRule // Rules of the ignore files (key: directory)
+	dirs  map[[2]string]bool      // Cached results of ignoredDir (key: root, directory)
+}
+
+// filterCacheSize bounds the number of directories whose result a Filter
+// keeps.
+const filterCacheSize = 4096
+
+// ignoreRule is a line of an ignore file.
+type ignoreRule struct {
+	pattern  string
+	negate   bool // "!pattern" re-includes what an earlier rule ignored
+	dirOnly  bool // "pattern/" only matches directories
+	anchored bool // A pattern with a slash is relative to the directory
+}
+
+// NewFilter returns a filter reading ignore files from fs, or nil if opts
+// filters nothing. It fails on malformed patterns. The methods of a nil
+// Filter filter nothing.
+func NewFilter(fs vfs.Vfs, opts FilterOptions) (*Filter, error) {
+	if opts.empty() {
+		return nil, nil
+	}
+	for _, patterns := range [][]string{opts.Include, opts.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := vfs.Match(pattern, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Filter{fs: fs, opts: opts, rules: make(map[string][]ignoreRule), dirs: make(map[[2]string]bool)}, nil
+}
+
+// IsIgnoreFile reports whether name is one of the ignore files, which the
+// watcher should Load again when it changes.
+func (f *Filter) IsIgnoreFile(name string) bool {
+	if f == nil {
+		return false
+	}
+	base := filepath.Base(name)
+	for _, n := range f.opts.IgnoreFiles {
+		if n == base {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the ignore files in dir, replacing the rules read from it
+// before. Missing ignore files and unreadable lines are skipped.
+func (f *Filter) Load(dir string) {
+	if f == nil || len(f.opts.IgnoreFiles) == 0 {
+		return
+	}
+	dir = filepath.Clean(dir)
+	var rules []ignoreRule
+	for _, name := range f.opts.IgnoreFiles {
+		rules = append(rules, f.read(filepath.Join(dir, name))...)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(rules) == 0 && len(f.rules[dir]) == 0 {
+		return
+	}
+	if len(rules) == 0 {
+		delete(f.rules, dir)
+	} else {
+		f.rules[dir] = rules
+	}
+	// The rules only apply below dir.
+	for key := range f.dirs {
+		if path := key[1]; path != dir && within(dir, path) {
+			delete(f.dirs, key)
+		}
+	}
+}
+
+// LoadTree loads the ignore files of root and of the directories below it
+// that are not ignored.
+func (f *Filter) LoadTree(root string) {
+	if f == nil || len(f.opts.IgnoreFiles) == 0 {
+		return
+	}
+	vfs.Walk(f.fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != root && f.Ignored(path, root, true) {
+			return filepath.SkipDir
+		}
+		f.Load(path)
+		return nil
+	})
+}
+
+func (f *Filter) read(name string) []ignoreRule {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		r.pattern = filepath.FromSlash(line)
+		if !r.anchored {
+			r.pattern = filepath.Join("**", r.pattern)
+		}
+		if _, err := vfs.Match(r.pattern, ""); err != nil || line == "" {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Ignored reports whether events for name, reported for the watched path
+// root, should be dropped, and for a directory whether it should not be
+// watched.
+func (f *Filter) Ignored(name, root string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	name, root = filepath.Clean(name), filepath.Clean(root)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Whatever is below an excluded directory is excluded too.
+	if dir := filepath.Dir(name); name != root && f.ignoredDir(dir, root) {
+		return true
+	}
+	if f.excluded(name, root, isDir) {
+		return true
+	}
+	if !isDir && len(f.opts.Include) > 0 && !matchAny(f.opts.Include, name, root) {
+		return true
+	}
+	return false
+}
+
+// ignoredDir reports whether the directory dir or one above it, up to but
+// not including root, is excluded. The result is cached until the rules
+// change, so the events of a directory do not check its ancestors again.
+// f.mu must be held.
+func (f *Filter) ignoredDir(dir, root string) bool {
+	if dir == root || !within(root, dir) {
+		return false
+	}
+	key := [2]string{root, dir}
+	if ignored, ok := f.dirs[key]; ok {
+		return ignored
+	}
+	ignored := f.ignoredDir(filepath.Dir(dir), root) || f.excluded(dir, root, true)
+	if len(f.dirs) >= filterCacheSize {
+		f.dirs = make(map[[2]string]bool)
+	}
+	f.dirs[key] = ignored
+	return ignored
+}
+
+// excluded reports whether name itself is excluded by a pattern or an
+// ignore file. f.mu must be held.
+func (f *Filter) excluded(name, root string, isDir bool) bool {
+	if matchAny(f.opts.Exclude, name, root) {
+		return true
+	}
+	if len(f.rules) == 0 {
+		return false
+	}
+
+	// The rules of deeper ignore files come later and override those of
+	// the directories above.
+	var dirs []string
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		if _, ok := f.rules[dir]; ok {
+			dirs = append(dirs, dir)
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], name)
+		if err != nil {
+			continue
+		}
+		for _, r := range f.rules[dirs[i]] {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if ok, _ := vfs.Match(r.pattern, rel); ok {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// matchAny reports whether name matches one of patterns, see
+// FilterOptions.
+func matchAny(patterns []string, name, root string) bool {
+	var rel string
+	if name != root && within(root, name) {
+		rel, _ = filepath.Rel(root, name)
+	}
+	for _, pattern := range patterns {
+		target := rel
+		if strings.HasPrefix(pattern, string(filepath.Separator)) || filepath.IsAbs(pattern) {
+			target = name
+		}
+		if target == "" {
+			continue
+		}
+		if ok, _ := vfs.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is root or below it.
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator)) ||
+		root == string(filepath.Separator) && strings.HasPrefix(path, root)
+}
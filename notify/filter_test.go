@@ -0,0 +1,119 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+func TestFilterPatterns(t *testing.T) {
+	f, err := NewFilter(vfs.NewMemMapFs(), FilterOptions{
+		Include: []string{"**/*.go", "*.md"},
+		Exclude: []string{"**/node_modules", "/src/.git", "*.tmp", "build/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/src/main.go", false, false},
+		{"/src/README", false, true},
+		{"/src/pkg", true, false},
+		{"/src/node_modules", true, true},
+		{"/src/web/node_modules/x/y.go", false, true},
+		{"/src/.git/HEAD", false, true},
+		{"/src/.git", true, true},
+		{"/src/README.md", false, false},
+		{"/src/doc/README.md", false, true},
+		{"/src/x.tmp", true, true},
+		{"/src/pkg/x.tmp", true, false},
+		{"/src/build/gen", true, true},
+		{"/src/build/gen/a.go", false, true},
+		{"/src/build", true, false},
+	} {
+		if got := f.Ignored(filepath.FromSlash(tc.name), filepath.FromSlash("/src"), tc.isDir); got != tc.ignored {
+			t.Errorf("Ignored(%q) = %v, want %v", tc.name, got, tc.ignored)
+		}
+	}
+
+	if _, err := NewFilter(vfs.NewMemMapFs(), FilterOptions{Exclude: []string{"["}}); err != filepath.ErrBadPattern {
+		t.Errorf("expected ErrBadPattern, got %v", err)
+	}
+	if f, _ := NewFilter(vfs.NewMemMapFs(), FilterOptions{}); f != nil || f.Ignored("/a", "/", false) {
+		t.Errorf("expected a nil filter ignoring nothing, got %v", f)
+	}
+
+	// Directories above the watched path are not looked at.
+	if !f.Ignored(filepath.FromSlash("/src/node_modules/x/a.go"), filepath.FromSlash("/src"), false) {
+		t.Error("file below an excluded directory not ignored")
+	}
+	if f.Ignored(filepath.FromSlash("/src/node_modules/x/a.go"), filepath.FromSlash("/src/node_modules/x"), false) {
+		t.Error("file ignored for an excluded directory above the watched path")
+	}
+}
+
+func TestFilterIgnoreFiles(t *testing.T) {
+	fs := vfs.NewMemMapFs()
+	vfs.WriteFile(fs, "/repo/.gitignore", []byte("# build outputs\n*.o\nbuild/\n/tmp\n!keep.o\n"), 0644)
+	vfs.WriteFile(fs, "/repo/lib/.gitignore", []byte("!*.o\ngen/*.go\n"), 0644)
+	fs.MkdirAll("/repo/build", 0755)
+	fs.MkdirAll("/repo/lib/gen", 0755)
+
+	f, err := NewFilter(fs, FilterOptions{IgnoreFiles: []string{".gitignore"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.LoadTree("/repo")
+
+	for _, tc := range []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/repo/main.c", false, false},
+		{"/repo/main.o", false, true},
+		{"/repo/sub/main.o", false, true},
+		{"/repo/keep.o", false, false},
+		{"/repo/build", true, true},
+		{"/repo/build/out", false, true},
+		{"/repo/x/build", false, false}, // build/ only matches directories
+		{"/repo/tmp", false, true},
+		{"/repo/x/tmp", false, false}, // /tmp is anchored
+		{"/repo/lib/lib.o", false, false},
+		{"/repo/lib/gen/a.go", false, true},
+		{"/repo/lib/gen/a.c", false, false},
+	} {
+		if got := f.Ignored(filepath.FromSlash(tc.name), filepath.FromSlash("/repo"), tc.isDir); got != tc.ignored {
+			t.Errorf("Ignored(%q) = %v, want %v", tc.name, got, tc.ignored)
+		}
+	}
+
+	if !f.IsIgnoreFile("/repo/lib/.gitignore") || f.IsIgnoreFile("/repo/main.c") {
+		t.Error("IsIgnoreFile does not recognise the ignore files")
+	}
+	vfs.WriteFile(fs, "/repo/lib/.gitignore", nil, 0644)
+	f.Load("/repo/lib")
+	if !f.Ignored("/repo/lib/lib.o", "/repo", false) {
+		t.Error("rules of a reloaded ignore file still apply")
+	}
+
+	// Directories checked before take new rules above them into account.
+	if f.Ignored("/repo/lib/gen/a.c", "/repo", false) {
+		t.Error("/repo/lib/gen/a.c ignored")
+	}
+	vfs.WriteFile(fs, "/repo/lib/.gitignore", []byte("gen/\n"), 0644)
+	f.Load("/repo/lib")
+	if !f.Ignored("/repo/lib/gen/a.c", "/repo", false) {
+		t.Error("rules of a changed ignore file do not apply below it")
+	}
+}
@@ -0,0 +1,667 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"github.com/gottingen/felix/notify"
+)
+
+// fanotify constants missing from golang.org/x/sys/unix.
+const (
+	fanReportDirFID = 0x00000400
+	fanReportName   = 0x00000800
+
+	fanEventInfoTypeDFIDName = 2
+
+	fanEventMetadataLen = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+)
+
+// fanWatcher watches whole filesystems with fanotify. A single mark per
+// filesystem replaces the inotify watch per directory, so the number of
+// watched directories is not limited by max_user_watches. The kernel reports
+// a directory file handle and an entry name with every event; the handle is
+// resolved to a path and events outside the watched paths are dropped.
+//
+// Marking a filesystem needs CAP_SYS_ADMIN and name reporting needs Linux
+// 5.9 or later. Paths whose filesystem cannot be marked are watched by an
+// inotify watcher instead, whose events are forwarded.
+type fanWatcher struct {
+	overflows uint64 // Kernel queue overflows, accessed atomically; first for alignment
+	Events    chan notify.Event
+	Errors    chan error
+	mu        sync.Mutex
+	fd        int
+	poller    *fdPoller
+	watches   map[string]*fanWatch   // key: path with symlinks resolved
+	mounts    map[[2]int32]*fanMount // key: fsid
+	done      chan struct{}
+	doneResp  chan struct{}
+	queue     *eventQueue    // Queue in front of Events
+	filter    *notify.Filter // nil if nothing is filtered
+	opts      Options
+
+	inotify        *osWatcher      // Watcher of the paths fanotify cannot mark, if any
+	inotifyStopped chan struct{}   // Closed when its events are no longer forwarded
+	inotified      map[string]bool // Paths watched with inotify (key: path as given to Add)
+}
+
+type fanWatch struct {
+	name      string    // Path as given to Add, used in events
+	ops       notify.Op // Ops to report
+	recursive bool      // Everything below the path is watched too
+	fsid      [2]int32  // Filesystem of the path
+}
+
+// fanMount is a marked filesystem.
+type fanMount struct {
+	fd   int    // Open file on the filesystem, to resolve file handles
+	mask uint64 // Mask of the filesystem mark
+}
+
+var (
+	_ notify.RecursiveWatcher = (*fanWatcher)(nil)
+	_ notify.OpsWatcher       = (*fanWatcher)(nil)
+	_ notify.StatsWatcher     = (*fanWatcher)(nil)
+)
+
+// fanotifyMark is replaced in tests to run into filesystems that cannot be
+// marked.
+var fanotifyMark = unix.FanotifyMark
+
+// newFanotifyWatcher returns a fanotify watcher, or the error of
+// fanotify_init. See fanotifyUnsupported.
+func newFanotifyWatcher(opts Options, filter *notify.Filter) (*fanWatcher, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|fanReportDirFID|fanReportName,
+		unix.O_RDONLY|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	poller, err := newFdPoller(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	w := &fanWatcher{
+		fd:        fd,
+		poller:    poller,
+		watches:   make(map[string]*fanWatch),
+		mounts:    make(map[[2]int32]*fanMount),
+		Events:    make(chan notify.Event, opts.EventBuffer),
+		Errors:    make(chan error),
+		done:      make(chan struct{}),
+		doneResp:  make(chan struct{}),
+		filter:    filter,
+		opts:      opts,
+		inotified: make(map[string]bool),
+	}
+	w.queue = newEventQueue(w.Events, w.done, opts.QueueSize, opts.DropPolicy)
+	go w.readEvents()
+	return w, nil
+}
+
+// fanotifyUnsupported reports whether err from fanotify_init or
+// fanotify_mark means fanotify cannot be used here, either for lack of
+// CAP_SYS_ADMIN (fanotify_init succeeds without it since Linux 5.13, but
+// filesystem marks need it), because the kernel is too old or because the
+// filesystem cannot be marked as a whole or report file handles (EXDEV and
+// ENODEV, as on overlayfs and btrfs subvolumes).
+func fanotifyUnsupported(err error) bool {
+	switch err {
+	case unix.EPERM, unix.EINVAL, unix.ENOSYS, unix.EOPNOTSUPP, unix.EXDEV, unix.ENODEV:
+		return true
+	}
+	return false
+}
+
+func (w *fanWatcher) EventChannel() <-chan notify.Event {
+	return w.Events
+}
+
+func (w *fanWatcher) ErrorChannel() <-chan error {
+	return w.Errors
+}
+
+func (w *fanWatcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close removes all marks and closes the events channel.
+func (w *fanWatcher) Close() error {
+	if w.isClosed() {
+		return nil
+	}
+	close(w.done)
+	w.queue.close()
+	w.poller.wake()
+	<-w.doneResp
+	return nil
+}
+
+// Stats reports on the delivery of events, see Options.QueueSize. The
+// events of the paths watched with inotify are included.
+func (w *fanWatcher) Stats() notify.Stats {
+	depth, dropped := w.queue.stats()
+	stats := notify.Stats{QueueDepth: depth, Dropped: dropped, Overflows: atomic.LoadUint64(&w.overflows)}
+	w.mu.Lock()
+	iw := w.inotify
+	w.mu.Unlock()
+	if iw != nil {
+		is := iw.Stats()
+		stats.QueueDepth += is.QueueDepth
+		stats.Dropped += is.Dropped
+		stats.Overflows += is.Overflows
+	}
+	return stats
+}
+
+// Add starts watching the named file or directory (non-recursively).
+func (w *fanWatcher) Add(name string) error {
+	return w.add(name, defaultOps, false)
+}
+
+// AddRecursive starts watching the named directory and everything below it.
+// No extra kernel resources are used for the directories below it.
+func (w *fanWatcher) AddRecursive(name string) error {
+	return w.add(name, defaultOps, true)
+}
+
+// AddWithOps starts watching the named file or directory (non-recursively)
+// for the events of ops only.
+func (w *fanWatcher) AddWithOps(name string, ops notify.Op) error {
+	return w.add(name, ops, false)
+}
+
+func (w *fanWatcher) add(name string, ops notify.Op, recursive bool) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return errors.New("fanotify instance already closed")
+	}
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return err
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(real, &st); err != nil {
+		return err
+	}
+	if recursive {
+		w.filter.LoadTree(name)
+	} else {
+		w.filter.Load(name)
+	}
+	err = w.mark(name, real, st.Fsid.Val, ops, recursive)
+	if fanotifyUnsupported(err) {
+		return w.addInotify(name, ops, recursive)
+	}
+	return err
+}
+
+// mark marks the filesystem fsid of real, if needed, and watches real.
+func (w *fanWatcher) mark(name, real string, fsid [2]int32, ops notify.Op, recursive bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed() {
+		return errors.New("fanotify instance already closed")
+	}
+	mount, marked := w.mounts[fsid]
+	if !marked {
+		mountFd, err := unix.Open(real, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		mount = &fanMount{fd: mountFd}
+	}
+	// Marks only grow while the filesystem is watched; ops are filtered per
+	// watch when reading.
+	mask := fanotifyMask(ops)
+	if err := fanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, mask, unix.AT_FDCWD, real); err != nil {
+		if !marked {
+			unix.Close(mount.fd)
+		}
+		return err
+	}
+	mount.mask |= mask
+	w.mounts[fsid] = mount
+
+	if watch, ok := w.watches[real]; ok {
+		watch.ops |= ops
+		watch.recursive = watch.recursive || recursive
+		return nil
+	}
+	w.watches[real] = &fanWatch{name: name, ops: ops, recursive: recursive, fsid: fsid}
+	return nil
+}
+
+// addInotify watches name with inotify, for a filesystem fanotify cannot
+// mark.
+func (w *fanWatcher) addInotify(name string, ops notify.Op, recursive bool) error {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return errors.New("fanotify instance already closed")
+	}
+	if w.inotify == nil {
+		iw, err := newInotifyWatcher(w.opts, w.filter)
+		if err != nil {
+			w.mu.Unlock()
+			return err
+		}
+		w.inotify, w.inotifyStopped = iw, make(chan struct{})
+		go w.forwardInotify(iw, w.inotifyStopped)
+	}
+	iw := w.inotify
+	w.mu.Unlock()
+
+	var err error
+	if recursive {
+		err = iw.AddRecursive(name)
+	} else {
+		err = iw.AddWithOps(name, ops)
+	}
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inotified[name] = true
+	return nil
+}
+
+// forwardInotify sends the events and errors of the inotify watcher iw
+// until its channels are closed.
+func (w *fanWatcher) forwardInotify(iw *osWatcher, stopped chan struct{}) {
+	defer close(stopped)
+
+	events, errs := iw.EventChannel(), iw.ErrorChannel()
+	for events != nil || errs != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.queue.push(ev)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case w.Errors <- err:
+			case <-w.done:
+			}
+		}
+	}
+}
+
+// stopInotify closes the inotify watcher and waits until nothing is
+// forwarded any more.
+func (w *fanWatcher) stopInotify() {
+	w.mu.Lock()
+	iw, stopped := w.inotify, w.inotifyStopped
+	w.mu.Unlock()
+	if iw != nil {
+		iw.Close()
+		<-stopped
+	}
+}
+
+// fanotifyMask returns the fanotify mask needed to produce the events of
+// ops, on directories as well as files.
+func fanotifyMask(ops notify.Op) uint64 {
+	var mask uint64 = unix.FAN_ONDIR | unix.FAN_DELETE | unix.FAN_MOVED_FROM
+	if ops&notify.Create != 0 {
+		mask |= unix.FAN_CREATE | unix.FAN_MOVED_TO
+	}
+	if ops&notify.Write != 0 {
+		mask |= unix.FAN_MODIFY
+	}
+	if ops&notify.Remove != 0 {
+		mask |= unix.FAN_DELETE
+	}
+	if ops&notify.Rename != 0 {
+		mask |= unix.FAN_MOVED_FROM
+	}
+	if ops&notify.Chmod != 0 {
+		mask |= unix.FAN_ATTRIB
+	}
+	if ops&notify.CloseWrite != 0 {
+		mask |= unix.FAN_CLOSE_WRITE
+	}
+	if ops&notify.CloseNoWrite != 0 {
+		mask |= unix.FAN_CLOSE_NOWRITE
+	}
+	if ops&notify.Open != 0 {
+		mask |= unix.FAN_OPEN
+	}
+	if ops&notify.Access != 0 {
+		mask |= unix.FAN_ACCESS
+	}
+	return mask
+}
+
+// Remove stops watching the named file or directory. The filesystem is
+// unmarked once no watched path is left on it.
+func (w *fanWatcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inotified[name] {
+		delete(w.inotified, name)
+		return w.inotify.Remove(name)
+	}
+	for real, watch := range w.watches {
+		if watch.name == name {
+			return w.unwatch(real)
+		}
+	}
+	return fmt.Errorf("can't remove non-existent fanotify watch for: %s", name)
+}
+
+// unwatch drops the watch of the path real, if any, and unmarks its
+// filesystem if it was the last watch there. w.mu must be held.
+func (w *fanWatcher) unwatch(real string) error {
+	watch, ok := w.watches[real]
+	if !ok {
+		return nil
+	}
+	delete(w.watches, real)
+	for _, other := range w.watches {
+		if other.fsid == watch.fsid {
+			return nil
+		}
+	}
+	mount := w.mounts[watch.fsid]
+	delete(w.mounts, watch.fsid)
+	defer unix.Close(mount.fd)
+	return fanotifyMark(w.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_FILESYSTEM, mount.mask, mount.fd, "")
+}
+
+// match returns the name to report for the path real, the watch root it is
+// reported against and the ops watched for it, or 0 ops if it is not
+// watched. w.mu must be held.
+func (w *fanWatcher) match(real string) (string, string, notify.Op) {
+	var (
+		name, root string
+		ops        notify.Op
+	)
+	for path, watch := range w.watches {
+		var inside bool
+		switch {
+		case path == real, path == filepath.Dir(real):
+			inside = true
+		case watch.recursive && strings.HasPrefix(real, path+string(filepath.Separator)):
+			inside = true
+		case watch.recursive && path == string(filepath.Separator):
+			inside = true
+		}
+		if !inside {
+			continue
+		}
+		ops |= watch.ops
+		if n := watch.name + strings.TrimPrefix(real, path); name == "" || len(n) < len(name) {
+			name, root = n, watch.name
+		}
+	}
+	return name, root, ops
+}
+
+func (w *fanWatcher) readEvents() {
+	var (
+		buf   [4096 * fanEventMetadataLen]byte
+		n     int
+		errno error
+		ok    bool
+	)
+
+	defer close(w.doneResp)
+	defer close(w.Errors)
+	defer close(w.Events)
+	defer w.stopInotify()
+	defer w.closeMounts()
+	defer unix.Close(w.fd)
+	defer w.poller.close()
+	defer w.queue.close()
+
+	for {
+		if w.isClosed() {
+			return
+		}
+
+		ok, errno = w.poller.wait()
+		if errno != nil {
+			select {
+			case w.Errors <- errno:
+			case <-w.done:
+				return
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		n, errno = unix.Read(w.fd, buf[:])
+		if errno == unix.EINTR {
+			continue
+		}
+		if w.isClosed() {
+			return
+		}
+		if n < fanEventMetadataLen {
+			var err error
+			if n == 0 {
+				err = io.EOF
+			} else if n < 0 {
+				err = errno
+			} else {
+				err = errors.New("notify: short read in readEvents()")
+			}
+			select {
+			case w.Errors <- err:
+			case <-w.done:
+				return
+			}
+			continue
+		}
+
+		for offset := 0; offset+fanEventMetadataLen <= n; {
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if int(meta.Event_len) < fanEventMetadataLen || offset+int(meta.Event_len) > n {
+				break
+			}
+			if meta.Fd >= 0 {
+				unix.Close(int(meta.Fd))
+			}
+
+			if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				atomic.AddUint64(&w.overflows, 1)
+				select {
+				case w.Errors <- notify.ErrEventOverflow:
+				case <-w.done:
+					return
+				}
+			}
+
+			info := buf[offset+int(meta.Metadata_len) : offset+int(meta.Event_len)]
+			if event, ok := w.newEvent(meta.Mask, info); ok {
+				if !w.queue.push(event) {
+					return
+				}
+			}
+			offset += int(meta.Event_len)
+		}
+	}
+}
+
+// newEvent returns the event for a fanotify mask and its info records, or
+// false if it is not watched or its directory cannot be resolved.
+//
+// Every change is reported against the directory entry it affects, so the
+// self events of watched paths are not needed: a watch is dropped when its
+// path is removed or renamed, like an inotify watch goes away with its file.
+func (w *fanWatcher) newEvent(mask uint64, info []byte) (notify.Event, bool) {
+	var real string
+	for len(info) >= 4 && real == "" {
+		typ, size := info[0], int(*(*uint16)(unsafe.Pointer(&info[2])))
+		if size < 4 || size > len(info) {
+			break
+		}
+		record := info[:size]
+		info = info[size:]
+		if typ != fanEventInfoTypeDFIDName {
+			continue
+		}
+		fsid, handle, name, ok := parseFID(record)
+		if !ok {
+			continue
+		}
+		dir, err := w.resolve(fsid, handle)
+		if err != nil {
+			return notify.Event{}, false
+		}
+		real = dir
+		if name != "." {
+			real = filepath.Join(dir, name)
+		}
+	}
+	if real == "" {
+		return notify.Event{}, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	name, root, ops := w.match(real)
+	if mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0 {
+		w.unwatch(real)
+	}
+	if w.filter.IsIgnoreFile(name) {
+		w.filter.Load(filepath.Dir(name))
+	}
+	isDir := mask&unix.FAN_ONDIR != 0
+	if w.filter.Ignored(name, root, isDir) {
+		return notify.Event{}, false
+	}
+	event := notify.Event{
+		Name:  name,
+		Op:    fanotifyOps(mask) & ops,
+		Time:  time.Now(),
+		IsDir: isDir,
+		Root:  root,
+	}
+	if event.Op == 0 {
+		return notify.Event{}, false
+	}
+	return event, true
+}
+
+// parseFID parses a fanotify_event_info_fid record with a name: header,
+// fsid, file handle and the entry name.
+func parseFID(record []byte) (fsid [2]int32, handle unix.FileHandle, name string, ok bool) {
+	const headerLen = 4 + 8 + 8 // header, fsid, handle_bytes and handle_type
+	if len(record) < headerLen {
+		return fsid, handle, "", false
+	}
+	fsid = *(*[2]int32)(unsafe.Pointer(&record[4]))
+	size := int(*(*uint32)(unsafe.Pointer(&record[12])))
+	typ := *(*int32)(unsafe.Pointer(&record[16]))
+	if headerLen+size > len(record) {
+		return fsid, handle, "", false
+	}
+	handle = unix.NewFileHandle(typ, record[headerLen:headerLen+size])
+	name = string(record[headerLen+size:])
+	if i := strings.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return fsid, handle, name, true
+}
+
+// resolve returns the current path of the file with the given handle.
+func (w *fanWatcher) resolve(fsid [2]int32, handle unix.FileHandle) (string, error) {
+	w.mu.Lock()
+	mount, ok := w.mounts[fsid]
+	w.mu.Unlock()
+	if !ok {
+		return "", unix.ESTALE
+	}
+	fd, err := unix.OpenByHandleAt(mount.fd, handle, unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(path, " (deleted)") {
+		return "", unix.ESTALE
+	}
+	return path, nil
+}
+
+func (w *fanWatcher) closeMounts() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for fsid, mount := range w.mounts {
+		unix.Close(mount.fd)
+		delete(w.mounts, fsid)
+	}
+}
+
+// fanotifyOps returns the ops of a fanotify mask.
+func fanotifyOps(mask uint64) notify.Op {
+	var op notify.Op
+	if mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+		op |= notify.Create
+	}
+	if mask&unix.FAN_DELETE != 0 {
+		op |= notify.Remove
+	}
+	if mask&unix.FAN_MODIFY != 0 {
+		op |= notify.Write
+	}
+	if mask&unix.FAN_MOVED_FROM != 0 {
+		op |= notify.Rename
+	}
+	if mask&unix.FAN_ATTRIB != 0 {
+		op |= notify.Chmod
+	}
+	if mask&unix.FAN_CLOSE_WRITE != 0 {
+		op |= notify.CloseWrite
+	}
+	if mask&unix.FAN_CLOSE_NOWRITE != 0 {
+		op |= notify.CloseNoWrite
+	}
+	if mask&unix.FAN_OPEN != 0 {
+		op |= notify.Open
+	}
+	if mask&unix.FAN_ACCESS != 0 {
+		op |= notify.Access
+	}
+	return op
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fsnotify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"github.com/gottingen/felix/notify"
+)
+
+// newFanWatcher returns a fanotify watcher, skipping the test without
+// CAP_SYS_ADMIN, on kernels without name reporting or if the temporary
+// directory cannot be marked.
+func newFanWatcher(t *testing.T) *fanWatcher {
+	w, err := newFanotifyWatcher(Options{}, nil)
+	if err == nil {
+		const flags = unix.FAN_MARK_FILESYSTEM
+		if err = unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|flags, unix.FAN_CREATE, unix.AT_FDCWD, os.TempDir()); err == nil {
+			unix.FanotifyMark(w.fd, unix.FAN_MARK_REMOVE|flags, unix.FAN_CREATE, unix.AT_FDCWD, os.TempDir())
+			return w
+		}
+		w.Close()
+	}
+	if fanotifyUnsupported(err) {
+		t.Skipf("fanotify not available: %v", err)
+	}
+	t.Fatalf("newFanotifyWatcher(Options{}, nil) failed: %v", err)
+	return nil
+}
+
+// nextFanEvent returns the next event of w.
+func nextFanEvent(t *testing.T, w notify.Watcher) notify.Event {
+	select {
+	case ev := <-w.EventChannel():
+		return ev
+	case err := <-w.ErrorChannel():
+		t.Fatalf("Error from watcher: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Took too long to wait for event")
+	}
+	return notify.Event{}
+}
+
+func TestFanotifyEvents(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	other := tempMkdir(t)
+	defer os.RemoveAll(other)
+
+	w := newFanWatcher(t)
+	defer w.Close()
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Changes outside the watched directory are filtered out.
+	if err := ioutil.WriteFile(filepath.Join(other, "ignored"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(testDir, "file")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextFanEvent(t, w); ev.Name != name || ev.Op != notify.Create || ev.Root != testDir || ev.IsDir {
+		t.Errorf("Unexpected event: %v (Root %q, IsDir %v)", ev, ev.Root, ev.IsDir)
+	}
+	if _, err := f.WriteString("data"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if ev := nextFanEvent(t, w); ev.Name != name || ev.Op != notify.Write {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextFanEvent(t, w); ev.Name != name || ev.Op != notify.Remove {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+}
+
+func TestFanotifyAddRecursive(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w := newFanWatcher(t)
+	defer w.Close()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	deep := filepath.Join(testDir, "a", "b", "c")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(deep, "file")
+	if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, filepath.Join(testDir, "a"), filepath.Join(testDir, "a", "b"), deep, name)
+
+	// No watch was installed for the directories below the watched one.
+	w.mu.Lock()
+	n := len(w.watches)
+	w.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected one watch, got %d", n)
+	}
+}
+
+// fanMarks returns the number of filesystems marked by w.
+func fanMarks(t *testing.T, w *fanWatcher) int {
+	info, err := ioutil.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", w.fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(info), "fanotify sdev:")
+}
+
+func TestFanotifyRemove(t *testing.T) {
+	a := tempMkdir(t)
+	defer os.RemoveAll(a)
+	b := tempMkdir(t)
+	defer os.RemoveAll(b)
+
+	w := newFanWatcher(t)
+	defer w.Close()
+	if err := w.Add(a); err != nil {
+		t.Fatalf("Failed to add a: %v", err)
+	}
+	if err := w.Add(b); err != nil {
+		t.Fatalf("Failed to add b: %v", err)
+	}
+	if n := fanMarks(t, w); n != 1 {
+		t.Fatalf("Expected one filesystem mark, got %d", n)
+	}
+
+	// The filesystem stays marked for the other path on it.
+	if err := w.Remove(a); err != nil {
+		t.Fatalf("Failed to remove a: %v", err)
+	}
+	if n := fanMarks(t, w); n != 1 {
+		t.Errorf("Filesystem unmarked with a path left on it")
+	}
+	if err := w.Remove(b); err != nil {
+		t.Fatalf("Failed to remove b: %v", err)
+	}
+	if n := fanMarks(t, w); n != 0 {
+		t.Errorf("Filesystem still marked after removing every path")
+	}
+	w.mu.Lock()
+	n := len(w.mounts)
+	w.mu.Unlock()
+	if n != 0 {
+		t.Errorf("Expected no mounts, got %d", n)
+	}
+}
+
+func TestFanotifyFallbackPerPath(t *testing.T) {
+	marked := tempMkdir(t)
+	defer os.RemoveAll(marked)
+	unmarked := tempMkdir(t)
+	defer os.RemoveAll(unmarked)
+
+	// The filesystem of unmarked cannot be marked, like overlayfs.
+	real, err := filepath.EvalSymlinks(unmarked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(mark func(int, uint, uint64, int, string) error) { fanotifyMark = mark }(fanotifyMark)
+	fanotifyMark = func(fd int, flags uint, mask uint64, dirFd int, path string) error {
+		if path == real {
+			return unix.EXDEV
+		}
+		return unix.FanotifyMark(fd, flags, mask, dirFd, path)
+	}
+
+	w := newFanWatcher(t)
+	defer w.Close()
+	if err := w.Add(marked); err != nil {
+		t.Fatalf("Failed to add marked: %v", err)
+	}
+	if err := w.Add(unmarked); err != nil {
+		t.Fatalf("Failed to add unmarked: %v", err)
+	}
+	names := []string{filepath.Join(marked, "file"), filepath.Join(unmarked, "file")}
+	for _, name := range names {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCreates(t, w, names...)
+
+	w.mu.Lock()
+	n, inotified := len(w.watches), w.inotified[unmarked]
+	w.mu.Unlock()
+	if n != 1 || !inotified {
+		t.Errorf("Expected one fanotify watch and unmarked watched with inotify, got %d, %v", n, inotified)
+	}
+	if err := w.Remove(unmarked); err != nil {
+		t.Errorf("Failed to remove unmarked: %v", err)
+	}
+}
+
+func TestFanotifyFallback(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	// Whether or not fanotify is available, a working watcher is returned.
+	w, err := NewWatcherWithOptions(Options{Fanotify: true})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	name := filepath.Join(testDir, "file")
+	if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, name)
+}
@@ -70,3 +70,21 @@ func TestWatcherClose(t *testing.T) {
 	}
 }
 
+
+func TestEventStringWithOldName(t *testing.T) {
+	event := notify.Event{Name: "/usr/new", OldName: "/usr/old", Op: notify.Rename}
+	expected := `"/usr/old" -> "/usr/new": RENAME`
+	if event.String() != expected {
+		t.Fatalf("Expected %s, got: %v", expected, event.String())
+	}
+}
+
+func TestEventOpStringWithOptInOps(t *testing.T) {
+	op := notify.Write | notify.CloseWrite | notify.Open
+	if op.String() != "WRITE|CLOSE_WRITE|OPEN" {
+		t.Fatalf("Expected WRITE|CLOSE_WRITE|OPEN, got: %v", op.String())
+	}
+	if notify.Resync.String() != "RESYNC" {
+		t.Fatalf("Expected RESYNC, got: %v", notify.Resync.String())
+	}
+}
@@ -10,33 +10,88 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 	"github.com/gottingen/felix/notify"
+	"github.com/gottingen/felix/vfs"
 )
 
 // Watcher watches a set of files, delivering events to a channel.
 type osWatcher struct {
-	Events   chan notify.Event
-	Errors   chan error
-	mu       sync.Mutex // Map access
-	fd       int
-	poller   *fdPoller
-	watches  map[string]*watch // Map of inotify watches (key: path)
-	paths    map[int]string    // Map of watched paths (key: watch descriptor)
-	done     chan struct{}     // Channel for sending a "quit message" to the reader goroutine
-	doneResp chan struct{}     // Channel to respond to Close
+	overflows uint64 // Kernel queue overflows, accessed atomically; first for alignment
+	Events    chan notify.Event
+	Errors    chan error
+	mu        sync.Mutex // Map access
+	fd        int
+	poller    *fdPoller
+	watches   map[string]*watch // Map of inotify watches (key: path)
+	paths     map[int]string    // Map of watched paths (key: watch descriptor)
+	inodes    map[fileID]string // Map of watched paths with Options.FollowMoves
+	done      chan struct{}     // Channel for sending a "quit message" to the reader goroutine
+	doneResp  chan struct{}     // Channel to respond to Close
+	opts      Options
+	queue     *eventQueue    // Queue in front of Events
+	filter    *notify.Filter // nil if nothing is filtered
+
+	// With Options.WatchLimitPolicy PollOnLimit, paths that could not be
+	// watched are polled.
+	polling     *notify.PollingWatcher
+	pollStopped chan struct{}       // Closed when the polled events are no longer forwarded
+	degraded    map[string]fallback // key: polled path
+}
+
+// fallback is a path watched by polling instead of inotify.
+type fallback struct {
+	root string
+	ops  notify.Op
 }
 
+// inotifyAddWatch is replaced in tests to run into the watch limit.
+var inotifyAddWatch = unix.InotifyAddWatch
+
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (notify.Watcher, error) {
+	return NewWatcherWithOptions(Options{})
+}
+
+// NewWatcherWithOptions is NewWatcher with the behaviour configured by opts.
+func NewWatcherWithOptions(opts Options) (notify.Watcher, error) {
+	filter, err := notify.NewFilter(vfs.NewOsFs(), opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Fanotify {
+		w, err := newFanotifyWatcher(opts, filter)
+		if err == nil {
+			return w, nil
+		}
+		if !fanotifyUnsupported(err) {
+			return nil, err
+		}
+	}
+	w, err := newInotifyWatcher(opts, filter)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// newInotifyWatcher returns an inotify watcher filtering with filter.
+func newInotifyWatcher(opts Options, filter *notify.Filter) (*osWatcher, error) {
 	// Create inotify fd
 	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC)
 	if fd == -1 {
+		if errno == unix.EMFILE {
+			return nil, &LimitError{Limit: ErrInstanceLimit, Err: errno}
+		}
 		return nil, errno
 	}
 	// Create epoll
@@ -50,11 +105,16 @@ func NewWatcher() (notify.Watcher, error) {
 		poller:   poller,
 		watches:  make(map[string]*watch),
 		paths:    make(map[int]string),
-		Events:   make(chan notify.Event),
+		inodes:   make(map[fileID]string),
+		degraded: make(map[string]fallback),
+		Events:   make(chan notify.Event, opts.EventBuffer),
 		Errors:   make(chan error),
 		done:     make(chan struct{}),
 		doneResp: make(chan struct{}),
+		opts:     opts,
+		filter:   filter,
 	}
+	w.queue = newEventQueue(w.Events, w.done, opts.QueueSize, opts.DropPolicy)
 
 	go w.readEvents()
 	return w, nil
@@ -85,6 +145,7 @@ func (w *osWatcher) Close() error {
 
 	// Send 'close' signal to goroutine, and set the Watcher to closed.
 	close(w.done)
+	w.queue.close()
 
 	// Wake up goroutine
 	w.poller.wake()
@@ -95,6 +156,23 @@ func (w *osWatcher) Close() error {
 	return nil
 }
 
+var (
+	_ notify.RecursiveWatcher = (*osWatcher)(nil)
+	_ notify.OpsWatcher       = (*osWatcher)(nil)
+	_ notify.StatsWatcher     = (*osWatcher)(nil)
+	_ notify.DegradedWatcher  = (*osWatcher)(nil)
+)
+
+// Stats reports on the delivery of events, see Options.QueueSize.
+func (w *osWatcher) Stats() notify.Stats {
+	depth, dropped := w.queue.stats()
+	return notify.Stats{QueueDepth: depth, Dropped: dropped, Overflows: atomic.LoadUint64(&w.overflows)}
+}
+
+const agnosticEvents = unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_MODIFY |
+	unix.IN_MOVE_SELF | unix.IN_DELETE | unix.IN_DELETE_SELF
+
 // Add starts watching the named file or directory (non-recursively).
 func (w *osWatcher) Add(name string) error {
 	name = filepath.Clean(name)
@@ -102,34 +180,352 @@ func (w *osWatcher) Add(name string) error {
 		return errors.New("inotify instance already closed")
 	}
 
-	const agnosticEvents = unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
-		unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_MODIFY |
-		unix.IN_MOVE_SELF | unix.IN_DELETE | unix.IN_DELETE_SELF
+	w.filter.Load(name)
+	w.mu.Lock()
+	err := w.addWatch(name, name, agnosticEvents, defaultOps, false)
+	w.mu.Unlock()
+	if w.pollOnLimit(err) {
+		return w.degrade(name, name, defaultOps, false)
+	}
+	return err
+}
 
-	var flags uint32 = agnosticEvents
+// AddWithOps starts watching the named file or directory (non-recursively)
+// for the events of ops only.
+func (w *osWatcher) AddWithOps(name string, ops notify.Op) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return errors.New("inotify instance already closed")
+	}
 
+	w.filter.Load(name)
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	err := w.addWatch(name, name, w.inotifyFlags(ops), ops, false)
+	w.mu.Unlock()
+	if w.pollOnLimit(err) {
+		return w.degrade(name, name, ops, false)
+	}
+	return err
+}
+
+// inotifyFlags returns the inotify flags needed to produce the events of
+// ops. IN_DELETE_SELF is always set to keep track of removed watches.
+func (w *osWatcher) inotifyFlags(ops notify.Op) uint32 {
+	var flags uint32 = unix.IN_DELETE_SELF
+	if ops&notify.Create != 0 {
+		flags |= unix.IN_CREATE | unix.IN_MOVED_TO
+	}
+	if ops&notify.Write != 0 {
+		flags |= unix.IN_MODIFY
+	}
+	if ops&notify.Remove != 0 {
+		flags |= unix.IN_DELETE
+	}
+	if ops&notify.Rename != 0 {
+		flags |= unix.IN_MOVE_SELF | unix.IN_MOVED_FROM
+		if w.opts.CorrelateRenames {
+			flags |= unix.IN_MOVED_TO
+		}
+	}
+	if w.opts.FollowMoves {
+		// Files moved in may be watched ones moving.
+		flags |= unix.IN_MOVED_TO
+	}
+	if ops&notify.Chmod != 0 {
+		flags |= unix.IN_ATTRIB
+	}
+	if ops&notify.CloseWrite != 0 {
+		flags |= unix.IN_CLOSE_WRITE
+	}
+	if ops&notify.CloseNoWrite != 0 {
+		flags |= unix.IN_CLOSE_NOWRITE
+	}
+	if ops&notify.Open != 0 {
+		flags |= unix.IN_OPEN
+	}
+	if ops&notify.Access != 0 {
+		flags |= unix.IN_ACCESS
+	}
+	return flags
+}
+
+// AddRecursive starts watching the named directory and every directory
+// below it. Directories created or moved into the tree are watched as they
+// appear; Create events are sent for their contents, as these may have been
+// created before the watch was installed.
+func (w *osWatcher) AddRecursive(name string) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return errors.New("inotify instance already closed")
+	}
+
+	_, err := w.addTree(name, name)
+	return err
+}
+
+// addWatch installs a watch for name on behalf of the watch of root, or
+// extends an existing one. w.mu must be held.
+func (w *osWatcher) addWatch(name, root string, flags uint32, ops notify.Op, recursive bool) error {
 	watchEntry := w.watches[name]
 	if watchEntry != nil {
-		flags |= watchEntry.flags | unix.IN_MASK_ADD
+		flags |= watchEntry.flags
+		ops |= watchEntry.ops
 	}
-	wd, errno := unix.InotifyAddWatch(w.fd, name, flags)
+	mask := flags
+	if watchEntry != nil {
+		mask |= unix.IN_MASK_ADD
+	}
+	wd, errno := inotifyAddWatch(w.fd, name, mask)
 	if wd == -1 {
+		if errno == unix.ENOSPC {
+			return &LimitError{Path: name, Limit: ErrWatchLimit, Err: errno}
+		}
 		return errno
 	}
 
 	if watchEntry == nil {
-		w.watches[name] = &watch{wd: uint32(wd), flags: flags}
+		watchEntry = &watch{wd: uint32(wd), flags: flags, ops: ops, recursive: recursive, root: root}
+		if w.opts.RescanOnOverflow {
+			watchEntry.snap = snapshot(name)
+		}
+		if w.opts.FollowMoves {
+			var st unix.Stat_t
+			if unix.Stat(name, &st) == nil {
+				watchEntry.id = fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+				w.inodes[watchEntry.id] = name
+			}
+		}
+		w.watches[name] = watchEntry
 		w.paths[wd] = name
 	} else {
 		watchEntry.wd = uint32(wd)
 		watchEntry.flags = flags
+		watchEntry.ops = ops
+		watchEntry.recursive = watchEntry.recursive || recursive
+	}
+	return nil
+}
+
+// addTree installs recursive watches on dir and every directory below it,
+// on behalf of the watch of root, and returns Create events for the paths
+// found below dir. Entries that disappear while the tree is walked are
+// skipped, and so are ignored entries and directories.
+func (w *osWatcher) addTree(dir, root string) ([]notify.Event, error) {
+	var found []notify.Event
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if path != dir && w.filter.Ignored(path, root, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != dir {
+			found = append(found, notify.Event{
+				Name:  path,
+				Op:    notify.Create,
+				Time:  time.Now(),
+				IsDir: info.IsDir(),
+				Root:  root,
+				Info:  info,
+			})
+		}
+		if !info.IsDir() && path != dir {
+			return nil
+		}
+		w.filter.Load(path)
+		w.mu.Lock()
+		err = w.addWatch(path, root, agnosticEvents, defaultOps, true)
+		w.mu.Unlock()
+		if err == unix.ENOENT && path != dir {
+			return filepath.SkipDir
+		}
+		if w.pollOnLimit(err) {
+			if err := w.degrade(path, root, defaultOps, true); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return err
+	})
+	return found, err
+}
+
+// pollOnLimit reports whether err is the watch limit and paths are to be
+// polled then.
+func (w *osWatcher) pollOnLimit(err error) bool {
+	return w.opts.WatchLimitPolicy == PollOnLimit && errors.Is(err, ErrWatchLimit)
+}
+
+// degrade watches name by polling, on behalf of the watch of root.
+func (w *osWatcher) degrade(name, root string, ops notify.Op, recursive bool) error {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return errors.New("inotify instance already closed")
+	}
+	if w.polling == nil {
+		w.polling = notify.NewPollingWatcher(vfs.NewOsFs(), w.opts.pollInterval(), notify.PollingOptions{})
+		w.pollStopped = make(chan struct{})
+		go w.forwardPolls(w.polling, w.pollStopped)
 	}
+	p := w.polling
+	w.mu.Unlock()
 
+	add := p.Add
+	if recursive {
+		add = p.AddRecursive
+	}
+	if err := add(name); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.degraded[name] = fallback{root: root, ops: ops}
 	return nil
 }
 
+// forwardPolls sends the events and errors of the polling watcher p until
+// its channels are closed.
+func (w *osWatcher) forwardPolls(p *notify.PollingWatcher, stopped chan struct{}) {
+	defer close(stopped)
+
+	events, errs := p.EventChannel(), p.ErrorChannel()
+	for events != nil || errs != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.mu.Lock()
+			fb, ok := w.degraded[ev.Root]
+			w.mu.Unlock()
+			if !ok || w.filter.Ignored(ev.Name, fb.root, ev.IsDir) {
+				continue
+			}
+			ev.Op &= fb.ops
+			ev.Root = fb.root
+			if ev.Op != 0 {
+				w.queue.push(ev)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case w.Errors <- err:
+			case <-w.done:
+			}
+		}
+	}
+}
+
+// stopPolling closes the polling watcher and waits until nothing is
+// forwarded any more.
+func (w *osWatcher) stopPolling() {
+	w.mu.Lock()
+	p, stopped := w.polling, w.pollStopped
+	w.mu.Unlock()
+	if p != nil {
+		p.Close()
+		<-stopped
+	}
+}
+
+// Degraded returns the paths watched by polling because the watch limit
+// was reached, see Options.WatchLimitPolicy.
+func (w *osWatcher) Degraded() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	paths := make([]string, 0, len(w.degraded))
+	for path := range w.degraded {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// removeTree drops the watch for name and the recursive watches below it.
+// w.mu must be held.
+func (w *osWatcher) removeTree(name string) {
+	prefix := name + string(filepath.Separator)
+	for path, watch := range w.watches {
+		if path != name && !(watch.recursive && strings.HasPrefix(path, prefix)) {
+			continue
+		}
+		w.forget(path, watch)
+		unix.InotifyRmWatch(w.fd, watch.wd)
+	}
+	for path := range w.degraded {
+		if path == name || strings.HasPrefix(path, prefix) {
+			w.polling.Remove(path)
+			delete(w.degraded, path)
+		}
+	}
+}
+
+// forget drops the watch of path from the maps. w.mu must be held.
+func (w *osWatcher) forget(path string, watch *watch) {
+	if w.paths[int(watch.wd)] == path {
+		delete(w.paths, int(watch.wd))
+	}
+	if w.watches[path] == watch {
+		delete(w.watches, path)
+	}
+	if w.inodes[watch.id] == path {
+		delete(w.inodes, watch.id)
+	}
+}
+
+// follow moves the watch of the file now at name, and the watches below
+// it, to name if it was watched under another path, and reports whether
+// it did. The Rename of the watched path is reported with its old name.
+func (w *osWatcher) follow(name string) bool {
+	var st unix.Stat_t
+	if unix.Lstat(name, &st) != nil {
+		return false
+	}
+	id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old, ok := w.inodes[id]
+	if !ok || old == name {
+		return false
+	}
+	prefix := old + string(filepath.Separator)
+	moved := make(map[string]*watch)
+	for path, watch := range w.watches {
+		if path == old || strings.HasPrefix(path, prefix) {
+			moved[path] = watch
+			w.forget(path, watch)
+		}
+	}
+	for path, watch := range moved {
+		to := name + path[len(old):]
+		w.watches[to] = watch
+		w.paths[int(watch.wd)] = to
+		w.inodes[watch.id] = to
+		if watch.root == old || strings.HasPrefix(watch.root, prefix) {
+			watch.root = name + watch.root[len(old):]
+		}
+		if path == old {
+			watch.movedFrom = old
+		}
+		if watch.snap != nil {
+			watch.snap = snapshot(to)
+		}
+	}
+	return true
+}
+
 // Remove stops watching the named file or directory (non-recursively).
 func (w *osWatcher) Remove(name string) error {
 	name = filepath.Clean(name)
@@ -139,16 +535,26 @@ func (w *osWatcher) Remove(name string) error {
 	defer w.mu.Unlock()
 	watch, ok := w.watches[name]
 
+	if _, polled := w.degraded[name]; polled && !ok {
+		delete(w.degraded, name)
+		return w.polling.Remove(name)
+	}
+
 	// Remove it from inotify.
 	if !ok {
 		return fmt.Errorf("can't remove non-existent inotify watch for: %s", name)
 	}
 
+	// Removing a directory of a recursive watch drops the tree below it.
+	if watch.recursive {
+		w.removeTree(name)
+		return nil
+	}
+
 	// We successfully removed the watch if InotifyRmWatch doesn't return an
 	// error, we need to clean up our internal state to ensure it matches
 	// inotify's kernel state.
-	delete(w.paths, int(watch.wd))
-	delete(w.watches, name)
+	w.forget(name, watch)
 
 	// inotify_rm_watch will return EINVAL if the file has been deleted;
 	// the inotify will already have been removed.
@@ -171,8 +577,22 @@ func (w *osWatcher) Remove(name string) error {
 }
 
 type watch struct {
-	wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
-	flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	wd        uint32    // Watch descriptor (as returned by the inotify_add_watch() syscall)
+	flags     uint32    // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	ops       notify.Op // Ops to report; the kernel may send more
+	recursive bool      // Directories created in this directory are watched too
+	root      string    // Path of the Add or AddRecursive call installing the watch
+	id        fileID    // File watched, with Options.FollowMoves
+	movedFrom string    // Path the watch had before its last move, with Options.FollowMoves
+
+	// snap is the state of the watched path and its entries, kept with
+	// Options.RescanOnOverflow.
+	snap notify.Snapshot
+}
+
+// fileID identifies a file independently of its path.
+type fileID struct {
+	dev, ino uint64
 }
 
 // readEvents reads from the inotify file descriptor, converts the
@@ -183,6 +603,7 @@ func (w *osWatcher) readEvents() {
 		n     int                                  // Number of bytes read with read()
 		errno error                                // Syscall errno
 		ok    bool                                 // For poller.wait
+		moves = make(map[uint32]pendingMove)       // IN_MOVED_FROM halves by cookie
 	)
 
 	defer close(w.doneResp)
@@ -190,6 +611,8 @@ func (w *osWatcher) readEvents() {
 	defer close(w.Events)
 	defer unix.Close(w.fd)
 	defer w.poller.close()
+	defer w.queue.close()
+	defer w.stopPolling()
 
 	for {
 		// See if we have been closed.
@@ -197,7 +620,10 @@ func (w *osWatcher) readEvents() {
 			return
 		}
 
-		ok, errno = w.poller.wait()
+		ok, errno = w.poller.waitTimeout(movesTimeout(moves))
+		if !w.expireMoves(moves) {
+			return
+		}
 		if errno != nil {
 			select {
 			case w.Errors <- errno:
@@ -244,6 +670,7 @@ func (w *osWatcher) readEvents() {
 			continue
 		}
 
+		now := time.Now()
 		var offset uint32
 		// We don't know how many events we just read into the buffer
 		// While the offset points to at least one whole event...
@@ -255,10 +682,17 @@ func (w *osWatcher) readEvents() {
 			nameLen := uint32(raw.Len)
 
 			if mask&unix.IN_Q_OVERFLOW != 0 {
-				select {
-				case w.Errors <- notify.ErrEventOverflow:
-				case <-w.done:
-					return
+				atomic.AddUint64(&w.overflows, 1)
+				if w.opts.RescanOnOverflow {
+					if !w.rescan() {
+						return
+					}
+				} else {
+					select {
+					case w.Errors <- notify.ErrEventOverflow:
+					case <-w.done:
+						return
+					}
 				}
 			}
 
@@ -268,16 +702,33 @@ func (w *osWatcher) readEvents() {
 			// the "paths" map.
 			w.mu.Lock()
 			name, ok := w.paths[int(raw.Wd)]
+			var (
+				recursive bool
+				ops       notify.Op
+				root      string
+				movedFrom string
+			)
+			watch := w.watches[name]
+			if ok && watch != nil {
+				recursive, ops, root = watch.recursive, watch.ops, watch.root
+				if mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
+					movedFrom, watch.movedFrom = watch.movedFrom, ""
+				}
+			} else if !ok {
+				// Events still queued for a watch that has been removed are
+				// reported as they always were, without the watch's name.
+				ops = defaultOps
+			}
 			// IN_DELETE_SELF occurs when the file/directory being watched is removed.
 			// This is a sign to clean up the maps, otherwise we are no longer in sync
 			// with the inotify kernel state which has already deleted the watch
 			// automatically.
-			if ok && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
-				delete(w.paths, int(raw.Wd))
-				delete(w.watches, name)
+			if ok && watch != nil && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
+				w.forget(name, watch)
 			}
 			w.mu.Unlock()
 
+			watchName := name
 			if nameLen > 0 {
 				// Point "bytes" at the first byte of the filename
 				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))
@@ -285,13 +736,70 @@ func (w *osWatcher) readEvents() {
 				name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
 			}
 
+			// A watched file moved here is followed before its events are
+			// reported, IN_MOVE_SELF coming after IN_MOVED_TO.
+			followed := false
+			if w.opts.FollowMoves && nameLen > 0 && mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+				followed = w.follow(name)
+			}
+			if w.opts.FollowMoves && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF && movedFrom == "" &&
+				recursive && name != root {
+				// A directory moved out of the tree.
+				w.mu.Lock()
+				w.removeTree(name)
+				w.mu.Unlock()
+			}
+
+			if w.filter.IsIgnoreFile(name) {
+				w.filter.Load(filepath.Dir(name))
+			}
+			isDir := mask&unix.IN_ISDIR == unix.IN_ISDIR
+			if w.filter.Ignored(name, root, isDir) {
+				offset += unix.SizeofInotifyEvent + nameLen
+				continue
+			}
+
+			var info os.FileInfo
+			if w.opts.RescanOnOverflow {
+				info = w.track(watchName, name)
+			}
+
 			event := newEvent(name, mask)
 
+			if w.opts.CorrelateRenames && raw.Cookie != 0 {
+				if mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
+					// Hold the event until the other half arrives or the
+					// rename times out.
+					moves[raw.Cookie] = pendingMove{
+						name:     name,
+						ops:      ops,
+						root:     root,
+						isDir:    isDir,
+						deadline: now.Add(w.opts.renameTimeout()),
+					}
+					event.Op = 0
+				} else if move, ok := moves[raw.Cookie]; ok && mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+					delete(moves, raw.Cookie)
+					event = notify.Event{Name: name, OldName: move.name, Op: notify.Rename}
+				}
+			}
+
+			if movedFrom != "" {
+				event.OldName = movedFrom
+			}
+			event.Time, event.IsDir, event.Root, event.Info = now, isDir, root, info
+
 			// Send the events that are not ignored on the events channel
-			if !event.IgnoreLinux(mask) {
-				select {
-				case w.Events <- event:
-				case <-w.done:
+			event.Op &= ops
+			if event.Op != 0 && !event.IgnoreLinux(mask) {
+				if !w.queue.push(event) {
+					return
+				}
+			}
+
+			// A directory followed within the tree is watched already.
+			if recursive && mask&unix.IN_ISDIR == unix.IN_ISDIR && nameLen > 0 && !followed {
+				if !w.updateTree(name, mask, root) {
 					return
 				}
 			}
@@ -302,6 +810,224 @@ func (w *osWatcher) readEvents() {
 	}
 }
 
+// pendingMove is the IN_MOVED_FROM half of a rename awaiting its
+// IN_MOVED_TO half.
+type pendingMove struct {
+	name     string
+	ops      notify.Op // Ops of the watch the file was moved from
+	root     string    // Root of the watch the file was moved from
+	isDir    bool
+	deadline time.Time
+}
+
+// movesTimeout returns the poller timeout in milliseconds until the first
+// pending move expires, or -1 if there are none.
+func movesTimeout(moves map[uint32]pendingMove) int {
+	if len(moves) == 0 {
+		return -1
+	}
+	var first time.Time
+	for _, move := range moves {
+		if first.IsZero() || move.deadline.Before(first) {
+			first = move.deadline
+		}
+	}
+	d := time.Until(first)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// expireMoves reports the moves whose other half did not arrive in time as
+// removals from the watched set. It returns false if the watcher was closed
+// while sending events.
+func (w *osWatcher) expireMoves(moves map[uint32]pendingMove) bool {
+	now := time.Now()
+	for cookie, move := range moves {
+		if now.Before(move.deadline) {
+			continue
+		}
+		delete(moves, cookie)
+		if move.ops&(notify.Remove|notify.Rename) == 0 {
+			continue
+		}
+		if !w.queue.push(notify.Event{Name: move.name, Op: notify.Remove, Time: now, IsDir: move.isDir, Root: move.root}) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateTree follows a directory entering or leaving the recursive watch
+// of root. It returns false if the watcher was closed while sending events.
+func (w *osWatcher) updateTree(name string, mask uint32, root string) bool {
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		found, err := w.addTree(name, root)
+		if err != nil && !os.IsNotExist(err) {
+			select {
+			case w.Errors <- err:
+			case <-w.done:
+				return false
+			}
+		}
+		for _, event := range found {
+			if !w.queue.push(event) {
+				return false
+			}
+		}
+	case mask&unix.IN_MOVED_FROM != 0 && !w.opts.FollowMoves:
+		// With Options.FollowMoves the watches are kept until the directory
+		// is found again or IN_MOVE_SELF shows it left the tree.
+		//
+		// The directory may have been moved out of the tree; if it was moved
+		// within it, IN_MOVED_TO adds it again under its new name.
+		w.mu.Lock()
+		w.removeTree(name)
+		w.mu.Unlock()
+	}
+	return true
+}
+
+// snapshot returns the state of name and, if it is a directory, of its
+// entries, or nil if name does not exist.
+func snapshot(name string) notify.Snapshot {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+	snap := notify.Snapshot{name: notify.StateOf(fi)}
+	if !fi.IsDir() {
+		return snap
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return snap
+	}
+	defer f.Close()
+	list, _ := f.Readdir(-1)
+	for _, fi := range list {
+		snap[filepath.Join(name, fi.Name())] = notify.StateOf(fi)
+	}
+	return snap
+}
+
+// track updates the snapshot of the watch for watchName after an event for
+// name, which is either the watched path or one of its entries, and returns
+// the info of name if it still exists.
+func (w *osWatcher) track(watchName, name string) os.FileInfo {
+	stat := os.Lstat
+	if name == watchName {
+		stat = os.Stat
+	}
+	fi, err := stat(name)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if watch := w.watches[watchName]; watch != nil && watch.snap != nil {
+		if err != nil {
+			delete(watch.snap, name)
+		} else {
+			watch.snap[name] = notify.StateOf(fi)
+		}
+	}
+	if err != nil {
+		return nil
+	}
+	return fi
+}
+
+// rescan takes new snapshots of all watches after events were lost, sends
+// the differences to the old snapshots as events and ends them with a
+// Resync event. Watches whose path is gone are dropped. It returns false if
+// the watcher was closed while sending events.
+func (w *osWatcher) rescan() bool {
+	var (
+		old, cur  = notify.Snapshot{}, notify.Snapshot{}
+		ops       = make(map[string]notify.Op)
+		roots     = make(map[string]string)
+		recursive = make(map[string]bool)
+		gone      []string
+	)
+	// Walking the watched trees can take a while, so it is done without
+	// w.mu; a watch removed or replaced meanwhile is left alone.
+	type scan struct {
+		name  string
+		watch *watch
+		snap  notify.Snapshot
+	}
+	var scans []scan
+	w.mu.Lock()
+	for name, watch := range w.watches {
+		scans = append(scans, scan{name: name, watch: watch})
+	}
+	w.mu.Unlock()
+	for i := range scans {
+		scans[i].snap = snapshot(scans[i].name)
+	}
+
+	w.mu.Lock()
+	for _, sc := range scans {
+		name, watch, snap := sc.name, sc.watch, sc.snap
+		if w.watches[name] != watch {
+			continue
+		}
+		for path, state := range watch.snap {
+			old[path] = state
+			ops[path] |= watch.ops
+			roots[path] = watch.root
+		}
+		for path, state := range snap {
+			cur[path] = state
+			ops[path] |= watch.ops
+			roots[path] = watch.root
+			recursive[path] = recursive[path] || watch.recursive && path != name
+		}
+		watch.snap = snap
+		if snap == nil {
+			gone = append(gone, name)
+		}
+	}
+	for _, name := range gone {
+		if _, ok := w.watches[name]; ok {
+			w.removeTree(name)
+		}
+	}
+	w.mu.Unlock()
+
+	now := time.Now()
+	var dirs []string
+	for _, event := range old.Diff(cur) {
+		if w.filter.Ignored(event.Name, roots[event.Name], event.IsDir) {
+			continue
+		}
+		if event.Op&notify.Create != 0 && recursive[event.Name] && event.IsDir {
+			dirs = append(dirs, event.Name)
+		}
+		event.Time, event.Root = now, roots[event.Name]
+		event.Op &= ops[event.Name]
+		if event.Op == 0 {
+			continue
+		}
+		if !w.queue.push(event) {
+			return false
+		}
+	}
+	// Directories that appeared in a recursive watch are watched like
+	// directories created while watching.
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if !w.updateTree(dir, unix.IN_CREATE, roots[dir]) {
+			return false
+		}
+	}
+
+	if !w.queue.push(notify.Event{Op: notify.Resync, Time: now}) {
+		return false
+	}
+	return true
+}
 
 // NewEvent returns an platform-independent Event based on an inotify mask.
 func newEvent(name string, mask uint32) notify.Event {
@@ -321,5 +1047,17 @@ func newEvent(name string, mask uint32) notify.Event {
 	if mask&unix.IN_ATTRIB == unix.IN_ATTRIB {
 		e.Op |= notify.Chmod
 	}
+	if mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
+		e.Op |= notify.CloseWrite
+	}
+	if mask&unix.IN_CLOSE_NOWRITE == unix.IN_CLOSE_NOWRITE {
+		e.Op |= notify.CloseNoWrite
+	}
+	if mask&unix.IN_OPEN == unix.IN_OPEN {
+		e.Op |= notify.Open
+	}
+	if mask&unix.IN_ACCESS == unix.IN_ACCESS {
+		e.Op |= notify.Access
+	}
 	return e
 }
\ No newline at end of file
@@ -0,0 +1,86 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fsnotify
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Limits are the kernel limits on inotify resources and the use of them by
+// the current user.
+type Limits struct {
+	MaxUserWatches   int // fs.inotify.max_user_watches
+	MaxUserInstances int // fs.inotify.max_user_instances
+	MaxQueuedEvents  int // fs.inotify.max_queued_events
+
+	// Watches and Instances count the inotify watches and instances of the
+	// processes of the current user. Processes whose file descriptors
+	// cannot be read are not counted.
+	Watches   int
+	Instances int
+}
+
+// ReadLimits reads the inotify limits and their use from /proc.
+func ReadLimits() (Limits, error) {
+	return readLimits("/proc", os.Getuid())
+}
+
+func readLimits(proc string, uid int) (Limits, error) {
+	var l Limits
+	for _, limit := range []struct {
+		name  string
+		value *int
+	}{
+		{"max_user_watches", &l.MaxUserWatches},
+		{"max_user_instances", &l.MaxUserInstances},
+		{"max_queued_events", &l.MaxQueuedEvents},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(proc, "sys/fs/inotify", limit.name))
+		if err != nil {
+			return l, err
+		}
+		if *limit.value, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return l, err
+		}
+	}
+
+	pids, err := ioutil.ReadDir(proc)
+	if err != nil {
+		return l, err
+	}
+	for _, fi := range pids {
+		if _, err := strconv.Atoi(fi.Name()); err != nil || !fi.IsDir() {
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+			continue
+		}
+		dir := filepath.Join(proc, fi.Name())
+		fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, _ := os.Readlink(filepath.Join(dir, "fd", fd.Name())); link != "anon_inode:inotify" {
+				continue
+			}
+			l.Instances++
+			info, err := ioutil.ReadFile(filepath.Join(dir, "fdinfo", fd.Name()))
+			if err != nil {
+				continue
+			}
+			l.Watches += bytes.Count(info, []byte("inotify wd:"))
+		}
+	}
+	return l, nil
+}
@@ -77,13 +77,19 @@ func newFdPoller(fd int) (*fdPoller, error) {
 // Returns true if something is ready to be read,
 // false if there is not.
 func (poller *fdPoller) wait() (bool, error) {
+	return poller.waitTimeout(-1)
+}
+
+// waitTimeout is wait giving up after msec milliseconds; a negative msec
+// waits indefinitely.
+func (poller *fdPoller) waitTimeout(msec int) (bool, error) {
 	// 3 possible events per fd, and 2 fds, makes a maximum of 6 events.
 	// I don't know whether epoll_wait returns the number of events returned,
 	// or the total number of events ready.
 	// I decided to catch both by making the buffer one larger than the maximum.
 	events := make([]unix.EpollEvent, 7)
 	for {
-		n, errno := unix.EpollWait(poller.epfd, events, -1)
+		n, errno := unix.EpollWait(poller.epfd, events, msec)
 		if n == -1 {
 			if errno == unix.EINTR {
 				continue
@@ -91,6 +97,10 @@ func (poller *fdPoller) wait() (bool, error) {
 			return false, errno
 		}
 		if n == 0 {
+			if msec >= 0 {
+				// Timed out.
+				return false, nil
+			}
 			// If there are no events, try again.
 			continue
 		}
@@ -106,6 +106,24 @@ func TestPollerWithWakeup(t *testing.T) {
 	}
 }
 
+func TestPollerWithTimeout(t *testing.T) {
+	tfd, poller := makePoller(t)
+	defer tfd.close()
+	defer poller.close()
+
+	start := time.Now()
+	ok, err := poller.waitTimeout(20)
+	if err != nil {
+		t.Fatalf("poller failed: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected poller to return false")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("poller returned before the timeout")
+	}
+}
+
 func TestPollerWithClose(t *testing.T) {
 	tfd, poller := makePoller(t)
 	defer tfd.close()
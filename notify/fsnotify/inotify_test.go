@@ -7,13 +7,18 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 	"github.com/gottingen/felix/notify"
 )
 
@@ -457,3 +462,753 @@ func TestInotifyOverflow(t *testing.T) {
 	}
 }
 
+
+// nextEvent returns the next event of w.
+func nextEvent(t *testing.T, w notify.Watcher) notify.Event {
+	select {
+	case ev := <-w.EventChannel():
+		return ev
+	case err := <-w.ErrorChannel():
+		t.Fatalf("Error from watcher: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("Took too long to wait for event")
+	}
+	return notify.Event{}
+}
+
+// waitForCreates collects events until every name in want has been seen
+// with a Create op, or the timeout expires.
+func waitForCreates(t *testing.T, w notify.Watcher, want ...string) {
+	pending := make(map[string]bool)
+	for _, name := range want {
+		pending[name] = true
+	}
+	timeout := time.After(2 * time.Second)
+	for len(pending) > 0 {
+		select {
+		case ev := <-w.EventChannel():
+			if ev.Op&notify.Create == notify.Create {
+				delete(pending, ev.Name)
+			}
+		case err := <-w.ErrorChannel():
+			t.Fatalf("Error from watcher: %v", err)
+		case <-timeout:
+			t.Fatalf("Missing create events for %v", pending)
+		}
+	}
+}
+
+func TestInotifyAddRecursive(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	if err := os.MkdirAll(filepath.Join(testDir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.(notify.RecursiveWatcher).AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// A file in an existing subdirectory.
+	deep := filepath.Join(testDir, "a", "b", "file")
+	if err := ioutil.WriteFile(deep, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, deep)
+
+	// A new directory with contents created before its watch landed.
+	newDir := filepath.Join(testDir, "c", "d")
+	newFile := filepath.Join(newDir, "file")
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, filepath.Join(testDir, "c"), newDir, newFile)
+
+	// A directory moved in from outside the tree.
+	outside := tempMkdir(t)
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	movedIn := filepath.Join(testDir, "moved")
+	if err := os.Rename(outside, movedIn); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, movedIn, filepath.Join(movedIn, "file"))
+	later := filepath.Join(movedIn, "later")
+	if err := ioutil.WriteFile(later, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, later)
+
+	ow := w.(*osWatcher)
+	ow.mu.Lock()
+	n := len(ow.watches)
+	ow.mu.Unlock()
+	if n != 6 {
+		t.Errorf("Expected 6 watches, got %d", n)
+	}
+
+	if err := w.Remove(testDir); err != nil {
+		t.Fatalf("Failed to remove testDir: %v", err)
+	}
+	ow.mu.Lock()
+	n = len(ow.watches)
+	ow.mu.Unlock()
+	if n != 0 {
+		t.Errorf("Expected all watches to be removed, %d left", n)
+	}
+}
+
+func TestInotifyRecursiveMoveOut(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	sub := filepath.Join(testDir, "sub")
+	if err := os.MkdirAll(filepath.Join(sub, "inner"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := tempMkdir(t)
+	defer os.RemoveAll(outside)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.(notify.RecursiveWatcher).AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	if err := os.Rename(sub, filepath.Join(outside, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	// A create in the root orders the check after the move was processed.
+	marker := filepath.Join(testDir, "marker")
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreates(t, w, marker)
+
+	ow := w.(*osWatcher)
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	if len(ow.watches) != 1 || ow.watches[testDir] == nil {
+		t.Errorf("Expected only the root to be watched, got %v", ow.watches)
+	}
+}
+
+func TestInotifyCorrelateRenames(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	outside := tempMkdir(t)
+	defer os.RemoveAll(outside)
+
+	w, err := NewWatcherWithOptions(Options{CorrelateRenames: true, RenameTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	oldName := filepath.Join(testDir, "old")
+	newName := filepath.Join(testDir, "new")
+	if err := ioutil.WriteFile(oldName, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// A rename inside the watched directory is a single event.
+	if err := os.Rename(oldName, newName); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Op != notify.Rename || ev.Name != newName || ev.OldName != oldName {
+		t.Errorf("Unexpected rename event: %v", ev)
+	}
+
+	// Moving out of the watched directory is a removal once the timeout passed.
+	if err := os.Rename(newName, filepath.Join(outside, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Op != notify.Remove || ev.Name != newName || ev.OldName != "" {
+		t.Errorf("Unexpected move out event: %v", ev)
+	}
+
+	// Moving in is a creation.
+	if err := os.Rename(filepath.Join(outside, "gone"), oldName); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Op != notify.Create || ev.Name != oldName {
+		t.Errorf("Unexpected move in event: %v", ev)
+	}
+}
+
+func TestInotifyFollowMoves(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcherWithOptions(Options{FollowMoves: true})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	// A log file and its directory, as watched by a log tailer.
+	logName := filepath.Join(testDir, "app.log")
+	rotated := filepath.Join(testDir, "app.log.1")
+	if err := ioutil.WriteFile(logName, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if err := w.Add(logName); err != nil {
+		t.Fatalf("Failed to add log file: %v", err)
+	}
+
+	if err := os.Rename(logName, rotated); err != nil {
+		t.Fatal(err)
+	}
+	var self notify.Event
+	for i := 0; i < 3; i++ {
+		if ev := nextEvent(t, w); ev.OldName != "" {
+			self = ev
+		}
+	}
+	if self.Op != notify.Rename || self.Name != rotated || self.OldName != logName || self.Root != rotated {
+		t.Errorf("Unexpected rename of the watched file: %v", self)
+	}
+
+	// The rotated file is still watched, under its new name.
+	f, err := os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("data")
+	f.Close()
+	for i := 0; i < 2; i++ {
+		if ev := nextEvent(t, w); ev.Op != notify.Write || ev.Name != rotated {
+			t.Errorf("Unexpected write event: %v", ev)
+		}
+	}
+
+	// A directory moved inside a recursive watch keeps its watch.
+	tree := tempMkdir(t)
+	defer os.RemoveAll(tree)
+	if err := os.MkdirAll(filepath.Join(tree, "a", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(notify.RecursiveWatcher).AddRecursive(tree); err != nil {
+		t.Fatalf("Failed to add tree: %v", err)
+	}
+	if err := os.Rename(filepath.Join(tree, "a"), filepath.Join(tree, "b")); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(tree, "b", "sub", "file")
+	if err := ioutil.WriteFile(moved, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		ev := nextEvent(t, w)
+		if ev.Name == moved {
+			if ev.Op != notify.Create {
+				t.Errorf("Unexpected event: %v", ev)
+			}
+			break
+		}
+		if ev.Op == notify.Create && strings.HasPrefix(ev.Name, filepath.Join(tree, "b")+"/") {
+			t.Errorf("Moved directory was watched again: %v", ev)
+		}
+	}
+	ow := w.(*osWatcher)
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	if ow.watches[filepath.Join(tree, "a", "sub")] != nil || ow.watches[filepath.Join(tree, "b", "sub")] == nil {
+		t.Errorf("Watches not moved: %v", ow.watches)
+	}
+}
+
+func TestInotifyAddWithOps(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	ow := w.(notify.OpsWatcher)
+
+	if err := ow.AddWithOps(testDir, notify.Write); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	// readEvents updates the watches concurrently.
+	watched := func() (notify.Op, uint32) {
+		ow := w.(*osWatcher)
+		ow.mu.Lock()
+		defer ow.mu.Unlock()
+		watch := ow.watches[testDir]
+		return watch.ops, watch.flags
+	}
+	if _, flags := watched(); flags&(unix.IN_CREATE|unix.IN_ATTRIB) != 0 {
+		t.Errorf("Unexpected inotify flags for a write watch: %#x", flags)
+	}
+
+	name := filepath.Join(testDir, "file")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("data")
+	f.Sync()
+	os.Chmod(name, 0600)
+	f.Close()
+
+	if ev := nextEvent(t, w); ev.Op != notify.Write || ev.Name != name {
+		t.Errorf("Expected only a write event, got %v", ev)
+	}
+
+	// Adding ops extends the watch.
+	if err := ow.AddWithOps(testDir, notify.Remove); err != nil {
+		t.Fatalf("Failed to extend watch: %v", err)
+	}
+	if ops, flags := watched(); ops != notify.Write|notify.Remove || flags&unix.IN_MASK_ADD != 0 {
+		t.Errorf("Unexpected watch after second add: ops %v, flags %#x", ops, flags)
+	}
+	os.Chmod(name, 0644)
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Op != notify.Remove || ev.Name != name {
+		t.Errorf("Expected only a remove event, got %v", ev)
+	}
+	select {
+	case ev := <-w.EventChannel():
+		t.Errorf("Unexpected event: %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInotifyOpenCloseOps(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	name := filepath.Join(testDir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	// Add does not report the opt-in ops.
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if _, err := ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-w.EventChannel():
+		t.Fatalf("Unexpected event for a plain watch: %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ops := notify.Open | notify.Access | notify.CloseWrite | notify.CloseNoWrite
+	if err := w.(notify.OpsWatcher).AddWithOps(testDir, ops); err != nil {
+		t.Fatalf("Failed to extend watch: %v", err)
+	}
+	if _, err := ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("more"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []notify.Op{notify.Open, notify.Access, notify.CloseNoWrite, notify.Open, notify.Write, notify.CloseWrite}
+	var got []notify.Op
+	timeout := time.After(time.Second)
+	for len(got) < len(want) {
+		select {
+		case ev := <-w.EventChannel():
+			if ev.Name != name {
+				t.Fatalf("Unexpected event: %v", ev)
+			}
+			// The truncate and the write may or may not be coalesced.
+			if len(got) > 0 && got[len(got)-1] == ev.Op {
+				continue
+			}
+			got = append(got, ev.Op)
+		case err := <-w.ErrorChannel():
+			t.Fatalf("Error from watcher: %v", err)
+		case <-timeout:
+			t.Fatalf("Took too long to wait for events, got %v", got)
+		}
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestInotifyRescanOnOverflow(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	removed := filepath.Join(testDir, "removed")
+	written := filepath.Join(testDir, "written")
+	created := filepath.Join(testDir, "created")
+	for _, name := range []string{removed, written} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ww, err := NewWatcherWithOptions(Options{RescanOnOverflow: true})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer ww.Close()
+	w := ww.(*osWatcher)
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Make changes the watcher reports as usual, then put back the snapshot
+	// from before them as if their events had been lost.
+	w.mu.Lock()
+	stale := notify.Snapshot{}
+	for name, state := range w.watches[testDir].snap {
+		stale[name] = state
+	}
+	w.mu.Unlock()
+
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(written, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(created, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for done := false; !done; {
+		select {
+		case <-w.Events:
+		case err := <-w.Errors:
+			t.Fatalf("Error from watcher: %v", err)
+		case <-time.After(50 * time.Millisecond):
+			done = true
+		}
+	}
+
+	w.mu.Lock()
+	w.watches[testDir].snap = stale
+	w.mu.Unlock()
+	go w.rescan()
+
+	var got []notify.Event
+	for {
+		select {
+		case ev := <-w.Events:
+			if ev.Time.IsZero() {
+				t.Errorf("Event without a time: %v", ev)
+			}
+			got = append(got, notify.Event{Name: ev.Name, Op: ev.Op, Root: ev.Root})
+		case <-time.After(time.Second):
+			t.Fatalf("Took too long to wait for the resync, got %v", got)
+		}
+		if got[len(got)-1].Op == notify.Resync {
+			break
+		}
+	}
+	want := []notify.Event{
+		{Name: removed, Op: notify.Remove, Root: testDir},
+		{Name: created, Op: notify.Create, Root: testDir},
+		{Name: written, Op: notify.Write, Root: testDir},
+		{Op: notify.Resync},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected events: got %v, want %v", got, want)
+	}
+}
+
+func TestInotifyFilter(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	for _, dir := range []string{"node_modules/pkg", "build", "src"} {
+		if err := os.MkdirAll(filepath.Join(testDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(testDir, ".gitignore"), []byte("build/\n*.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ww, err := NewWatcherWithOptions(Options{Filter: notify.FilterOptions{
+		Exclude:     []string{"**/node_modules"},
+		IgnoreFiles: []string{".gitignore"},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer ww.Close()
+	w := ww.(*osWatcher)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Ignored directories are not watched at all.
+	w.mu.Lock()
+	for _, dir := range []string{"node_modules", "node_modules/pkg", "build"} {
+		if _, ok := w.watches[filepath.Join(testDir, dir)]; ok {
+			t.Errorf("%s is watched", dir)
+		}
+	}
+	if _, ok := w.watches[filepath.Join(testDir, "src")]; !ok {
+		t.Error("src is not watched")
+	}
+	w.mu.Unlock()
+
+	for _, name := range []string{"src/x.tmp", "node_modules/y", "src/z"} {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case ev := <-w.Events:
+		if ev.Name != filepath.Join(testDir, "src", "z") || ev.Op != notify.Create {
+			t.Errorf("Unexpected event: %v", ev)
+		}
+	case err := <-w.Errors:
+		t.Fatalf("Error from watcher: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Took too long to wait for event")
+	}
+}
+
+func TestInotifyWatchFileReplaced(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	name := filepath.Join(testDir, "app.conf")
+	if err := ioutil.WriteFile(name, []byte("v0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fw, err := notify.WatchFile(newWatcher(t), name, notify.FileWatchOptions{})
+	if err != nil {
+		t.Fatalf("WatchFile failed: %v", err)
+	}
+	defer fw.Close()
+
+	// Every atomic replacement is one Write, also after the first one took
+	// the original file away.
+	for i := 1; i <= 3; i++ {
+		tmp := filepath.Join(testDir, fmt.Sprintf(".app.conf.%d", i))
+		if err := ioutil.WriteFile(tmp, []byte(fmt.Sprint("v", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-fw.Events():
+			if ev.Name != name || ev.Op != notify.Write {
+				t.Errorf("Unexpected event: %v", ev)
+			}
+		case err := <-fw.Errors():
+			t.Fatalf("Error from watcher: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Took too long to wait for replacement %d", i)
+		}
+	}
+	select {
+	case ev := <-fw.Events():
+		t.Errorf("Unexpected event: %v", ev)
+	case <-time.After(2 * notify.DefaultSettle):
+	}
+}
+
+func TestInotifyEventPayload(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	if err := os.Mkdir(filepath.Join(testDir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.(notify.RecursiveWatcher).AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Events below the root are reported against the root, whether they
+	// come from the kernel or from the walk of a new directory.
+	dir := filepath.Join(testDir, "a", "b")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{dir: true, file: false}
+	timeout := time.After(2 * time.Second)
+	for len(want) > 0 {
+		select {
+		case ev := <-w.EventChannel():
+			isDir, ok := want[ev.Name]
+			if !ok || ev.Op&notify.Create == 0 {
+				continue
+			}
+			delete(want, ev.Name)
+			if ev.IsDir != isDir || ev.Root != testDir || ev.Time.IsZero() {
+				t.Errorf("Unexpected payload for %s: IsDir %v, Root %q, Time %v", ev.Name, ev.IsDir, ev.Root, ev.Time)
+			}
+		case err := <-w.ErrorChannel():
+			t.Fatalf("Error from watcher: %v", err)
+		case <-timeout:
+			t.Fatalf("Missing create events for %v", want)
+		}
+	}
+}
+
+func TestInotifyWatchLimit(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	full := filepath.Join(testDir, "full")
+	if err := os.MkdirAll(filepath.Join(full, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(testDir, "ok"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Watches below full run into the limit.
+	defer func(add func(int, string, uint32) (int, error)) { inotifyAddWatch = add }(inotifyAddWatch)
+	inotifyAddWatch = func(fd int, name string, flags uint32) (int, error) {
+		if strings.HasPrefix(name, full) {
+			return -1, unix.ENOSPC
+		}
+		return unix.InotifyAddWatch(fd, name, flags)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	err = w.Add(full)
+	if !errors.Is(err, ErrWatchLimit) || !errors.Is(err, unix.ENOSPC) || errors.Is(err, ErrInstanceLimit) {
+		t.Errorf("Add returned %v, want the watch limit", err)
+	}
+	w.Close()
+
+	w, err = NewWatcherWithOptions(Options{WatchLimitPolicy: PollOnLimit, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.(notify.RecursiveWatcher).AddRecursive(testDir); err != nil {
+		t.Fatalf("AddRecursive failed: %v", err)
+	}
+	if got := w.(notify.DegradedWatcher).Degraded(); !reflect.DeepEqual(got, []string{full}) {
+		t.Errorf("Degraded() = %v, want %v", got, []string{full})
+	}
+
+	// Both the watched and the polled parts of the tree report events.
+	watched := filepath.Join(testDir, "ok", "file")
+	polled := filepath.Join(full, "sub", "file")
+	for _, name := range []string{watched, polled} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]bool{watched: true, polled: true}
+	timeout := time.After(2 * time.Second)
+	for len(want) > 0 {
+		select {
+		case ev := <-w.EventChannel():
+			if !want[ev.Name] || ev.Op&notify.Create == 0 {
+				continue
+			}
+			delete(want, ev.Name)
+			if ev.Root != testDir {
+				t.Errorf("Unexpected root for %s: %q", ev.Name, ev.Root)
+			}
+		case err := <-w.ErrorChannel():
+			t.Fatalf("Error from watcher: %v", err)
+		case <-timeout:
+			t.Fatalf("Missing create events for %v", want)
+		}
+	}
+
+	if err := w.Remove(testDir); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if got := w.(notify.DegradedWatcher).Degraded(); len(got) != 0 {
+		t.Errorf("Degraded() = %v after Remove", got)
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	proc := tempMkdir(t)
+	defer os.RemoveAll(proc)
+	files := map[string]string{
+		"sys/fs/inotify/max_user_watches":   "8192\n",
+		"sys/fs/inotify/max_user_instances": "128\n",
+		"sys/fs/inotify/max_queued_events":  "16384\n",
+		"42/fdinfo/3":                       "pos:\t0\nflags:\t02000000\ninotify wd:2 ino:1\ninotify wd:1 ino:2\n",
+		"42/fdinfo/4":                       "pos:\t0\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(proc, name)
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(proc, "42", "fd"), 0755)
+	os.Symlink("anon_inode:inotify", filepath.Join(proc, "42", "fd", "3"))
+	os.Symlink("/dev/null", filepath.Join(proc, "42", "fd", "4"))
+
+	got, err := readLimits(proc, os.Getuid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Limits{MaxUserWatches: 8192, MaxUserInstances: 128, MaxQueuedEvents: 16384, Watches: 2, Instances: 1}
+	if got != want {
+		t.Errorf("readLimits() = %+v, want %+v", got, want)
+	}
+
+	// The real limits count the instance of a watcher.
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add(proc); err != nil {
+		t.Fatal(err)
+	}
+	l, err := ReadLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.MaxUserWatches == 0 || l.Instances == 0 || l.Watches == 0 {
+		t.Errorf("Unexpected limits: %+v", l)
+	}
+}
@@ -27,15 +27,18 @@ type kqWatcher struct {
 
 	kq int // File descriptor (as returned by the kqueue() syscall).
 
-	mu              sync.Mutex        // Protects access to watcher data
-	watches         map[string]int    // Map of watched file descriptors (key: path).
-	externalWatches map[string]bool   // Map of watches added by user of the library.
-	dirFlags        map[string]uint32 // Map of watched directories to fflags used in kqueue.
-	paths           map[int]pathInfo  // Map file descriptors to path names for processing kqueue events.
-	fileExists      map[string]bool   // Keep track of if we know this file exists (to stop duplicate create events).
-	isClosed        bool              // Set to true when Close() is first called
+	mu              sync.Mutex           // Protects access to watcher data
+	watches         map[string]int       // Map of watched file descriptors (key: path).
+	externalWatches map[string]bool      // Map of watches added by user of the library.
+	dirFlags        map[string]uint32    // Map of watched directories to fflags used in kqueue.
+	paths           map[int]pathInfo     // Map file descriptors to path names for processing kqueue events.
+	fileExists      map[string]bool      // Keep track of if we know this file exists (to stop duplicate create events).
+	ops             map[string]notify.Op // Ops to report for watches added by user of the library.
+	isClosed        bool                 // Set to true when Close() is first called
 }
 
+var _ notify.OpsWatcher = (*kqWatcher)(nil)
+
 type pathInfo struct {
 	name  string
 	isDir bool
@@ -43,6 +46,12 @@ type pathInfo struct {
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (notify.Watcher, error) {
+	return NewWatcherWithOptions(Options{})
+}
+
+// NewWatcherWithOptions is NewWatcher with the behaviour configured by opts.
+// This backend does not correlate renames.
+func NewWatcherWithOptions(opts Options) (notify.Watcher, error) {
 	kq, err := kqueue()
 	if err != nil {
 		return nil, err
@@ -55,6 +64,7 @@ func NewWatcher() (notify.Watcher, error) {
 		paths:           make(map[int]pathInfo),
 		fileExists:      make(map[string]bool),
 		externalWatches: make(map[string]bool),
+		ops:             make(map[string]notify.Op),
 		Events:          make(chan notify.Event),
 		Errors:          make(chan error),
 		done:            make(chan struct{}),
@@ -101,13 +111,54 @@ func (w *kqWatcher) Close() error {
 
 // Add starts watching the named file or directory (non-recursively).
 func (w *kqWatcher) Add(name string) error {
+	return w.AddWithOps(name, defaultOps)
+}
+
+// AddWithOps starts watching the named file or directory (non-recursively)
+// for the events of ops only. CloseWrite, CloseNoWrite, Open and Access are
+// not supported by this backend and are never reported.
+func (w *kqWatcher) AddWithOps(name string, ops notify.Op) error {
+	name = filepath.Clean(name)
 	w.mu.Lock()
 	w.externalWatches[name] = true
+	ops |= w.ops[name]
+	w.ops[name] = ops
 	w.mu.Unlock()
-	_, err := w.addWatch(name, noteAllEvents)
+	_, err := w.addWatch(name, kqueueFlags(ops))
 	return err
 }
 
+// kqueueFlags returns the kevent fflags needed to produce the events of ops.
+// NOTE_DELETE and NOTE_RENAME are always set to keep track of watches.
+func kqueueFlags(ops notify.Op) uint32 {
+	var flags uint32 = unix.NOTE_DELETE | unix.NOTE_RENAME
+	// Creates in a directory are found by rescanning it on NOTE_WRITE.
+	if ops&(notify.Create|notify.Write) != 0 {
+		flags |= unix.NOTE_WRITE
+	}
+	if ops&notify.Chmod != 0 {
+		flags |= unix.NOTE_ATTRIB
+	}
+	return flags
+}
+
+// filter drops the ops of e not asked for by the watch on its path or, for
+// files in a watched directory, on the directory, and stamps e with the
+// time and the root of that watch.
+func (w *kqWatcher) filter(e notify.Event) notify.Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ops, ok := w.ops[e.Name]; ok {
+		e.Op &= ops
+		e.Root = e.Name
+	} else if ops, ok := w.ops[filepath.Dir(e.Name)]; ok {
+		e.Op &= ops
+		e.Root = filepath.Dir(e.Name)
+	}
+	e.Time = time.Now()
+	return e
+}
+
 // Remove stops watching the the named file or directory (non-recursively).
 func (w *kqWatcher) Remove(name string) error {
 	name = filepath.Clean(name)
@@ -130,6 +181,7 @@ func (w *kqWatcher) Remove(name string) error {
 	delete(w.watches, name)
 	delete(w.paths, watchfd)
 	delete(w.dirFlags, name)
+	delete(w.ops, name)
 	w.mu.Unlock()
 
 	// Find all watched paths that are in this directory that are not external.
@@ -300,6 +352,7 @@ loop:
 			path := w.paths[watchfd]
 			w.mu.Unlock()
 			event := newEvent(path.name, mask)
+			event.IsDir = path.isDir
 
 			if path.isDir && !(event.Op&notify.Remove == notify.Remove) {
 				// Double check to make sure the directory exists. This can happen when
@@ -321,7 +374,7 @@ loop:
 
 			if path.isDir && event.Op&notify.Write == notify.Write && !(event.Op&notify.Remove == notify.Remove) {
 				w.sendDirectoryChangeEvents(event.Name)
-			} else {
+			} else if event = w.filter(event); event.Op != 0 {
 				// Send the event on the Events channel.
 				select {
 				case w.Events <- event:
@@ -449,10 +502,12 @@ func (w *kqWatcher) sendFileCreatedEventIfNew(filePath string, fileInfo os.FileI
 	w.mu.Lock()
 	_, doesExist := w.fileExists[filePath]
 	w.mu.Unlock()
-	if !doesExist {
+	event := newCreateEvent(filePath)
+	event.IsDir, event.Info = fileInfo.IsDir(), fileInfo
+	if event = w.filter(event); !doesExist && event.Op != 0 {
 		// Send create event
 		select {
-		case w.Events <- newCreateEvent(filePath):
+		case w.Events <- event:
 		case <-w.done:
 			return
 		}
@@ -483,8 +538,14 @@ func (w *kqWatcher) internalWatch(name string, fileInfo os.FileInfo) (string, er
 		return w.addWatch(name, flags)
 	}
 
-	// watch file to mimic Linux inotify
-	return w.addWatch(name, noteAllEvents)
+	// watch file to mimic Linux inotify, for the ops of its directory
+	w.mu.Lock()
+	ops, ok := w.ops[filepath.Dir(name)]
+	w.mu.Unlock()
+	if !ok {
+		return w.addWatch(name, noteAllEvents)
+	}
+	return w.addWatch(name, kqueueFlags(ops))
 }
 
 // kqueue creates a new kernel event queue and returns a descriptor.
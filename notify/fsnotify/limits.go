@@ -0,0 +1,41 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package fsnotify
+
+import "errors"
+
+var (
+	// ErrWatchLimit is reported when fs.inotify.max_user_watches is
+	// exhausted.
+	ErrWatchLimit = errors.New("inotify watch limit reached (fs.inotify.max_user_watches)")
+	// ErrInstanceLimit is reported when fs.inotify.max_user_instances, or
+	// the limit on open files, is exhausted.
+	ErrInstanceLimit = errors.New("inotify instance limit reached (fs.inotify.max_user_instances)")
+)
+
+// LimitError is the error of a watcher running into a kernel limit. With
+// errors.Is it matches both its Limit and the errno of the failed call.
+type LimitError struct {
+	Path  string // Path being watched; empty for ErrInstanceLimit
+	Limit error  // ErrWatchLimit or ErrInstanceLimit
+	Err   error  // Errno of the failed call
+}
+
+func (e *LimitError) Error() string {
+	if e.Path == "" {
+		return e.Limit.Error()
+	}
+	return e.Limit.Error() + ": " + e.Path
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == e.Limit
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package fsnotify
+
+import (
+	"time"
+
+	"github.com/gottingen/felix/notify"
+)
+
+// defaultOps are the ops watched by Add.
+const defaultOps = notify.Create | notify.Write | notify.Remove | notify.Rename | notify.Chmod
+
+// DefaultRenameTimeout is how long a correlating watcher waits for the
+// second half of a rename when Options.RenameTimeout is not set.
+const DefaultRenameTimeout = 50 * time.Millisecond
+
+// DefaultPollInterval is how often paths watched by polling are scanned
+// when Options.PollInterval is not set.
+const DefaultPollInterval = time.Second
+
+// Options configures a watcher created by NewWatcherWithOptions. The zero
+// value gives the same watcher as NewWatcher.
+type Options struct {
+	// CorrelateRenames pairs the two halves of a rename inside the watched
+	// set into one Rename event, with Name set to the new name and OldName
+	// to the old one. A file moved out of the watched set is reported as
+	// Remove once RenameTimeout has passed without the matching half; a
+	// file moved in is reported as Create. Only inotify supports this;
+	// other backends ignore it.
+	CorrelateRenames bool
+	RenameTimeout    time.Duration
+
+	// RescanOnOverflow recovers from a kernel event queue overflow instead
+	// of reporting notify.ErrEventOverflow. The watcher keeps a snapshot
+	// of every watched path and the entries of watched directories, which
+	// costs a stat per event. On overflow it takes new snapshots and sends
+	// Create, Remove, Write and Chmod events for the differences, followed
+	// by an event with Op notify.Resync. Changes reported by events queued
+	// before the overflow may be reported again. Only inotify supports
+	// this; other backends ignore it.
+	RescanOnOverflow bool
+
+	// FollowMoves keeps a watch on a file or directory after it is renamed
+	// or moved, and reports its events under the new name. Watches are
+	// keyed by device and inode: when a watched file shows up under a new
+	// name in a watched directory, the watch, and the watches below it for
+	// a directory, take the new name, and the Rename of the watched path
+	// itself carries the new name in Name and the old one in OldName. The
+	// destination directory must be watched for the move to be seen; a
+	// file moved elsewhere keeps being reported under its old name, and a
+	// directory moved out of a recursive watch is dropped. Only inotify
+	// supports this; other backends ignore it.
+	FollowMoves bool
+
+	// Fanotify makes the Linux watcher use one fanotify mark per watched
+	// filesystem instead of one inotify watch per directory, for trees too
+	// large for max_user_watches. It needs Linux 5.9 or later, or else the
+	// inotify watcher is used. Each path added is watched with inotify
+	// instead if its filesystem cannot be marked as a whole (overlayfs and
+	// btrfs subvolumes cannot) or without CAP_SYS_ADMIN. A fanotify watch
+	// is bound to its path rather than to a file: it is dropped when its
+	// path is removed or renamed, and CorrelateRenames, RescanOnOverflow
+	// and FollowMoves are ignored for it. Other backends ignore this.
+	Fanotify bool
+
+	// EventBuffer is the capacity of the Events channel.
+	EventBuffer int
+	// QueueSize is the capacity of a queue between the goroutine reading
+	// the kernel events and the Events channel. It keeps a slow consumer
+	// from stalling the reader and overflowing the kernel queue. Zero means
+	// no queue: the reader waits for the consumer.
+	QueueSize int
+	// DropPolicy decides what happens when the queue is full.
+	DropPolicy DropPolicy
+
+	// Only the Linux watchers support EventBuffer, QueueSize and
+	// DropPolicy, and report on them with notify.StatsWatcher; other
+	// backends ignore them.
+
+	// Filter drops the events of excluded and ignored paths, and keeps
+	// AddRecursive from watching ignored directories at all. A changed
+	// ignore file is read again; its rules apply to the events from then
+	// on, but do not add or remove watches. Only the Linux watchers
+	// support this; other backends ignore it.
+	Filter notify.FilterOptions
+
+	// WatchLimitPolicy decides what happens when a watch cannot be added
+	// because fs.inotify.max_user_watches is exhausted. With PollOnLimit
+	// the path, and for a recursive watch the directory tree below it, is
+	// watched by polling every PollInterval instead; the watcher reports
+	// those paths with notify.DegradedWatcher. Polling does not see changes
+	// undone between two scans, and reports no Open, Access or Close ops.
+	// Only inotify supports this; other backends ignore it.
+	WatchLimitPolicy LimitPolicy
+	PollInterval     time.Duration
+}
+
+// DropPolicy is what a watcher does with events that do not fit in its
+// queue.
+type DropPolicy int
+
+const (
+	// Block waits for the consumer to make room, as without a queue.
+	Block DropPolicy = iota
+	// DropOldest drops the oldest queued event to make room.
+	DropOldest
+	// DropNewest drops the event that does not fit.
+	DropNewest
+)
+
+// LimitPolicy is what a watcher does when it runs into the kernel limit on
+// watches.
+type LimitPolicy int
+
+const (
+	// FailOnLimit returns an error matching ErrWatchLimit.
+	FailOnLimit LimitPolicy = iota
+	// PollOnLimit watches the paths by polling.
+	PollOnLimit
+)
+
+func (o Options) pollInterval() time.Duration {
+	if o.PollInterval > 0 {
+		return o.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+func (o Options) renameTimeout() time.Duration {
+	if o.RenameTimeout > 0 {
+		return o.RenameTimeout
+	}
+	return DefaultRenameTimeout
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fsnotify
+
+import (
+	"sync"
+
+	"github.com/gottingen/felix/notify"
+)
+
+// eventQueue is a ring buffer between the goroutine reading the kernel and
+// the Events channel, so that a slow consumer does not stop the reader and
+// make the kernel queue overflow. A queue of size zero sends directly.
+type eventQueue struct {
+	out    chan notify.Event
+	done   chan struct{}
+	policy DropPolicy
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ring    []notify.Event
+	head    int // Index of the oldest event
+	n       int // Number of queued events
+	dropped uint64
+	closed  bool
+	stopped chan struct{} // Closed when the forwarding goroutine exits
+}
+
+func newEventQueue(out chan notify.Event, done chan struct{}, size int, policy DropPolicy) *eventQueue {
+	q := &eventQueue{
+		out:     out,
+		done:    done,
+		policy:  policy,
+		stopped: make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if size <= 0 {
+		close(q.stopped)
+		return q
+	}
+	q.ring = make([]notify.Event, size)
+	go q.forward()
+	return q
+}
+
+// push queues ev, or drops an event if the queue is full and the policy
+// says so. It returns false if the watcher was closed.
+func (q *eventQueue) push(ev notify.Event) bool {
+	if q.ring == nil {
+		select {
+		case q.out <- ev:
+			return true
+		case <-q.done:
+			return false
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n == len(q.ring) && !q.closed {
+		switch q.policy {
+		case DropNewest:
+			q.dropped++
+			return true
+		case DropOldest:
+			q.head = (q.head + 1) % len(q.ring)
+			q.n--
+			q.dropped++
+		default:
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return false
+	}
+	q.ring[(q.head+q.n)%len(q.ring)] = ev
+	q.n++
+	q.cond.Broadcast()
+	return true
+}
+
+func (q *eventQueue) forward() {
+	defer close(q.stopped)
+
+	for {
+		q.mu.Lock()
+		for q.n == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		ev := q.ring[q.head]
+		q.ring[q.head] = notify.Event{}
+		q.head = (q.head + 1) % len(q.ring)
+		q.n--
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		select {
+		case q.out <- ev:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// close stops the queue and waits until nothing is sent on the Events
+// channel any more. Queued events are dropped.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	<-q.stopped
+}
+
+// stats returns the number of queued events, including those buffered in
+// the Events channel, and the number of dropped events.
+func (q *eventQueue) stats() (depth int, dropped uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n + len(q.out), q.dropped
+}
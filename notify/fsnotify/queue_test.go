@@ -0,0 +1,159 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fsnotify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+)
+
+// fillQueue pushes the events a..e to a queue nobody receives from, and
+// waits until the forwarding goroutine is stuck sending the first one.
+func fillQueue(t *testing.T, q *eventQueue) {
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if !q.push(notify.Event{Name: name}) {
+			t.Fatalf("push(%s) failed", name)
+		}
+		if name == "a" {
+			for deadline := time.Now().Add(time.Second); ; {
+				if depth, _ := q.stats(); depth == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("forwarding goroutine did not take the first event")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+}
+
+func receiveNames(t *testing.T, out chan notify.Event, n int) string {
+	var names string
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-out:
+			names += ev.Name
+		case <-time.After(time.Second):
+			t.Fatalf("Took too long to wait for event, got %q", names)
+		}
+	}
+	return names
+}
+
+func TestEventQueueDropPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy DropPolicy
+		want   string
+	}{
+		{DropNewest, "abcd"},
+		{DropOldest, "acde"},
+	} {
+		out, done := make(chan notify.Event), make(chan struct{})
+		q := newEventQueue(out, done, 3, tc.policy)
+		// "a" is held by the forwarding goroutine, three fit in the ring and
+		// the fifth is one too many.
+		fillQueue(t, q)
+		if depth, dropped := q.stats(); depth != 3 || dropped != 1 {
+			t.Errorf("policy %d: got depth %d, dropped %d; want 3, 1", tc.policy, depth, dropped)
+		}
+		if got := receiveNames(t, out, 4); got != tc.want {
+			t.Errorf("policy %d: got %q, want %q", tc.policy, got, tc.want)
+		}
+		close(done)
+		q.close()
+	}
+}
+
+func TestEventQueueBlock(t *testing.T) {
+	out, done := make(chan notify.Event), make(chan struct{})
+	q := newEventQueue(out, done, 3, Block)
+
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		fillQueue(t, q)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push of the fifth event did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := receiveNames(t, out, 5); got != "abcde" {
+		t.Errorf("got %q, want abcde", got)
+	}
+	<-pushed
+
+	// Closing releases a blocked push.
+	for i := 0; i < 4; i++ {
+		q.push(notify.Event{Name: fmt.Sprint(i)})
+	}
+	released := make(chan bool)
+	go func() { released <- q.push(notify.Event{Name: "x"}) }()
+	close(done)
+	q.close()
+	if <-released {
+		t.Error("push on a closed queue succeeded")
+	}
+}
+
+func TestInotifyStats(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcherWithOptions(Options{EventBuffer: 2, QueueSize: 4, DropPolicy: DropNewest})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Nobody receives: at most two events wait in the channel, one is held
+	// by the forwarding goroutine and four in the queue; the rest are
+	// dropped.
+	for i := 0; i < 10; i++ {
+		if err := ioutil.WriteFile(filepath.Join(testDir, fmt.Sprint(i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sw := w.(notify.StatsWatcher)
+	var stats notify.Stats
+	for deadline := time.Now().Add(time.Second); ; {
+		stats = sw.Stats()
+		if stats.QueueDepth+int(stats.Dropped) == 9 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected stats: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats.Dropped < 3 {
+		t.Errorf("Expected at least 3 dropped events: %+v", stats)
+	}
+
+	var received int
+	for received < 10-int(stats.Dropped) {
+		select {
+		case <-w.EventChannel():
+			received++
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d events, stats %+v", received, stats)
+		}
+	}
+	if stats := sw.Stats(); stats.QueueDepth != 0 {
+		t.Errorf("Unexpected stats after receiving: %+v", stats)
+	}
+}
@@ -15,12 +15,13 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 // Watcher watches a set of files, delivering events to a channel.
 type winWatcher struct {
-	Events   chan Event
+	Events   chan notify.Event
 	Errors   chan error
 	isClosed bool           // Set to true when Close() is first called
 	mu       sync.Mutex     // Map access
@@ -32,6 +33,12 @@ type winWatcher struct {
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (notify.Watcher, error) {
+	return NewWatcherWithOptions(Options{})
+}
+
+// NewWatcherWithOptions is NewWatcher with the behaviour configured by opts.
+// This backend does not correlate renames.
+func NewWatcherWithOptions(opts Options) (notify.Watcher, error) {
 	port, e := syscall.CreateIoCompletionPort(syscall.InvalidHandle, 0, 0, 0)
 	if e != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", e)
@@ -48,6 +55,16 @@ func NewWatcher() (notify.Watcher, error) {
 	return w, nil
 }
 
+var _ notify.OpsWatcher = (*winWatcher)(nil)
+
+func (w *winWatcher) EventChannel() <-chan notify.Event {
+	return w.Events
+}
+
+func (w *winWatcher) ErrorChannel() <-chan error {
+	return w.Errors
+}
+
 // Close removes all watches and closes the events channel.
 func (w *winWatcher) Close() error {
 	if w.isClosed {
@@ -66,13 +83,24 @@ func (w *winWatcher) Close() error {
 
 // Add starts watching the named file or directory (non-recursively).
 func (w *winWatcher) Add(name string) error {
+	return w.addWithFlags(name, sysFSALLEVENTS)
+}
+
+// AddWithOps starts watching the named file or directory (non-recursively)
+// for the events of ops only. CloseWrite, CloseNoWrite, Open and Access are
+// not supported by this backend and are never reported.
+func (w *winWatcher) AddWithOps(name string, ops notify.Op) error {
+	return w.addWithFlags(name, toSysFlags(ops))
+}
+
+func (w *winWatcher) addWithFlags(name string, flags uint32) error {
 	if w.isClosed {
 		return errors.New("watcher already closed")
 	}
 	in := &input{
 		op:    opAddWatch,
 		path:  filepath.Clean(name),
-		flags: sysFSALLEVENTS,
+		flags: flags,
 		reply: make(chan error),
 	}
 	w.input <- in
@@ -303,11 +331,12 @@ func (w *winWatcher) remWatch(pathname string) error {
 		return fmt.Errorf("can't remove non-existent watch for: %s", pathname)
 	}
 	if pathname == dir {
-		w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+		w.sendEvent(watch.path, watch.path, watch.mask&sysFSIGNORED)
 		watch.mask = 0
 	} else {
 		name := filepath.Base(pathname)
-		w.sendEvent(filepath.Join(watch.path, name), watch.names[name]&sysFSIGNORED)
+		path := filepath.Join(watch.path, name)
+		w.sendEvent(path, path, watch.names[name]&sysFSIGNORED)
 		delete(watch.names, name)
 	}
 	return w.startRead(watch)
@@ -317,13 +346,14 @@ func (w *winWatcher) remWatch(pathname string) error {
 func (w *winWatcher) deleteWatch(watch *watch) {
 	for name, mask := range watch.names {
 		if mask&provisional == 0 {
-			w.sendEvent(filepath.Join(watch.path, name), mask&sysFSIGNORED)
+			path := filepath.Join(watch.path, name)
+			w.sendEvent(path, path, mask&sysFSIGNORED)
 		}
 		delete(watch.names, name)
 	}
 	if watch.mask != 0 {
 		if watch.mask&provisional == 0 {
-			w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+			w.sendEvent(watch.path, watch.path, watch.mask&sysFSIGNORED)
 		}
 		watch.mask = 0
 	}
@@ -354,7 +384,7 @@ func (w *winWatcher) startRead(watch *watch) error {
 		err := os.NewSyscallError("ReadDirectoryChanges", e)
 		if e == syscall.ERROR_ACCESS_DENIED && watch.mask&provisional == 0 {
 			// Watched directory was probably removed
-			if w.sendEvent(watch.path, watch.mask&sysFSDELETESELF) {
+			if w.sendEvent(watch.path, watch.path, watch.mask&sysFSDELETESELF) {
 				if watch.mask&sysFSONESHOT != 0 {
 					watch.mask = 0
 				}
@@ -429,7 +459,7 @@ func (w *winWatcher) readEvents() {
 			}
 		case syscall.ERROR_ACCESS_DENIED:
 			// Watched directory was probably removed
-			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF)
+			w.sendEvent(watch.path, watch.path, watch.mask&sysFSDELETESELF)
 			w.deleteWatch(watch)
 			w.startRead(watch)
 			continue
@@ -445,7 +475,9 @@ func (w *winWatcher) readEvents() {
 		var offset uint32
 		for {
 			if n == 0 {
-				w.Events <- newEvent("", sysFSQOVERFLOW)
+				event := newEvent("", sysFSQOVERFLOW)
+				event.Time = time.Now()
+				w.Events <- event
 				w.Errors <- errors.New("short read in readEvents()")
 				break
 			}
@@ -473,7 +505,7 @@ func (w *winWatcher) readEvents() {
 			}
 
 			sendNameEvent := func() {
-				if w.sendEvent(fullname, watch.names[name]&mask) {
+				if w.sendEvent(fullname, fullname, watch.names[name]&mask) {
 					if watch.names[name]&sysFSONESHOT != 0 {
 						delete(watch.names, name)
 					}
@@ -483,10 +515,10 @@ func (w *winWatcher) readEvents() {
 				sendNameEvent()
 			}
 			if raw.Action == syscall.FILE_ACTION_REMOVED {
-				w.sendEvent(fullname, watch.names[name]&sysFSIGNORED)
+				w.sendEvent(fullname, fullname, watch.names[name]&sysFSIGNORED)
 				delete(watch.names, name)
 			}
-			if w.sendEvent(fullname, watch.mask&toFSnotifyFlags(raw.Action)) {
+			if w.sendEvent(watch.path, fullname, watch.mask&toFSnotifyFlags(raw.Action)) {
 				if watch.mask&sysFSONESHOT != 0 {
 					watch.mask = 0
 				}
@@ -515,11 +547,19 @@ func (w *winWatcher) readEvents() {
 	}
 }
 
-func (w *winWatcher) sendEvent(name string, mask uint64) bool {
+// sendEvent sends the event for mask on name, reported against the watch of
+// root. It returns false if there is no event to send.
+func (w *winWatcher) sendEvent(root, name string, mask uint64) bool {
 	if mask == 0 {
 		return false
 	}
 	event := newEvent(name, uint32(mask))
+	event.Time, event.Root = time.Now(), root
+	if event.Op&(notify.Remove|notify.Rename) == 0 {
+		if fi, err := os.Lstat(name); err == nil {
+			event.IsDir, event.Info = fi.IsDir(), fi
+		}
+	}
 	select {
 	case ch := <-w.quit:
 		w.quit <- ch
@@ -528,6 +568,27 @@ func (w *winWatcher) sendEvent(name string, mask uint64) bool {
 	return true
 }
 
+// toSysFlags returns the watch flags producing the events of ops.
+func toSysFlags(ops notify.Op) uint32 {
+	var flags uint32
+	if ops&notify.Create != 0 {
+		flags |= sysFSCREATE | sysFSMOVEDTO
+	}
+	if ops&notify.Write != 0 {
+		flags |= sysFSMODIFY
+	}
+	if ops&notify.Remove != 0 {
+		flags |= sysFSDELETE | sysFSDELETESELF
+	}
+	if ops&notify.Rename != 0 {
+		flags |= sysFSMOVEDFROM | sysFSMOVESELF
+	}
+	if ops&notify.Chmod != 0 {
+		flags |= sysFSATTRIB
+	}
+	return flags
+}
+
 func toWindowsFlags(mask uint64) uint32 {
 	var m uint32
 	if mask&sysFSACCESS != 0 {
@@ -0,0 +1,528 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+// Package journal records the events of a notify.Watcher in a durable log,
+// so that consumers can resume after a restart from the last event they
+// processed, and changes made while nothing was watching are found by
+// reconciling the watched roots against the state last recorded.
+//
+// A journal is a directory of segment files, each holding one JSON record
+// per line and named after the sequence number of its first record, next
+// to the checkpoints of the consumers and the recorded state of the files.
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+	"github.com/gottingen/felix/vfs"
+)
+
+// DefaultSegmentSize is the size at which a new segment is started when
+// Options.SegmentSize is not set.
+const DefaultSegmentSize = 4 << 20
+
+const (
+	segmentExt     = ".log"
+	checkpointsDir = "checkpoints"
+	stateFile      = "state.json"
+)
+
+var (
+	ErrClosed = errors.New("journal: closed")
+	// ErrCompacted is returned when replaying from a sequence number whose
+	// successors were compacted away.
+	ErrCompacted = errors.New("journal: records compacted")
+)
+
+// Options configures a Journal.
+type Options struct {
+	// Fs holds the journal. It defaults to the operating system's file
+	// system.
+	Fs vfs.Vfs
+	// SegmentSize is the size in bytes past which a new segment is started.
+	SegmentSize int64
+	// SyncInterval is how long an appended record may stay unsynced. Zero
+	// syncs the segment on every Append, so that a record appended is not
+	// lost in a power failure; a larger interval trades the records of
+	// that long for faster appends. Checkpoints and the recorded state are
+	// always synced.
+	SyncInterval time.Duration
+}
+
+// A Record is an event as the journal stores it.
+type Record struct {
+	Seq     uint64    `json:"seq"`
+	Op      notify.Op `json:"op"`
+	Name    string    `json:"name,omitempty"`
+	OldName string    `json:"old_name,omitempty"`
+	Time    time.Time `json:"time"`
+	IsDir   bool      `json:"is_dir,omitempty"`
+	Root    string    `json:"root,omitempty"`
+}
+
+// Event returns the event r was recorded from, without its file info.
+func (r Record) Event() notify.Event {
+	return notify.Event{
+		Name:    r.Name,
+		OldName: r.OldName,
+		Op:      r.Op,
+		Time:    r.Time,
+		IsDir:   r.IsDir,
+		Root:    r.Root,
+	}
+}
+
+// A Journal is an append-only log of events numbered from 1. It is safe for
+// concurrent use.
+type Journal struct {
+	fs   vfs.Vfs
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	segments []uint64 // First sequence numbers of the segments, ascending
+	active   vfs.File // Last segment, open for appending
+	size     int64    // Size of the active segment
+	next     uint64   // Sequence number of the next record
+	closed   bool
+
+	// With a SyncInterval: whether the active segment has unsynced
+	// records, the timer syncing it and the error of the last sync done
+	// by the timer, returned by the next Append.
+	dirty   bool
+	syncer  *time.Timer
+	syncErr error
+
+	// Set by Reconcile: the file system and roots the state is kept for.
+	src   vfs.Vfs
+	roots []string
+	state *fileState
+}
+
+// Open opens the journal in dir, creating it if needed. A record left
+// incomplete by a crash at the end of the last segment is discarded; a
+// corrupt record before the end is an error.
+func Open(dir string, opts Options) (*Journal, error) {
+	if opts.Fs == nil {
+		opts.Fs = vfs.NewOsFs()
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	j := &Journal{fs: opts.Fs, dir: filepath.Clean(dir), opts: opts, next: 1}
+	if err := j.fs.MkdirAll(filepath.Join(j.dir, checkpointsDir), 0755); err != nil {
+		return nil, err
+	}
+	list, err := vfs.ReadDir(j.fs, j.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range list {
+		if seq, ok := parseSegmentName(fi.Name()); ok && !fi.IsDir() {
+			j.segments = append(j.segments, seq)
+		}
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a] < j.segments[b] })
+
+	if len(j.segments) == 0 {
+		if err := j.roll(); err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+	if err := j.openLast(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentExt)
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+	return seq, err == nil && seq > 0
+}
+
+func (j *Journal) segmentPath(seq uint64) string {
+	return filepath.Join(j.dir, segmentName(seq))
+}
+
+// openLast finds the next sequence number in the last segment, cuts off an
+// incomplete last record and opens the segment for appending.
+func (j *Journal) openLast() error {
+	first := j.segments[len(j.segments)-1]
+	f, err := j.fs.OpenFile(j.segmentPath(first), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	j.next = first
+	var good int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A last line without a newline was torn by a crash.
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		var rec Record
+		if jerr := json.Unmarshal(line, &rec); jerr != nil {
+			// Only the last record can have been torn.
+			if _, err := r.Peek(1); err != io.EOF {
+				f.Close()
+				return fmt.Errorf("journal: corrupt record in %s at offset %d: %v", segmentName(first), good, jerr)
+			}
+			break
+		}
+		good += int64(len(line))
+		j.next = rec.Seq + 1
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	j.active, j.size = f, good
+	return nil
+}
+
+// roll starts a new segment with the next record. If the segment cannot be
+// created, the last one stays active. j.mu must be held.
+func (j *Journal) roll() error {
+	if j.active != nil {
+		if err := j.sync(); err != nil {
+			return err
+		}
+	}
+	f, err := j.fs.OpenFile(j.segmentPath(j.next), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(j.fs, j.dir); err != nil {
+		f.Close()
+		j.fs.Remove(j.segmentPath(j.next))
+		return err
+	}
+	var cerr error
+	if j.active != nil {
+		cerr = j.active.Close()
+	}
+	j.segments = append(j.segments, j.next)
+	j.active, j.size = f, 0
+	return cerr
+}
+
+// sync syncs the active segment. j.mu must be held.
+func (j *Journal) sync() error {
+	if j.syncer != nil {
+		j.syncer.Stop()
+		j.syncer = nil
+	}
+	j.dirty = false
+	return j.active.Sync()
+}
+
+// syncLater syncs the active segment when the SyncInterval after an
+// Append is over.
+func (j *Journal) syncLater() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.syncer = nil
+	if j.closed || !j.dirty {
+		return
+	}
+	if err := j.sync(); err != nil && j.syncErr == nil {
+		j.syncErr = err
+	}
+}
+
+// Append records ev and returns its sequence number. An event without a
+// time is recorded with the current time.
+//
+// If the journal keeps the state of files, it is updated after appending
+// without holding up other callers.
+func (j *Journal) Append(ev notify.Event) (uint64, error) {
+	j.mu.Lock()
+	seq, err := j.append(ev)
+	src, roots, tracked := j.src, j.roots, j.state != nil
+	j.mu.Unlock()
+	if err == nil && tracked {
+		j.track(src, roots, seq, ev)
+	}
+	return seq, err
+}
+
+// append records ev. j.mu must be held.
+func (j *Journal) append(ev notify.Event) (uint64, error) {
+	if j.closed {
+		return 0, ErrClosed
+	}
+	if err := j.syncErr; err != nil {
+		j.syncErr = nil
+		return 0, err
+	}
+	rec := Record{
+		Seq:     j.next,
+		Op:      ev.Op,
+		Name:    ev.Name,
+		OldName: ev.OldName,
+		Time:    ev.Time,
+		IsDir:   ev.IsDir,
+		Root:    ev.Root,
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	data = append(data, '\n')
+	if j.size > 0 && j.size+int64(len(data)) > j.opts.SegmentSize {
+		if err := j.roll(); err != nil {
+			return 0, err
+		}
+		if err := j.saveState(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := j.active.Write(data)
+	j.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	j.next++
+	switch {
+	case j.opts.SyncInterval <= 0:
+		if err := j.sync(); err != nil {
+			return 0, err
+		}
+	case j.syncer == nil:
+		j.dirty = true
+		j.syncer = time.AfterFunc(j.opts.SyncInterval, j.syncLater)
+	default:
+		j.dirty = true
+	}
+	return rec.Seq, nil
+}
+
+// Follow appends the events of w until ctx is done or appending fails,
+// passing the errors of w to errHandler; see notify.Run.
+func (j *Journal) Follow(ctx context.Context, w notify.Watcher, errHandler func(error) error) error {
+	return notify.Run(ctx, w, func(ev notify.Event) error {
+		_, err := j.Append(ev)
+		return err
+	}, errHandler)
+}
+
+// LastSeq returns the sequence number of the last record, or 0 if there
+// are none.
+func (j *Journal) LastSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.next - 1
+}
+
+// Replay calls fn for the records after the sequence number after, in
+// order, until fn returns an error, which Replay returns. Records appended
+// while replaying may or may not be seen. It returns ErrCompacted if some
+// of the records after after were compacted away.
+func (j *Journal) Replay(after uint64, fn func(Record) error) error {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return ErrClosed
+	}
+	segments := append([]uint64(nil), j.segments...)
+	j.mu.Unlock()
+
+	if after+1 < segments[0] {
+		return ErrCompacted
+	}
+	for i, first := range segments {
+		if i+1 < len(segments) && segments[i+1] <= after+1 {
+			continue
+		}
+		if err := j.replaySegment(first, after, i == len(segments)-1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *Journal) replaySegment(first, after uint64, last bool, fn func(Record) error) error {
+	f, err := j.fs.Open(j.segmentPath(first))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && (len(line) == 0 || last) {
+			// A last line without a newline is being appended.
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("journal: corrupt record in %s: %v", segmentName(first), err)
+		}
+		if rec.Seq <= after {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Compact removes the segments holding only records up to through, which
+// is usually the lowest checkpoint of the consumers. The segment being
+// appended to is kept.
+func (j *Journal) Compact(through uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return ErrClosed
+	}
+	for len(j.segments) > 1 && j.segments[1]-1 <= through {
+		if err := j.fs.Remove(j.segmentPath(j.segments[0])); err != nil {
+			return err
+		}
+		j.segments = j.segments[1:]
+	}
+	return nil
+}
+
+func (j *Journal) checkpointPath(consumer string) (string, error) {
+	if consumer == "" || strings.ContainsAny(consumer, `/\`) || consumer == "." || consumer == ".." {
+		return "", fmt.Errorf("journal: invalid consumer name %q", consumer)
+	}
+	return filepath.Join(j.dir, checkpointsDir, consumer), nil
+}
+
+// Checkpoint records that consumer processed the records up to seq, so
+// that it can resume with Replay(Checkpoint(consumer), ...) after a
+// restart.
+func (j *Journal) Checkpoint(consumer string, seq uint64) error {
+	name, err := j.checkpointPath(consumer)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.fs, name, []byte(strconv.FormatUint(seq, 10)+"\n"))
+}
+
+// LoadCheckpoint returns the last checkpoint of consumer, or 0 if it has
+// none.
+func (j *Journal) LoadCheckpoint(consumer string) (uint64, error) {
+	name, err := j.checkpointPath(consumer)
+	if err != nil {
+		return 0, err
+	}
+	data, err := vfs.ReadFile(j.fs, name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("journal: corrupt checkpoint %q: %v", consumer, err)
+	}
+	return seq, nil
+}
+
+// Close saves the state of the files, if reconciled, and closes the
+// journal.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	err := j.saveState()
+	if serr := j.sync(); err == nil {
+		err = serr
+	}
+	if err == nil {
+		err = j.syncErr
+	}
+	if cerr := j.active.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic replaces name with data through a temporary file, so that
+// a crash leaves either the old or the new content. The data is synced
+// before the rename and the directory after it.
+func writeFileAtomic(fs vfs.Vfs, name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(fs, filepath.Dir(name))
+}
+
+// syncDir syncs the directory dir, so that the entries created in it or
+// renamed into it survive a power failure. Windows cannot sync directories;
+// the error is ignored there.
+func syncDir(fs vfs.Vfs, dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package journal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+	"github.com/gottingen/felix/vfs"
+)
+
+func openJournal(t *testing.T, fs vfs.Vfs, opts Options) *Journal {
+	t.Helper()
+	opts.Fs = fs
+	j, err := Open("/journal", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return j
+}
+
+func appendEvents(t *testing.T, j *Journal, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := j.Append(notify.Event{Name: name, Op: notify.Write}); err != nil {
+			t.Fatalf("Append(%s) failed: %v", name, err)
+		}
+	}
+}
+
+// replay returns "seq:name" for the records after the given sequence number.
+func replay(t *testing.T, j *Journal, after uint64) []string {
+	t.Helper()
+	var got []string
+	if err := j.Replay(after, func(r Record) error {
+		got = append(got, fmt.Sprintf("%d:%s", r.Seq, r.Name))
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay(%d) failed: %v", after, err)
+	}
+	return got
+}
+
+func TestJournalAppendReplay(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	j := openJournal(t, fs, Options{})
+	appendEvents(t, j, "a", "b")
+	j.Close()
+
+	// Numbering goes on after reopening.
+	j = openJournal(t, fs, Options{})
+	defer j.Close()
+	appendEvents(t, j, "c")
+	if got, want := replay(t, j, 0), []string{"1:a", "2:b", "3:c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := replay(t, j, 2), []string{"3:c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if seq := j.LastSeq(); seq != 3 {
+		t.Errorf("LastSeq() = %d, want 3", seq)
+	}
+
+	ev := notify.Event{Name: "d", OldName: "c", Op: notify.Rename, IsDir: true, Root: "/", Time: time.Unix(1, 0)}
+	if _, err := j.Append(ev); err != nil {
+		t.Fatal(err)
+	}
+	var last Record
+	j.Replay(3, func(r Record) error {
+		last = r
+		return nil
+	})
+	if got := last.Event(); got.Name != ev.Name || got.OldName != ev.OldName ||
+		got.Op != ev.Op || got.IsDir != ev.IsDir || got.Root != ev.Root || !got.Time.Equal(ev.Time) {
+		t.Errorf("got %+v, want %+v", got, ev)
+	}
+}
+
+func TestJournalTornRecord(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	j := openJournal(t, fs, Options{})
+	appendEvents(t, j, "a", "b")
+	j.Close()
+
+	f, err := fs.OpenFile(filepath.Join("/journal", segmentName(1)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"na`)
+	f.Close()
+
+	j = openJournal(t, fs, Options{})
+	defer j.Close()
+	appendEvents(t, j, "c")
+	if got, want := replay(t, j, 0), []string{"1:a", "2:b", "3:c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJournalCorruptRecord(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	j := openJournal(t, fs, Options{})
+	appendEvents(t, j, "a")
+	j.Close()
+
+	// A complete but unreadable last line is a torn record too.
+	name := filepath.Join("/journal", segmentName(1))
+	data, _ := vfs.ReadFile(fs, name)
+	vfs.WriteFile(fs, name, append(data, "{\"seq\":2\n"...), 0644)
+	j = openJournal(t, fs, Options{})
+	appendEvents(t, j, "b")
+	j.Close()
+	if data, _ = vfs.ReadFile(fs, name); !strings.Contains(string(data), `"seq":2,`) {
+		t.Fatalf("torn record not replaced: %s", data)
+	}
+
+	// Anything in front of other records is corruption.
+	lines := strings.SplitAfter(string(data), "\n")
+	vfs.WriteFile(fs, name, []byte(lines[0]+"garbage\n"+lines[1]), 0644)
+	if _, err := Open("/journal", Options{Fs: fs}); err == nil {
+		t.Fatal("Open succeeded with a corrupt record")
+	}
+	if data, _ := vfs.ReadFile(fs, name); !strings.Contains(string(data), `"seq":2,`) {
+		t.Errorf("records after the corruption were cut off: %s", data)
+	}
+}
+
+func TestJournalSync(t *testing.T) {
+	fs := vfs.NewInstrumentedFs(&vfs.MemMapFs{}, "journal")
+	syncs := func() uint64 {
+		return fs.Snapshot().Methods["File.Sync"].Calls
+	}
+
+	j := openJournal(t, fs, Options{})
+	before := syncs()
+	appendEvents(t, j, "a", "b")
+	if n := syncs() - before; n != 2 {
+		t.Errorf("%d syncs for 2 records, want 2", n)
+	}
+	// The checkpoint file and its directory.
+	before = syncs()
+	j.Checkpoint("sync", 2)
+	if n := syncs() - before; n != 2 {
+		t.Errorf("%d syncs for a checkpoint, want 2", n)
+	}
+	j.Close()
+
+	j = openJournal(t, fs, Options{SyncInterval: 10 * time.Millisecond})
+	defer j.Close()
+	before = syncs()
+	appendEvents(t, j, "c", "d")
+	if n := syncs() - before; n != 0 {
+		t.Errorf("%d syncs right after appending, want 0", n)
+	}
+	for deadline := time.Now().Add(time.Second); syncs() == before; {
+		if time.Now().After(deadline) {
+			t.Fatal("Records never synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	// Every record gets a segment of its own.
+	j := openJournal(t, fs, Options{SegmentSize: 1})
+	defer j.Close()
+	appendEvents(t, j, "a", "b", "c", "d")
+	if n := len(j.segments); n != 4 {
+		t.Fatalf("Expected 4 segments, got %d", n)
+	}
+
+	if err := j.Compact(2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replay(t, j, 2), []string{"3:c", "4:d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := j.Replay(1, func(Record) error { return nil }); err != ErrCompacted {
+		t.Errorf("Replay of compacted records returned %v", err)
+	}
+
+	// The active segment stays.
+	if err := j.Compact(10); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replay(t, j, 3), []string{"4:d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJournalCheckpoint(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	j := openJournal(t, fs, Options{})
+	defer j.Close()
+
+	if seq, err := j.LoadCheckpoint("sync"); seq != 0 || err != nil {
+		t.Errorf("LoadCheckpoint without checkpoint = %d, %v", seq, err)
+	}
+	if err := j.Checkpoint("sync", 42); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := j.LoadCheckpoint("sync"); seq != 42 || err != nil {
+		t.Errorf("LoadCheckpoint = %d, %v; want 42", seq, err)
+	}
+	if err := j.Checkpoint("../x", 1); err == nil {
+		t.Error("Checkpoint accepted a path as consumer name")
+	}
+}
+
+func ops(records []Record) []string {
+	var got []string
+	for _, r := range records {
+		got = append(got, fmt.Sprintf("%s %s", r.Op, r.Name))
+	}
+	return got
+}
+
+func TestJournalReconcile(t *testing.T) {
+	fs, src := &vfs.MemMapFs{}, &vfs.MemMapFs{}
+	src.MkdirAll("/data/sub", 0755)
+	vfs.WriteFile(src, "/data/kept", []byte("1"), 0644)
+	vfs.WriteFile(src, "/data/changed", []byte("1"), 0644)
+	vfs.WriteFile(src, "/data/sub/removed", []byte("1"), 0644)
+
+	// Without a recorded state there is nothing to compare with.
+	j := openJournal(t, fs, Options{})
+	records, err := j.Reconcile(src, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ops(records), []string{"RESYNC "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Changes appended while running are part of the recorded state.
+	vfs.WriteFile(src, "/data/appended", nil, 0644)
+	j.Append(notify.Event{Name: "/data/appended", Op: notify.Create})
+	j.Close()
+
+	// Changes while the journal was closed.
+	vfs.WriteFile(src, "/data/changed", []byte("22"), 0644)
+	src.Remove("/data/sub/removed")
+	vfs.WriteFile(src, "/data/created", nil, 0644)
+
+	j = openJournal(t, fs, Options{})
+	defer j.Close()
+	records, err = j.Reconcile(src, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"REMOVE /data/sub/removed",
+		"WRITE /data/changed",
+		"CREATE /data/created",
+		"RESYNC ",
+	}
+	if got := ops(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if records[0].Seq != 3 || records[0].Root != "/data" {
+		t.Errorf("Unexpected first record: %+v", records[0])
+	}
+}
+
+func TestJournalReconcileKeepsOtherRoots(t *testing.T) {
+	fs, src := &vfs.MemMapFs{}, &vfs.MemMapFs{}
+	src.MkdirAll("/a", 0755)
+	src.MkdirAll("/b", 0755)
+	vfs.WriteFile(src, "/a/file", []byte("1"), 0644)
+	vfs.WriteFile(src, "/b/file", []byte("1"), 0644)
+
+	j := openJournal(t, fs, Options{})
+	if _, err := j.Reconcile(src, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	j = openJournal(t, fs, Options{})
+	if _, err := j.Reconcile(src, "/b"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// The state of /a survived reconciling /b alone.
+	vfs.WriteFile(src, "/a/file", []byte("22"), 0644)
+	j = openJournal(t, fs, Options{})
+	defer j.Close()
+	records, err := j.Reconcile(src, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ops(records), []string{"WRITE /a/file", "RESYNC "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileState(t *testing.T) {
+	st := newFileState(notify.Snapshot{
+		"/data":         {},
+		"/data/a":       {},
+		"/data/a/b":     {},
+		"/data/a/b/c":   {},
+		"/data/ab":      {},
+		"/data/a/other": {},
+	}, 1)
+	st.set("/data/a/b/new", notify.FileState{}, 3)
+
+	// Forgetting a tree keeps its neighbours and what later events recorded.
+	st.forget("/data/a", 2)
+	var got []string
+	for path := range st.files {
+		got = append(got, path)
+	}
+	sort.Strings(got)
+	if want := []string{"/data", "/data/a/b/new", "/data/ab"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	st.forget("/data/a", 3)
+	st.forget("/data/ab", 3)
+	if len(st.files) != 1 || len(st.children) != 1 || len(st.children["/"]) != 1 {
+		t.Errorf("index not cleaned up: %v %v", st.files, st.children)
+	}
+}
+
+func TestJournalRollFailure(t *testing.T) {
+	fs := vfs.NewFaultFs(&vfs.MemMapFs{})
+	j := openJournal(t, fs, Options{SegmentSize: 1})
+	appendEvents(t, j, "a")
+
+	// The segment for the next record cannot be created: the journal
+	// stays usable with the last one.
+	fs.AddRule(vfs.FaultRule{Ops: vfs.FaultOpen, Path: "/journal/*.log", Err: os.ErrPermission})
+	if _, err := j.Append(notify.Event{Name: "b", Op: notify.Write}); err == nil {
+		t.Error("Append succeeded without a segment")
+	}
+	fs.SetRules()
+	appendEvents(t, j, "c")
+	if got, want := replay(t, j, 0), []string{"1:a", "2:c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	fs.AddRule(vfs.FaultRule{Ops: vfs.FaultOpen, Path: "/journal/*.log", Err: os.ErrPermission})
+	j.Append(notify.Event{Name: "d", Op: notify.Write})
+	if err := j.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestJournalFollow(t *testing.T) {
+	fs, src := &vfs.MemMapFs{}, &vfs.MemMapFs{}
+	j := openJournal(t, fs, Options{})
+	defer j.Close()
+	w := notify.NewMemWatcher(src)
+	if err := w.AddWithOps("/", notify.Create); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- j.Follow(ctx, w, nil) }()
+	vfs.WriteFile(src, "/a", nil, 0644)
+	vfs.WriteFile(src, "/b", nil, 0644)
+	for deadline := time.Now().Add(time.Second); j.LastSeq() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d events appended", j.LastSeq())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Follow returned %v", err)
+	}
+	if got, want := replay(t, j, 0), []string{"1:/a", "2:/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package journal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+	"github.com/gottingen/felix/vfs"
+)
+
+// savedState is the content of the state file.
+type savedState struct {
+	Roots []string        `json:"roots"`
+	Files notify.Snapshot `json:"files"`
+}
+
+// Reconcile finds the changes made below roots in src since the state last
+// recorded, appends them as events followed by a Resync event, and returns
+// the records appended. Roots without a recorded state are only scanned.
+// The recorded state of other roots is kept for a later Reconcile.
+//
+// From then on the journal keeps the state of the files below roots up to
+// date with the events appended, and records it when a segment is started
+// and on Close. After a crash the recorded state may be older than the last
+// events, whose changes are then appended again.
+func (j *Journal) Reconcile(src vfs.Vfs, roots ...string) ([]Record, error) {
+	roots = append([]string(nil), roots...)
+	for i, root := range roots {
+		roots[i] = filepath.Clean(root)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil, ErrClosed
+	}
+	saved, err := j.loadState()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, root := range saved.Roots {
+		known[root] = true
+	}
+
+	old, cur, state := notify.Snapshot{}, notify.Snapshot{}, notify.Snapshot{}
+	for _, root := range roots {
+		files, err := scan(src, root)
+		if err != nil {
+			return nil, err
+		}
+		for path, s := range files {
+			state[path] = s
+			if known[root] {
+				cur[path] = s
+			}
+		}
+		if !known[root] {
+			continue
+		}
+		for path, s := range saved.Files {
+			if within(root, path) {
+				old[path] = s
+			}
+		}
+	}
+
+	var records []Record
+	now := time.Now()
+	j.state = nil // Not saved while appending the differences
+	for _, ev := range old.Diff(cur) {
+		ev.Time, ev.Root = now, rootOf(roots, ev.Name)
+		seq, err := j.append(ev)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, recordOf(seq, ev))
+	}
+	ev := notify.Event{Op: notify.Resync, Time: now}
+	seq, err := j.append(ev)
+	if err != nil {
+		return records, err
+	}
+	records = append(records, recordOf(seq, ev))
+
+	// Roots reconciled before but not now keep their recorded state.
+	kept := roots
+	for _, root := range saved.Roots {
+		if rootOf(roots, root) == "" {
+			kept = append(kept, root)
+		}
+	}
+	for path, s := range saved.Files {
+		if rootOf(roots, path) == "" {
+			state[path] = s
+		}
+	}
+
+	j.src, j.roots, j.state = src, kept, newFileState(state, seq)
+	return records, j.saveState()
+}
+
+func recordOf(seq uint64, ev notify.Event) Record {
+	return Record{
+		Seq:     seq,
+		Op:      ev.Op,
+		Name:    ev.Name,
+		OldName: ev.OldName,
+		Time:    ev.Time,
+		IsDir:   ev.IsDir,
+		Root:    ev.Root,
+	}
+}
+
+// loadState reads the state file. A missing file is an empty state.
+func (j *Journal) loadState() (savedState, error) {
+	var s savedState
+	data, err := vfs.ReadFile(j.fs, filepath.Join(j.dir, stateFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// saveState writes the state file if the state is tracked. j.mu must be
+// held.
+func (j *Journal) saveState() error {
+	if j.state == nil {
+		return nil
+	}
+	data, err := json.Marshal(savedState{Roots: j.roots, Files: j.state.files})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.fs, filepath.Join(j.dir, stateFile), data)
+}
+
+// track updates the state after ev was appended with the sequence number
+// seq. It looks at src without holding j.mu, so that appending does not
+// wait for it, and then skips what was recorded for later events.
+func (j *Journal) track(src vfs.Vfs, roots []string, seq uint64, ev notify.Event) {
+	if ev.Name == "" {
+		return
+	}
+	name := filepath.Clean(ev.Name)
+	var (
+		fi    os.FileInfo
+		err   error
+		files notify.Snapshot
+	)
+	watched := rootOf(roots, name) != ""
+	if watched {
+		fi, err = src.Stat(name)
+		// A directory created or moved in brings its entries along,
+		// which have no events of their own.
+		if err == nil && fi.IsDir() && ev.Op&(notify.Create|notify.Rename) != 0 {
+			files, _ = scan(src, name)
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state == nil || seq <= j.state.since {
+		return
+	}
+	if ev.OldName != "" {
+		j.state.forget(filepath.Clean(ev.OldName), seq)
+	}
+	switch {
+	case !watched:
+	case err != nil:
+		j.state.forget(name, seq)
+	case files != nil:
+		j.state.forget(name, seq)
+		for path, s := range files {
+			j.state.set(path, s, seq)
+		}
+	default:
+		j.state.set(name, notify.StateOf(fi), seq)
+	}
+}
+
+// fileState is the state of the files below the roots, indexed by
+// directory so that a tree is forgotten without going through every file.
+type fileState struct {
+	since    uint64                     // Events up to since are part of the state
+	files    notify.Snapshot            // What is saved as the state
+	seqs     map[string]uint64          // Sequence number of the event each file was recorded for
+	children map[string]map[string]bool // Paths recorded below each directory, directly or deeper (key: directory)
+}
+
+// newFileState returns the state of files, recorded after the event with
+// the sequence number since.
+func newFileState(files notify.Snapshot, since uint64) *fileState {
+	st := &fileState{
+		since:    since,
+		files:    notify.Snapshot{},
+		seqs:     make(map[string]uint64),
+		children: make(map[string]map[string]bool),
+	}
+	for path, s := range files {
+		st.set(path, s, since)
+	}
+	return st
+}
+
+// set records s for path unless a later event recorded it already.
+func (st *fileState) set(path string, s notify.FileState, seq uint64) {
+	if st.seqs[path] > seq {
+		return
+	}
+	st.files[path], st.seqs[path] = s, seq
+	for dir := filepath.Dir(path); dir != path && !st.children[dir][path]; path, dir = dir, filepath.Dir(dir) {
+		if st.children[dir] == nil {
+			st.children[dir] = make(map[string]bool)
+		}
+		st.children[dir][path] = true
+	}
+}
+
+// forget drops path and everything below it, except what later events than
+// seq recorded.
+func (st *fileState) forget(path string, seq uint64) {
+	for child := range st.children[path] {
+		st.forget(child, seq)
+	}
+	if _, ok := st.files[path]; ok && st.seqs[path] <= seq {
+		delete(st.files, path)
+		delete(st.seqs, path)
+	}
+	// Unlink path, and directories above it left empty, from the index.
+	for dir := filepath.Dir(path); dir != path; path, dir = dir, filepath.Dir(dir) {
+		if _, ok := st.files[path]; ok || len(st.children[path]) > 0 {
+			return
+		}
+		delete(st.children, path)
+		delete(st.children[dir], path)
+		if len(st.children[dir]) > 0 {
+			return
+		}
+		delete(st.children, dir)
+	}
+}
+
+// scan takes a snapshot of root and everything below it. A missing root
+// gives an empty snapshot.
+func scan(fs vfs.Vfs, root string) (notify.Snapshot, error) {
+	files := notify.Snapshot{}
+	err := vfs.Walk(fs, root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		files[path] = notify.StateOf(fi)
+		return nil
+	})
+	return files, err
+}
+
+// within reports whether path is root or below it.
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator)) ||
+		root == string(filepath.Separator) && strings.HasPrefix(path, root)
+}
+
+// rootOf returns the longest of roots name is within, or "".
+func rootOf(roots []string, name string) string {
+	var match string
+	for _, root := range roots {
+		if within(root, name) && len(root) > len(match) {
+			match = root
+		}
+	}
+	return match
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+var (
+	_ RecursiveWatcher = (*MemWatcher)(nil)
+	_ OpsWatcher       = (*MemWatcher)(nil)
+)
+
+// defaultOps are the ops watched by Add.
+const defaultOps = Create | Write | Remove | Rename | Chmod
+
+// MemWatcher watches a vfs.MemMapFs through its change subscription. The
+// events of a change are queued before the call making it returns, in the
+// order the changes were made, so tests can make changes and then assert
+// on the exact event sequence.
+//
+// A rename with both names watched is reported as one Rename event with
+// OldName set. Writes are reported per Write call; closing a file opened
+// for writing is reported as CloseWrite when asked for with AddWithOps.
+type MemWatcher struct {
+	fs     *vfs.MemMapFs
+	cancel func()
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	watches map[string]*memWatch // key: path
+	queue   []Event
+	closed  bool
+
+	events chan Event
+	errors chan error
+	done   chan struct{}
+}
+
+type memWatch struct {
+	ops       Op
+	recursive bool
+}
+
+// NewMemWatcher returns a watcher for changes made to fs.
+func NewMemWatcher(fs *vfs.MemMapFs) *MemWatcher {
+	w := &MemWatcher{
+		fs:      fs,
+		watches: make(map[string]*memWatch),
+		events:  make(chan Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	w.cancel = fs.Subscribe(w.changed)
+	go w.deliver()
+	return w
+}
+
+func (w *MemWatcher) EventChannel() <-chan Event {
+	return w.events
+}
+
+// ErrorChannel returns the error channel. A MemWatcher has no errors to
+// report; the channel is closed with the watcher.
+func (w *MemWatcher) ErrorChannel() <-chan error {
+	return w.errors
+}
+
+// Close stops watching. Queued events not yet received are dropped.
+func (w *MemWatcher) Close() error {
+	w.cancel()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.cond.Broadcast()
+	return nil
+}
+
+// Add starts watching the named file or directory (non-recursively).
+func (w *MemWatcher) Add(name string) error {
+	return w.add(name, defaultOps, false)
+}
+
+// AddRecursive starts watching the named directory and everything below it.
+func (w *MemWatcher) AddRecursive(name string) error {
+	return w.add(name, defaultOps, true)
+}
+
+// AddWithOps starts watching the named file or directory (non-recursively)
+// for the events of ops only.
+func (w *MemWatcher) AddWithOps(name string, ops Op) error {
+	return w.add(name, ops, false)
+}
+
+func (w *MemWatcher) add(name string, ops Op, recursive bool) error {
+	name = filepath.Clean(name)
+	if _, err := w.fs.Stat(name); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("mem watcher already closed")
+	}
+	if mw, ok := w.watches[name]; ok {
+		mw.ops |= ops
+		mw.recursive = mw.recursive || recursive
+		return nil
+	}
+	w.watches[name] = &memWatch{ops: ops, recursive: recursive}
+	return nil
+}
+
+// Remove stops watching the named file or directory.
+func (w *MemWatcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[name]; !ok {
+		return fmt.Errorf("can't remove non-existent mem watch for: %s", name)
+	}
+	delete(w.watches, name)
+	return nil
+}
+
+// ops returns the ops watched for name, or 0 if it is not watched, and the
+// path of the closest watch. w.mu must be held.
+func (w *MemWatcher) ops(name string) (Op, string) {
+	var (
+		ops  Op
+		root string
+	)
+	for path, mw := range w.watches {
+		switch {
+		case path == name, path == filepath.Dir(name):
+		case mw.recursive && strings.HasPrefix(name, path+string(os.PathSeparator)):
+		case mw.recursive && path == string(os.PathSeparator):
+		default:
+			continue
+		}
+		ops |= mw.ops
+		if len(path) > len(root) {
+			root = path
+		}
+	}
+	return ops, root
+}
+
+func (w *MemWatcher) changed(c vfs.MemChange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+
+	now := time.Now()
+	var ev Event
+	switch c.Op {
+	case vfs.MemCreate:
+		ev = Event{Name: c.Name, Op: Create}
+	case vfs.MemWrite:
+		ev = Event{Name: c.Name, Op: Write}
+	case vfs.MemCloseWrite:
+		ev = Event{Name: c.Name, Op: CloseWrite}
+	case vfs.MemRemove:
+		ev = Event{Name: c.Name, Op: Remove}
+	case vfs.MemChmod, vfs.MemChtimes:
+		ev = Event{Name: c.Name, Op: Chmod}
+	case vfs.MemRename:
+		oldOps, oldRoot := w.ops(c.OldName)
+		newOps, newRoot := w.ops(c.Name)
+		switch {
+		case oldOps&Rename != 0 && newOps&Rename != 0:
+			w.push(Event{Name: c.Name, OldName: c.OldName, Op: Rename, Time: now, IsDir: c.IsDir, Root: newRoot})
+		case oldOps&Rename != 0:
+			w.push(Event{Name: c.OldName, Op: Rename, Time: now, IsDir: c.IsDir, Root: oldRoot})
+		case newOps&Create != 0:
+			w.push(Event{Name: c.Name, Op: Create, Time: now, IsDir: c.IsDir, Root: newRoot})
+		}
+		w.forget(c.OldName)
+		return
+	default:
+		return
+	}
+
+	if ops, root := w.ops(c.Name); ops&ev.Op != 0 {
+		ev.Time, ev.IsDir, ev.Root = now, c.IsDir, root
+		w.push(ev)
+	}
+	if c.Op == vfs.MemRemove {
+		w.forget(c.Name)
+	}
+}
+
+// forget drops the watches of a path that went away and of the paths below
+// it, as kernel watches go away with their files. w.mu must be held.
+func (w *MemWatcher) forget(name string) {
+	prefix := strings.TrimSuffix(name, string(os.PathSeparator)) + string(os.PathSeparator)
+	for path := range w.watches {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(w.watches, path)
+		}
+	}
+}
+
+// push queues ev for delivery. w.mu must be held.
+func (w *MemWatcher) push(ev Event) {
+	w.queue = append(w.queue, ev)
+	w.cond.Signal()
+}
+
+func (w *MemWatcher) deliver() {
+	defer close(w.errors)
+	defer close(w.events)
+
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		ev := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.events <- ev:
+		case <-w.done:
+			return
+		}
+	}
+}
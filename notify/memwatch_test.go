@@ -0,0 +1,172 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+// receiveEvents receives n events from w, failing the test if they do not
+// arrive in time.
+// stripPayload clears the fields of ev that vary between runs, or are
+// checked by tests of their own.
+func stripPayload(ev Event) Event {
+	ev.Time, ev.IsDir, ev.Root, ev.Info = time.Time{}, false, "", nil
+	return ev
+}
+
+// receiveEvents receives n events, without their payload.
+func receiveEvents(t *testing.T, w Watcher, n int) []Event {
+	var events []Event
+	for len(events) < n {
+		select {
+		case ev := <-w.EventChannel():
+			events = append(events, stripPayload(ev))
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d events: %v", len(events), n, events)
+		}
+	}
+	return events
+}
+
+func expectNoEvent(t *testing.T, w Watcher) {
+	select {
+	case ev := <-w.EventChannel():
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMemWatcher(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	fs.MkdirAll("/dir", 0755)
+	w := NewMemWatcher(fs)
+	defer w.Close()
+	if err := w.Add("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := fs.Create("/dir/file")
+	f.Write([]byte("data"))
+	f.Close()
+	fs.Chmod("/dir/file", 0600)
+	fs.Rename("/dir/file", "/dir/renamed")
+	fs.Rename("/dir/renamed", "/elsewhere")
+	fs.Mkdir("/dir/sub", 0755)
+	vfs.WriteFile(fs, "/dir/sub/file", nil, 0644)
+	fs.RemoveAll("/dir/sub")
+
+	want := []Event{
+		{Name: "/dir/file", Op: Create},
+		{Name: "/dir/file", Op: Write},
+		{Name: "/dir/file", Op: Chmod},
+		{Name: "/dir/renamed", OldName: "/dir/file", Op: Rename},
+		{Name: "/dir/renamed", Op: Rename},
+		{Name: "/dir/sub", Op: Create},
+		{Name: "/dir/sub", Op: Remove},
+	}
+	if got := receiveEvents(t, w, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	expectNoEvent(t, w)
+}
+
+func TestMemWatcherRecursiveOps(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	fs.MkdirAll("/dir", 0755)
+	w := NewMemWatcher(fs)
+	defer w.Close()
+	if err := w.AddRecursive("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWithOps("/other", Create); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+
+	fs.MkdirAll("/dir/a/b", 0755)
+	f, _ := fs.OpenFile("/dir/a/b/file", os.O_CREATE|os.O_WRONLY, 0644)
+	f.Close()
+	vfs.WriteFile(fs, "/outside", nil, 0644)
+
+	want := []Event{
+		{Name: "/dir/a", Op: Create},
+		{Name: "/dir/a/b", Op: Create},
+		{Name: "/dir/a/b/file", Op: Create},
+	}
+	if got := receiveEvents(t, w, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	expectNoEvent(t, w)
+
+	// CloseWrite is reported when asked for.
+	if err := w.AddWithOps("/dir/a/b", CloseWrite); err != nil {
+		t.Fatal(err)
+	}
+	f, _ = fs.OpenFile("/dir/a/b/file", os.O_WRONLY, 0)
+	f.Close()
+	if got := receiveEvents(t, w, 1); got[0] != (Event{Name: "/dir/a/b/file", Op: CloseWrite}) {
+		t.Errorf("unexpected event %v", got[0])
+	}
+}
+
+func TestMemWatcherForgetTree(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	fs.MkdirAll("/d/sub", 0755)
+	fs.MkdirAll("/other/sub", 0755)
+	w := NewMemWatcher(fs)
+	defer w.Close()
+	w.Add("/d/sub")
+	w.Add("/other/sub")
+
+	// The watch below the renamed directory goes with it, and a new
+	// directory of the same name is not watched.
+	fs.Rename("/d", "/e")
+	vfs.WriteFile(fs, "/d/sub/file", nil, 0644)
+	expectNoEvent(t, w)
+
+	fs.Remove("/other")
+	vfs.WriteFile(fs, "/other/sub/file", nil, 0644)
+	expectNoEvent(t, w)
+}
+
+func TestMemWatcherClose(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	w := NewMemWatcher(fs)
+	w.Add("/")
+	vfs.WriteFile(fs, "/file", nil, 0644)
+	w.Close()
+
+	for range w.EventChannel() {
+	}
+	if _, ok := <-w.ErrorChannel(); ok {
+		t.Error("errors channel not closed")
+	}
+	// Changes after Close go nowhere.
+	vfs.WriteFile(fs, "/file", nil, 0644)
+}
+
+func TestMemWatcherPayload(t *testing.T) {
+	fs := &vfs.MemMapFs{}
+	fs.MkdirAll("/dir", 0755)
+	w := NewMemWatcher(fs)
+	defer w.Close()
+	if err := w.AddRecursive("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	fs.Mkdir("/dir/sub", 0755)
+	ev := <-w.EventChannel()
+	if ev.Name != "/dir/sub" || !ev.IsDir || ev.Root != "/dir" || ev.Time.Before(before) {
+		t.Errorf("unexpected payload %+v", ev)
+	}
+}
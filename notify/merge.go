@@ -0,0 +1,244 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	_ RecursiveWatcher = (*Merged)(nil)
+	_ OpsWatcher       = (*Merged)(nil)
+)
+
+// Merged is a Watcher combining the events and errors of several watchers,
+// for example an inotify watcher for local directories and a polling one
+// for a network file system.
+//
+// Add and Remove go to the watcher routed the longest prefix of the path,
+// and to the first watcher for paths without a route. AddTo picks the
+// watcher explicitly. Remove goes to the watcher the path was added to.
+type Merged struct {
+	children []Watcher
+
+	mu     sync.Mutex
+	routes map[string]Watcher // key: path prefix
+	added  map[string]Watcher // Watcher each path was added to
+	closed bool
+
+	events chan Event
+	errors chan error
+	done   chan struct{}
+}
+
+// Merge returns a Watcher fanning in the events and errors of watchers. It
+// owns their channels; closing it closes them all. Its channels are closed
+// once those of all watchers are.
+func Merge(watchers ...Watcher) *Merged {
+	m := &Merged{
+		children: watchers,
+		routes:   make(map[string]Watcher),
+		added:    make(map[string]Watcher),
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(watchers))
+	for _, w := range watchers {
+		go func(w Watcher) {
+			defer wg.Done()
+			m.forward(w)
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(m.events)
+		close(m.errors)
+	}()
+	return m
+}
+
+// forward sends the events and errors of w on the merged channels until
+// the channels of w are closed.
+func (m *Merged) forward(w Watcher) {
+	events, errs := w.EventChannel(), w.ErrorChannel()
+	for events != nil || errs != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			select {
+			case m.events <- ev:
+			case <-m.done:
+				drain(w)
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case m.errors <- err:
+			case <-m.done:
+				drain(w)
+				return
+			}
+		}
+	}
+}
+
+func (m *Merged) EventChannel() <-chan Event {
+	return m.events
+}
+
+func (m *Merged) ErrorChannel() <-chan error {
+	return m.errors
+}
+
+// Route sends the paths at or below prefix to w, which must be one of the
+// merged watchers.
+func (m *Merged) Route(prefix string, w Watcher) error {
+	if !m.child(w) {
+		return errors.New("notify: route to a watcher not merged")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes[filepath.Clean(prefix)] = w
+	return nil
+}
+
+func (m *Merged) child(w Watcher) bool {
+	for _, c := range m.children {
+		if c == w {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the watcher for path. m.mu must be held.
+func (m *Merged) route(path string) (Watcher, error) {
+	var (
+		match  Watcher
+		length = -1
+	)
+	for prefix, w := range m.routes {
+		inside := path == prefix || strings.HasPrefix(path, prefix+string(filepath.Separator)) ||
+			prefix == string(filepath.Separator)
+		if inside && len(prefix) > length {
+			match, length = w, len(prefix)
+		}
+	}
+	if match != nil {
+		return match, nil
+	}
+	if len(m.children) == 0 {
+		return nil, fmt.Errorf("no watcher for: %s", path)
+	}
+	return m.children[0], nil
+}
+
+// add adds path with the watcher routed path, or w if not nil.
+func (m *Merged) add(path string, w Watcher, fn func(Watcher) error) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("notify: watcher closed")
+	}
+	if w == nil {
+		var err error
+		if w, err = m.route(path); err != nil {
+			return err
+		}
+	}
+	if err := fn(w); err != nil {
+		return err
+	}
+	m.added[path] = w
+	return nil
+}
+
+func (m *Merged) Add(path string) error {
+	return m.add(path, nil, func(w Watcher) error { return w.Add(path) })
+}
+
+// AddTo adds path with w, which must be one of the merged watchers.
+func (m *Merged) AddTo(w Watcher, path string) error {
+	if !m.child(w) {
+		return errors.New("notify: add to a watcher not merged")
+	}
+	return m.add(path, w, func(w Watcher) error { return w.Add(path) })
+}
+
+// AddRecursive fails if the watcher for path is not a RecursiveWatcher.
+func (m *Merged) AddRecursive(path string) error {
+	return m.add(path, nil, func(w Watcher) error {
+		rw, ok := w.(RecursiveWatcher)
+		if !ok {
+			return fmt.Errorf("watcher for %s cannot watch recursively", path)
+		}
+		return rw.AddRecursive(path)
+	})
+}
+
+// AddWithOps fails if the watcher for path is not an OpsWatcher.
+func (m *Merged) AddWithOps(path string, ops Op) error {
+	return m.add(path, nil, func(w Watcher) error {
+		ow, ok := w.(OpsWatcher)
+		if !ok {
+			return fmt.Errorf("watcher for %s cannot restrict ops", path)
+		}
+		return ow.AddWithOps(path, ops)
+	})
+}
+
+func (m *Merged) Remove(path string) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.added[path]
+	if !ok {
+		var err error
+		if w, err = m.route(path); err != nil {
+			return err
+		}
+	}
+	if err := w.Remove(path); err != nil {
+		return err
+	}
+	delete(m.added, path)
+	return nil
+}
+
+// Close closes all merged watchers and returns the first error.
+func (m *Merged) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	m.mu.Unlock()
+
+	var first error
+	for _, w := range m.children {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+// failingWatcher is a chanWatcher whose Close fails.
+type failingWatcher struct {
+	*chanWatcher
+	err error
+}
+
+func (w failingWatcher) Close() error {
+	w.chanWatcher.Close()
+	return w.err
+}
+
+func TestMerge(t *testing.T) {
+	before := runtime.NumGoroutine()
+	local, remote := &vfs.MemMapFs{}, &vfs.MemMapFs{}
+	local.MkdirAll("/home", 0755)
+	remote.MkdirAll("/mnt/nfs", 0755)
+	remote.MkdirAll("/home", 0755)
+	lw, rw := NewMemWatcher(local), NewMemWatcher(remote)
+	m := Merge(lw, rw)
+	if err := m.Route("/mnt", rw); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Route("/", newChanWatcher()); err == nil {
+		t.Error("Route to a watcher not merged succeeded")
+	}
+
+	// Without a route paths go to the first watcher.
+	if err := m.AddWithOps("/home", Create); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddWithOps("/mnt/nfs", Create); err != nil {
+		t.Fatal(err)
+	}
+	vfs.WriteFile(local, "/home/file", nil, 0644)
+	if got := receiveEvents(t, m, 1); got[0] != (Event{Name: "/home/file", Op: Create}) {
+		t.Errorf("Unexpected event: %v", got[0])
+	}
+	vfs.WriteFile(remote, "/mnt/nfs/file", nil, 0644)
+	if got := receiveEvents(t, m, 1); got[0] != (Event{Name: "/mnt/nfs/file", Op: Create}) {
+		t.Errorf("Unexpected event: %v", got[0])
+	}
+
+	// Remove goes where Add went, even against the routes.
+	if err := m.AddTo(rw, "/home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("/home"); err != nil {
+		t.Errorf("Remove(/home) failed: %v", err)
+	}
+	if err := m.Remove("/mnt/nfs"); err != nil {
+		t.Errorf("Remove(/mnt/nfs) failed: %v", err)
+	}
+	vfs.WriteFile(remote, "/mnt/nfs/other", nil, 0644)
+	expectNoEvent(t, m)
+
+	if err := m.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	for range m.EventChannel() {
+	}
+	if _, ok := <-m.ErrorChannel(); ok {
+		t.Error("errors channel not closed")
+	}
+	if err := m.Add("/home"); err == nil {
+		t.Error("Add after Close succeeded")
+	}
+	checkGoroutines(t, before)
+}
+
+func TestMergeErrors(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := newChanWatcher(), newChanWatcher()
+	closeErr := errors.New("close failed")
+	m := Merge(a, failingWatcher{b, closeErr}, failingWatcher{newChanWatcher(), errors.New("second")})
+
+	go func() { b.errors <- ErrEventOverflow }()
+	if err := <-m.ErrorChannel(); err != ErrEventOverflow {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := m.AddRecursive("/"); err == nil {
+		t.Error("AddRecursive succeeded without a RecursiveWatcher")
+	}
+
+	// An event nobody receives when the merged watcher is closed does not
+	// hold up its forwarding.
+	a.events <- Event{Name: "/pending"}
+	if err := m.Close(); err != closeErr {
+		t.Errorf("Close returned %v, want %v", err, closeErr)
+	}
+	checkGoroutines(t, before)
+}
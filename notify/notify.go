@@ -11,11 +11,30 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
+	"time"
 )
 
 type Event struct {
 	Name string
 	Op   Op
+
+	// OldName is the previous name of a renamed file when the watcher could
+	// pair both halves of the rename; Name is then the new name.
+	OldName string
+
+	// Time is when the watcher received the event. It has a monotonic clock
+	// reading, so durations between events are reliable.
+	Time time.Time
+	// IsDir reports whether the event is about a directory, as far as the
+	// watcher could tell without looking the path up again.
+	IsDir bool
+	// Root is the path given to Add (or AddRecursive, AddWithOps) of the
+	// watch reporting the event.
+	Root string
+	// Info describes the file when the watcher had it at hand; it is nil
+	// otherwise.
+	Info os.FileInfo
 }
 
 type Op int32
@@ -26,6 +45,18 @@ const (
 	Remove
 	Rename
 	Chmod
+
+	// The ops below are only reported when asked for with
+	// OpsWatcher.AddWithOps, and only the inotify backend produces them.
+
+	CloseWrite   // A file opened for writing was closed
+	CloseNoWrite // A file not opened for writing was closed
+	Open         // A file or directory was opened
+	Access       // A file was read
+
+	// Resync marks the end of the synthetic events a watcher sent after
+	// recovering from lost events. Its Name is empty.
+	Resync
 )
 
 func (op Op) String() string {
@@ -47,6 +78,21 @@ func (op Op) String() string {
 	if op&Chmod == Chmod {
 		buffer.WriteString("|CHMOD")
 	}
+	if op&CloseWrite == CloseWrite {
+		buffer.WriteString("|CLOSE_WRITE")
+	}
+	if op&CloseNoWrite == CloseNoWrite {
+		buffer.WriteString("|CLOSE_NOWRITE")
+	}
+	if op&Open == Open {
+		buffer.WriteString("|OPEN")
+	}
+	if op&Access == Access {
+		buffer.WriteString("|ACCESS")
+	}
+	if op&Resync == Resync {
+		buffer.WriteString("|RESYNC")
+	}
 	if buffer.Len() == 0 {
 		return ""
 	}
@@ -54,6 +100,9 @@ func (op Op) String() string {
 }
 
 func (e Event) String() string {
+	if e.OldName != "" {
+		return fmt.Sprintf("%q -> %q: %s", e.OldName, e.Name, e.Op.String())
+	}
 	return fmt.Sprintf("%q: %s", e.Name, e.Op.String())
 }
 
@@ -68,3 +117,43 @@ type Watcher interface {
 	EventChannel() <-chan Event
 	ErrorChannel() <-chan error
 }
+
+// RecursiveWatcher is an optional interface in notify. It is implemented by
+// watchers that can watch a whole directory tree. Watches are installed on
+// every directory below path, directories created or moved into the tree
+// later are watched as they appear, and Remove(path) drops the whole tree.
+type RecursiveWatcher interface {
+	Watcher
+	AddRecursive(path string) error
+}
+
+// OpsWatcher is an optional interface in notify. It is implemented by
+// watchers that can restrict a watch to the events of the given ops. The
+// watcher asks the kernel for as few events as it can and filters the rest.
+// Calling AddWithOps again for the same path adds to the ops watched.
+type OpsWatcher interface {
+	Watcher
+	AddWithOps(path string, ops Op) error
+}
+
+// Stats are counters of a watcher's event delivery.
+type Stats struct {
+	QueueDepth int    // Events waiting to be received
+	Dropped    uint64 // Events dropped because the queue was full
+	Overflows  uint64 // Kernel event queue overflows
+}
+
+// StatsWatcher is an optional interface in notify. It is implemented by
+// watchers that can report on their event delivery.
+type StatsWatcher interface {
+	Watcher
+	Stats() Stats
+}
+
+// DegradedWatcher is an optional interface in notify. It is implemented by
+// watchers that fall back to a less precise strategy, such as polling, for
+// paths they cannot watch natively. Degraded returns those paths, sorted.
+type DegradedWatcher interface {
+	Watcher
+	Degraded() []string
+}
@@ -0,0 +1,356 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+// Package notifytest provides a scripted notify.Watcher and helpers for
+// testing code that consumes watchers without touching the disk.
+package notifytest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+)
+
+var (
+	_ notify.RecursiveWatcher = (*FakeWatcher)(nil)
+	_ notify.OpsWatcher       = (*FakeWatcher)(nil)
+)
+
+// DefaultTimeout is how long the helpers wait for an event, an error or
+// the end of a watcher.
+const DefaultTimeout = 2 * time.Second
+
+// A Call is a call of a watch method of a FakeWatcher.
+type Call struct {
+	Method string // "Add", "AddRecursive", "AddWithOps" or "Remove"
+	Path   string
+	Ops    notify.Op // Ops of AddWithOps
+}
+
+func (c Call) String() string {
+	if c.Method == "AddWithOps" {
+		return fmt.Sprintf("%s(%q, %s)", c.Method, c.Path, c.Ops)
+	}
+	return fmt.Sprintf("%s(%q)", c.Method, c.Path)
+}
+
+// FakeWatcher is a Watcher whose events and errors are sent by the test.
+// Its channels are unbuffered, so a Send returns once the code under test
+// received the event. Sends and Close may race like they do with real
+// watchers: an event whose send is under way when Close is called is
+// dropped.
+type FakeWatcher struct {
+	mu       sync.Mutex
+	calls    []Call
+	watched  map[string]bool
+	fail     map[string]error // Errors to return from Add (key: path)
+	closeErr error
+	closed   bool
+
+	sendMu sync.RWMutex // Held for reading while sending
+	ended  bool         // The channels are closed
+	once   sync.Once
+	events chan notify.Event
+	errors chan error
+	done   chan struct{}
+}
+
+// NewFakeWatcher returns a watcher without watches.
+func NewFakeWatcher() *FakeWatcher {
+	return &FakeWatcher{
+		watched: make(map[string]bool),
+		fail:    make(map[string]error),
+		events:  make(chan notify.Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+}
+
+func (w *FakeWatcher) EventChannel() <-chan notify.Event {
+	return w.events
+}
+
+func (w *FakeWatcher) ErrorChannel() <-chan error {
+	return w.errors
+}
+
+func (w *FakeWatcher) Add(path string) error {
+	return w.add(Call{Method: "Add", Path: path})
+}
+
+func (w *FakeWatcher) AddRecursive(path string) error {
+	return w.add(Call{Method: "AddRecursive", Path: path})
+}
+
+func (w *FakeWatcher) AddWithOps(path string, ops notify.Op) error {
+	return w.add(Call{Method: "AddWithOps", Path: path, Ops: ops})
+}
+
+func (w *FakeWatcher) add(c Call) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = append(w.calls, c)
+	if w.closed {
+		return errors.New("notifytest: watcher closed")
+	}
+	if err := w.fail[filepath.Clean(c.Path)]; err != nil {
+		return err
+	}
+	w.watched[filepath.Clean(c.Path)] = true
+	return nil
+}
+
+// Remove stops watching path. Like real watchers it fails for paths not
+// watched.
+func (w *FakeWatcher) Remove(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = append(w.calls, Call{Method: "Remove", Path: path})
+	if !w.watched[filepath.Clean(path)] {
+		return fmt.Errorf("can't remove non-existent watch for: %s", path)
+	}
+	delete(w.watched, filepath.Clean(path))
+	return nil
+}
+
+// FailAdd makes adding path fail with err. A nil err lets it succeed again.
+func (w *FakeWatcher) FailAdd(path string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		delete(w.fail, filepath.Clean(path))
+	} else {
+		w.fail[filepath.Clean(path)] = err
+	}
+}
+
+// FailClose makes Close return err.
+func (w *FakeWatcher) FailClose(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeErr = err
+}
+
+// Calls returns the calls of the watch methods so far, in order.
+func (w *FakeWatcher) Calls() []Call {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Call(nil), w.calls...)
+}
+
+// Watched returns the paths watched, sorted.
+func (w *FakeWatcher) Watched() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var paths []string
+	for path := range w.watched {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Closed reports whether Close was called.
+func (w *FakeWatcher) Closed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+// Send sends the events in order and reports whether all of them were
+// received before the watcher was closed.
+func (w *FakeWatcher) Send(events ...notify.Event) bool {
+	for _, ev := range events {
+		if !w.send(func() bool {
+			select {
+			case w.events <- ev:
+				return true
+			case <-w.done:
+				return false
+			}
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// SendAsync sends the events in order from a new goroutine and returns a
+// channel receiving the number of events received once the sending is
+// over, which is when all were received or the watcher was closed.
+func (w *FakeWatcher) SendAsync(events ...notify.Event) <-chan int {
+	n := make(chan int, 1)
+	go func() {
+		sent := 0
+		for _, ev := range events {
+			if !w.Send(ev) {
+				break
+			}
+			sent++
+		}
+		n <- sent
+	}()
+	return n
+}
+
+// SendError sends err and reports whether it was received before the
+// watcher was closed.
+func (w *FakeWatcher) SendError(err error) bool {
+	return w.send(func() bool {
+		select {
+		case w.errors <- err:
+			return true
+		case <-w.done:
+			return false
+		}
+	})
+}
+
+// Overflow reports a kernel queue overflow the way the watchers in
+// notify/fsnotify do without rescanning: with notify.ErrEventOverflow.
+func (w *FakeWatcher) Overflow() bool {
+	return w.SendError(notify.ErrEventOverflow)
+}
+
+// send runs a send unless the channels are closed.
+func (w *FakeWatcher) send(fn func() bool) bool {
+	w.sendMu.RLock()
+	defer w.sendMu.RUnlock()
+	if w.ended {
+		return false
+	}
+	return fn()
+}
+
+// Close closes the watcher and its channels. Sends under way are dropped.
+func (w *FakeWatcher) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	err := w.closeErr
+	w.mu.Unlock()
+	w.end()
+	return err
+}
+
+// Terminate closes the channels without Close being called, like a watcher
+// whose backend failed.
+func (w *FakeWatcher) Terminate() {
+	w.end()
+}
+
+func (w *FakeWatcher) end() {
+	w.once.Do(func() {
+		close(w.done)
+		w.sendMu.Lock()
+		defer w.sendMu.Unlock()
+		w.ended = true
+		close(w.events)
+		close(w.errors)
+	})
+}
+
+// Equal reports whether two events have the same name, old name and ops.
+// The payload of the events is not compared.
+func Equal(a, b notify.Event) bool {
+	return a.Name == b.Name && a.OldName == b.OldName && a.Op == b.Op
+}
+
+// NextEvent returns the next event of w. It fails the test on an error of
+// w, if the events of w end or after DefaultTimeout.
+func NextEvent(t testing.TB, w notify.Watcher) notify.Event {
+	t.Helper()
+	select {
+	case ev, ok := <-w.EventChannel():
+		if !ok {
+			t.Fatal("Events channel closed")
+		}
+		return ev
+	case err := <-w.ErrorChannel():
+		t.Fatalf("Error from watcher: %v", err)
+	case <-time.After(DefaultTimeout):
+		t.Fatal("Took too long to wait for event")
+	}
+	return notify.Event{}
+}
+
+// ExpectEvents receives len(want) events from w and fails the test unless
+// they are Equal to want, in order.
+func ExpectEvents(t testing.TB, w notify.Watcher, want ...notify.Event) []notify.Event {
+	t.Helper()
+	got := make([]notify.Event, 0, len(want))
+	for range want {
+		got = append(got, NextEvent(t, w))
+	}
+	for i := range want {
+		if !Equal(got[i], want[i]) {
+			t.Errorf("Unexpected events: got %v, want %v", got, want)
+			break
+		}
+	}
+	return got
+}
+
+// ExpectNoEvent fails the test if w sends an event or an error within d.
+func ExpectNoEvent(t testing.TB, w notify.Watcher, d time.Duration) {
+	t.Helper()
+	select {
+	case ev, ok := <-w.EventChannel():
+		if ok {
+			t.Errorf("Unexpected event: %v", ev)
+		}
+	case err, ok := <-w.ErrorChannel():
+		if ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(d):
+	}
+}
+
+// ExpectError returns the next error of w. It fails the test if an event
+// comes first, if the errors of w end or after DefaultTimeout.
+func ExpectError(t testing.TB, w notify.Watcher) error {
+	t.Helper()
+	select {
+	case ev := <-w.EventChannel():
+		t.Fatalf("Unexpected event: %v", ev)
+	case err, ok := <-w.ErrorChannel():
+		if !ok {
+			t.Fatal("Errors channel closed")
+		}
+		return err
+	case <-time.After(DefaultTimeout):
+		t.Fatal("Took too long to wait for error")
+	}
+	return nil
+}
+
+// WaitClosed discards the events and errors of w until both of its
+// channels are closed, and fails the test after DefaultTimeout.
+func WaitClosed(t testing.TB, w notify.Watcher) {
+	t.Helper()
+	events, errs := w.EventChannel(), w.ErrorChannel()
+	timeout := time.After(DefaultTimeout)
+	for events != nil || errs != nil {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		case <-timeout:
+			t.Fatal("Watcher channels not closed")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notifytest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+)
+
+func TestFakeWatcherCalls(t *testing.T) {
+	w := NewFakeWatcher()
+	denied := errors.New("permission denied")
+	w.FailAdd("/secret", denied)
+
+	w.Add("/a")
+	w.AddRecursive("/b/")
+	w.AddWithOps("/c", notify.Create)
+	if err := w.Add("/secret"); err != denied {
+		t.Errorf("Add(/secret) returned %v, want %v", err, denied)
+	}
+	if err := w.Remove("/a"); err != nil {
+		t.Errorf("Remove(/a) failed: %v", err)
+	}
+	if err := w.Remove("/a"); err == nil {
+		t.Error("Remove of a path not watched succeeded")
+	}
+
+	want := []Call{
+		{Method: "Add", Path: "/a"},
+		{Method: "AddRecursive", Path: "/b/"},
+		{Method: "AddWithOps", Path: "/c", Ops: notify.Create},
+		{Method: "Add", Path: "/secret"},
+		{Method: "Remove", Path: "/a"},
+		{Method: "Remove", Path: "/a"},
+	}
+	if got := w.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls() = %v, want %v", got, want)
+	}
+	if got, want := w.Watched(), []string{"/b", "/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Watched() = %v, want %v", got, want)
+	}
+	if got := want[2].String(); got != `AddWithOps("/c", CREATE)` {
+		t.Errorf("Call.String() = %s", got)
+	}
+}
+
+func TestFakeWatcherEvents(t *testing.T) {
+	w := NewFakeWatcher()
+	sent := w.SendAsync(
+		notify.Event{Name: "/a", Op: notify.Create},
+		notify.Event{Name: "/b", OldName: "/a", Op: notify.Rename},
+	)
+	ExpectEvents(t, w,
+		notify.Event{Name: "/a", Op: notify.Create},
+		notify.Event{Name: "/b", OldName: "/a", Op: notify.Rename},
+	)
+	if n := <-sent; n != 2 {
+		t.Errorf("%d events sent, want 2", n)
+	}
+
+	go w.Overflow()
+	if err := ExpectError(t, w); err != notify.ErrEventOverflow {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	ExpectNoEvent(t, w, 10*time.Millisecond)
+
+	closeErr := errors.New("close failed")
+	w.FailClose(closeErr)
+	if err := w.Close(); err != closeErr {
+		t.Errorf("Close returned %v, want %v", err, closeErr)
+	}
+	WaitClosed(t, w)
+	if !w.Closed() {
+		t.Error("Closed() = false after Close")
+	}
+	if w.Send(notify.Event{Name: "/late"}) || w.SendError(closeErr) {
+		t.Error("Send succeeded after Close")
+	}
+}
+
+func TestFakeWatcherCloseRace(t *testing.T) {
+	// Nobody receives: the pending send is dropped by Close.
+	w := NewFakeWatcher()
+	sent := w.SendAsync(notify.Event{Name: "/a", Op: notify.Create})
+	w.Close()
+	if n := <-sent; n != 0 {
+		t.Errorf("%d events sent, want 0", n)
+	}
+
+	// A backend failing ends the consumer's loop without Close.
+	w = NewFakeWatcher()
+	done := make(chan error)
+	go func() {
+		done <- notify.Run(context.Background(), w, func(notify.Event) error { return nil }, nil)
+	}()
+	w.Send(notify.Event{Name: "/a", Op: notify.Create})
+	w.Terminate()
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if !w.Closed() {
+		t.Error("Run did not close the watcher")
+	}
+}
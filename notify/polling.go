@@ -0,0 +1,276 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+var _ RecursiveWatcher = (*PollingWatcher)(nil)
+
+// PollingOptions configures a PollingWatcher.
+type PollingOptions struct {
+	// Hash makes the watcher hash the content of regular files, so that a
+	// change keeping both size and modification time is reported too. It
+	// reads every watched file on every poll.
+	Hash bool
+	// Clock defaults to the system clock.
+	Clock Clock
+}
+
+// PollingWatcher watches the files of any vfs.Vfs by taking a snapshot of
+// the watched paths every interval and reporting the differences. Changes
+// made and undone between two polls are not seen.
+type PollingWatcher struct {
+	fs       vfs.Vfs
+	interval time.Duration
+	opts     PollingOptions
+
+	mu      sync.Mutex
+	watches map[string]*pollWatch // key: path
+	closed  bool
+
+	events chan Event
+	errors chan error
+	done   chan struct{}
+}
+
+type pollWatch struct {
+	recursive bool
+	files     Snapshot // including the watched path
+}
+
+// NewPollingWatcher returns a watcher polling fs every interval.
+func NewPollingWatcher(fs vfs.Vfs, interval time.Duration, opts PollingOptions) *PollingWatcher {
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	w := &PollingWatcher{
+		fs:       fs,
+		interval: interval,
+		opts:     opts,
+		watches:  make(map[string]*pollWatch),
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *PollingWatcher) EventChannel() <-chan Event {
+	return w.events
+}
+
+func (w *PollingWatcher) ErrorChannel() <-chan error {
+	return w.errors
+}
+
+// Close stops polling and closes the channels.
+func (w *PollingWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	return nil
+}
+
+// Add starts watching the named file or directory (non-recursively).
+func (w *PollingWatcher) Add(name string) error {
+	return w.add(name, false)
+}
+
+// AddRecursive starts watching the named directory and everything below it.
+func (w *PollingWatcher) AddRecursive(name string) error {
+	return w.add(name, true)
+}
+
+func (w *PollingWatcher) add(name string, recursive bool) error {
+	name = filepath.Clean(name)
+	files, err := w.scan(name, recursive)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("polling watcher already closed")
+	}
+	if pw, ok := w.watches[name]; ok && pw.recursive && !recursive {
+		return nil
+	}
+	w.watches[name] = &pollWatch{recursive: recursive, files: files}
+	return nil
+}
+
+// Remove stops watching the named file or directory.
+func (w *PollingWatcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[name]; !ok {
+		return fmt.Errorf("can't remove non-existent polling watch for: %s", name)
+	}
+	delete(w.watches, name)
+	return nil
+}
+
+func (w *PollingWatcher) run() {
+	defer close(w.errors)
+	defer close(w.events)
+
+	for {
+		timer := w.opts.Clock.NewTimer(w.interval)
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		if !w.poll() {
+			return
+		}
+	}
+}
+
+// poll compares every watch with a new snapshot. It returns false if the
+// watcher was closed while sending.
+func (w *PollingWatcher) poll() bool {
+	w.mu.Lock()
+	roots := make([]string, 0, len(w.watches))
+	for name := range w.watches {
+		roots = append(roots, name)
+	}
+	w.mu.Unlock()
+	sort.Strings(roots)
+
+	for _, root := range roots {
+		w.mu.Lock()
+		pw, ok := w.watches[root]
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		files, err := w.scan(root, pw.recursive)
+		if err != nil && !os.IsNotExist(err) {
+			if !w.send(nil, err) {
+				return false
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		if w.watches[root] != pw {
+			// Removed or replaced while scanning.
+			w.mu.Unlock()
+			continue
+		}
+		old := pw.files
+		if files == nil {
+			// Like a kernel watch, the watch goes away with its file.
+			delete(w.watches, root)
+		} else {
+			pw.files = files
+		}
+		w.mu.Unlock()
+
+		now := w.opts.Clock.Now()
+		for _, ev := range old.Diff(files) {
+			ev.Time, ev.Root = now, root
+			if !w.send(&ev, nil) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (w *PollingWatcher) send(ev *Event, err error) bool {
+	if ev != nil {
+		select {
+		case w.events <- *ev:
+		case <-w.done:
+			return false
+		}
+		return true
+	}
+	select {
+	case w.errors <- err:
+	case <-w.done:
+		return false
+	}
+	return true
+}
+
+// scan takes a snapshot of root, the entries of root if it is a directory,
+// and with recursive everything below it. It returns nil files if root does
+// not exist.
+func (w *PollingWatcher) scan(root string, recursive bool) (Snapshot, error) {
+	fi, err := w.fs.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	files := Snapshot{root: w.state(root, fi)}
+	if !fi.IsDir() {
+		return files, nil
+	}
+	if !recursive {
+		list, err := vfs.ReadDir(w.fs, root)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range list {
+			name := filepath.Join(root, fi.Name())
+			files[name] = w.state(name, fi)
+		}
+		return files, nil
+	}
+	err = vfs.Walk(w.fs, root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		files[path] = w.state(path, fi)
+		return nil
+	})
+	return files, err
+}
+
+func (w *PollingWatcher) state(name string, fi os.FileInfo) FileState {
+	s := StateOf(fi)
+	if w.opts.Hash && fi.Mode().IsRegular() {
+		s.Hash = w.hash(name)
+	}
+	return s
+}
+
+func (w *PollingWatcher) hash(name string) uint64 {
+	f, err := w.fs.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	h := fnv.New64a()
+	io.Copy(h, f)
+	return h.Sum64()
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+// pollOnce advances the clock by one interval and collects the events of
+// the poll that follows, without their payload. polls is the number of
+// polls done before.
+func pollOnce(t *testing.T, w *PollingWatcher, clock *fakeClock, polls int) []Event {
+	clock.waitTimers(t, polls+1)
+	clock.Advance(w.interval)
+	var events []Event
+	for {
+		select {
+		case ev := <-w.EventChannel():
+			events = append(events, stripPayload(ev))
+			continue
+		case err := <-w.ErrorChannel():
+			t.Fatalf("unexpected error: %v", err)
+		default:
+		}
+		// The next timer is created once the poll has sent all its events.
+		clock.mu.Lock()
+		done := clock.created > polls+1
+		clock.mu.Unlock()
+		if done {
+			return events
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPollingWatcher(t *testing.T) {
+	fs := vfs.NewMemMapFs()
+	fs.MkdirAll("/dir/sub", 0755)
+	vfs.WriteFile(fs, "/dir/a", []byte("a"), 0644)
+	vfs.WriteFile(fs, "/dir/d", []byte("d"), 0644)
+	vfs.WriteFile(fs, "/dir/sub/b", []byte("b"), 0644)
+
+	clock := newFakeClock()
+	w := NewPollingWatcher(fs, time.Second, PollingOptions{Clock: clock})
+	defer w.Close()
+	if err := w.Add("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	vfs.WriteFile(fs, "/dir/a", []byte("aa"), 0644)
+	vfs.WriteFile(fs, "/dir/c", []byte("c"), 0644)
+	fs.Chmod("/dir/d", 0600)
+	vfs.WriteFile(fs, "/dir/sub/b", []byte("bb"), 0644)
+	want := []Event{
+		{Name: "/dir/a", Op: Write},
+		{Name: "/dir/c", Op: Create},
+		{Name: "/dir/d", Op: Chmod},
+	}
+	if got := pollOnce(t, w, clock, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fs.Remove("/dir/a")
+	if got := pollOnce(t, w, clock, 1); !reflect.DeepEqual(got, []Event{{Name: "/dir/a", Op: Remove}}) {
+		t.Errorf("unexpected events %v", got)
+	}
+
+	if got := pollOnce(t, w, clock, 2); len(got) != 0 {
+		t.Errorf("unexpected events without changes: %v", got)
+	}
+
+	// The watch goes away with the watched directory.
+	fs.RemoveAll("/dir")
+	want = []Event{
+		{Name: "/dir/sub", Op: Remove},
+		{Name: "/dir/d", Op: Remove},
+		{Name: "/dir/c", Op: Remove},
+		{Name: "/dir", Op: Remove},
+	}
+	if got := pollOnce(t, w, clock, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := w.Remove("/dir"); err == nil {
+		t.Error("watch of removed directory still present")
+	}
+}
+
+func TestPollingWatcherRecursive(t *testing.T) {
+	fs := vfs.NewMemMapFs()
+	fs.MkdirAll("/dir/sub", 0755)
+
+	clock := newFakeClock()
+	w := NewPollingWatcher(fs, time.Second, PollingOptions{Clock: clock})
+	defer w.Close()
+	if err := w.AddRecursive("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.MkdirAll("/dir/sub/new", 0755)
+	vfs.WriteFile(fs, "/dir/sub/new/file", nil, 0644)
+	want := []Event{
+		{Name: "/dir/sub/new", Op: Create},
+		{Name: "/dir/sub/new/file", Op: Create},
+	}
+	if got := pollOnce(t, w, clock, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPollingWatcherHash(t *testing.T) {
+	fs := vfs.NewMemMapFs()
+	vfs.WriteFile(fs, "/file", []byte("one"), 0644)
+	fi, _ := fs.Stat("/file")
+	mtime := fi.ModTime()
+
+	for _, hash := range []bool{false, true} {
+		clock := newFakeClock()
+		w := NewPollingWatcher(fs, time.Second, PollingOptions{Clock: clock, Hash: hash})
+		if err := w.Add("/file"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Same size, same modification time.
+		vfs.WriteFile(fs, "/file", []byte("two"), 0644)
+		fs.Chtimes("/file", mtime, mtime)
+
+		got := pollOnce(t, w, clock, 0)
+		if hash && !reflect.DeepEqual(got, []Event{{Name: "/file", Op: Write}}) {
+			t.Errorf("hashing watcher: unexpected events %v", got)
+		}
+		if !hash && len(got) != 0 {
+			t.Errorf("stat watcher: unexpected events %v", got)
+		}
+		w.Close()
+		vfs.WriteFile(fs, "/file", []byte("one"), 0644)
+		fs.Chtimes("/file", mtime, mtime)
+	}
+}
+
+func TestPollingWatcherClose(t *testing.T) {
+	w := NewPollingWatcher(vfs.NewMemMapFs(), time.Second, PollingOptions{Clock: newFakeClock()})
+	w.Close()
+	if _, ok := <-w.EventChannel(); ok {
+		t.Error("events channel not closed")
+	}
+	if _, ok := <-w.ErrorChannel(); ok {
+		t.Error("errors channel not closed")
+	}
+	if err := w.Add("/"); err == nil {
+		t.Error("expected Add on a closed watcher to fail")
+	}
+}
+
+func TestPollingWatcherPayload(t *testing.T) {
+	fs := vfs.NewMemMapFs()
+	fs.MkdirAll("/dir", 0755)
+	clock := newFakeClock()
+	w := NewPollingWatcher(fs, time.Second, PollingOptions{Clock: clock})
+	defer w.Close()
+	if err := w.AddRecursive("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Mkdir("/dir/sub", 0755)
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Second)
+	ev := <-w.EventChannel()
+	if ev.Name != "/dir/sub" || !ev.IsDir || ev.Root != "/dir" || !ev.Time.Equal(clock.Now()) {
+		t.Errorf("unexpected payload %+v", ev)
+	}
+}
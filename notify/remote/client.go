@@ -0,0 +1,307 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+)
+
+var _ notify.RecursiveWatcher = (*Client)(nil)
+
+// DefaultRetryInterval is how long a Client waits before reconnecting when
+// ClientOptions.RetryInterval is not set.
+const DefaultRetryInterval = time.Second
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	// HTTPClient makes the requests. It defaults to a client without a
+	// timeout, dialing the socket for "unix:" addresses.
+	HTTPClient *http.Client
+	// RetryInterval is how long to wait before reconnecting after the feed
+	// failed.
+	RetryInterval time.Duration
+}
+
+// A Client is a Watcher receiving the events of a Server. Add and
+// AddRecursive select the events to receive rather than install watches;
+// the server decides what is watched. The client reconnects when the feed
+// fails, resuming after the last event received, and reports the failure
+// on the error channel.
+type Client struct {
+	url  string
+	hc   *http.Client
+	opts ClientOptions
+
+	mu     sync.Mutex
+	paths  map[string]bool // Selected paths (value: recursive)
+	seq    uint64          // Sequence number of the last message
+	synced bool            // seq was received from the server
+	cancel func()          // Ends the current request
+	closed bool
+
+	events chan notify.Event
+	errors chan error
+	update chan struct{} // The paths changed
+	done   chan struct{}
+}
+
+// NewClient returns a client for the server at addr, which is either a URL
+// or a Unix socket path prefixed with "unix:".
+func NewClient(addr string, opts ClientOptions) (*Client, error) {
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	u := addr
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		u = "http://unix/"
+		if opts.HTTPClient == nil {
+			opts.HTTPClient = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			}}
+		}
+	} else if _, err := url.Parse(addr); err != nil {
+		return nil, err
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{}
+	}
+	c := &Client{
+		url:    u,
+		hc:     opts.HTTPClient,
+		opts:   opts,
+		paths:  make(map[string]bool),
+		events: make(chan notify.Event),
+		errors: make(chan error),
+		update: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *Client) EventChannel() <-chan notify.Event {
+	return c.events
+}
+
+func (c *Client) ErrorChannel() <-chan error {
+	return c.errors
+}
+
+// Add selects the events for name and the entries directly in it.
+func (c *Client) Add(name string) error {
+	return c.add(name, false)
+}
+
+// AddRecursive selects the events for name and everything below it.
+func (c *Client) AddRecursive(name string) error {
+	return c.add(name, true)
+}
+
+func (c *Client) add(name string, recursive bool) error {
+	name = filepath.Clean(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if r, ok := c.paths[name]; ok && (r || !recursive) {
+		return nil
+	}
+	c.paths[name] = recursive
+	c.changed()
+	return nil
+}
+
+func (c *Client) Remove(name string) error {
+	name = filepath.Clean(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.paths[name]; !ok {
+		return fmt.Errorf("can't remove non-existent watch for: %s", name)
+	}
+	delete(c.paths, name)
+	c.changed()
+	return nil
+}
+
+// changed makes the client reconnect with the new paths. c.mu must be held.
+func (c *Client) changed() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	select {
+	case c.update <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return nil
+}
+
+func (c *Client) run() {
+	defer close(c.errors)
+	defer close(c.events)
+
+	for {
+		req, ctx, err := c.request()
+		if err != nil {
+			select {
+			case c.errors <- err:
+			case <-c.done:
+				return
+			}
+			select {
+			case <-time.After(c.opts.RetryInterval):
+			case <-c.update:
+			case <-c.done:
+				return
+			}
+			continue
+		}
+		if req == nil {
+			// Nothing selected: wait for Add.
+			select {
+			case <-c.update:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		err = c.receive(req)
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if ctx.Err() != nil {
+			// The paths changed.
+			continue
+		}
+		if err != nil {
+			select {
+			case c.errors <- err:
+			case <-c.done:
+				return
+			}
+		}
+		select {
+		case <-time.After(c.opts.RetryInterval):
+		case <-c.update:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// request returns the request for the feed of the selected paths, resuming
+// after the last message, or nil if no path is selected.
+func (c *Client) request() (*http.Request, context.Context, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.paths) == 0 || c.closed {
+		return nil, nil, nil
+	}
+	query := url.Values{}
+	for name, recursive := range c.paths {
+		if recursive {
+			query.Add("tree", name)
+		} else {
+			query.Add("path", name)
+		}
+	}
+	if c.synced {
+		query.Set("since", strconv.FormatUint(c.seq, 10))
+	}
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Accept", "application/x-ndjson")
+	c.cancel = cancel
+	// Drop a stale update: the request has the current paths.
+	select {
+	case <-c.update:
+	default:
+	}
+	return req.WithContext(ctx), ctx, nil
+}
+
+// receive reads the feed until it ends. The server ends it when it shuts
+// down or the client fell behind, which was reported already.
+func (c *Client) receive(req *http.Request) error {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notify server: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for first := true; scanner.Scan(); first = false {
+		var m message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return fmt.Errorf("notify server: invalid message: %v", err)
+		}
+		// The sequence number of the first message of a resumed feed is
+		// ahead of the events kept for it, unless the server restarted and
+		// counts from zero again.
+		c.mu.Lock()
+		switch {
+		case m.Op != 0, !c.synced:
+			c.seq, c.synced = m.Seq, true
+		case first && m.Seq < c.seq:
+			c.seq = 0
+		}
+		c.mu.Unlock()
+		switch {
+		case m.Error != "":
+			select {
+			case c.errors <- m.err():
+			case <-c.done:
+				return nil
+			}
+		case m.Op != 0:
+			select {
+			case c.events <- m.event():
+			case <-c.done:
+				return nil
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+// Package remote serves the events of a notify.Watcher over HTTP, so that
+// several programs share one set of watches, and provides a client that is
+// itself a notify.Watcher.
+//
+// A feed is requested with GET. The query selects the events:
+//
+//	path=P   events for P and the entries directly in it
+//	tree=P   events for P and everything below it
+//	match=G  events for paths matching the vfs.Match pattern G
+//	since=N  first the kept events after sequence number N
+//
+// Without path, tree or match every event is sent. The feed is sent as
+// Server-Sent Events if the request accepts text/event-stream or has
+// format=sse, and as newline-delimited JSON otherwise. Each message is a
+// JSON object; the first carries the current sequence number only, and
+// errors carry an error text instead of an event. For Server-Sent Events
+// the sequence number is the event id, so a reconnecting EventSource
+// resumes through Last-Event-ID.
+package remote
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+)
+
+// ErrClosed is returned when adding paths to a closed Client.
+var ErrClosed = errors.New("notify client closed")
+
+// errLost is the error text sent when events a subscriber should have
+// received are gone. The client reports it as notify.ErrEventOverflow.
+const errLost = "events lost"
+
+// message is what the feed sends for an event or an error.
+type message struct {
+	Seq     uint64    `json:"seq"`
+	Op      notify.Op `json:"op,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	OldName string    `json:"old_name,omitempty"`
+	Time    time.Time `json:"time"`
+	IsDir   bool      `json:"is_dir,omitempty"`
+	Root    string    `json:"root,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newMessage(seq uint64, ev notify.Event) message {
+	return message{
+		Seq:     seq,
+		Op:      ev.Op,
+		Name:    ev.Name,
+		OldName: ev.OldName,
+		Time:    ev.Time,
+		IsDir:   ev.IsDir,
+		Root:    ev.Root,
+	}
+}
+
+func (m message) event() notify.Event {
+	return notify.Event{
+		Name:    m.Name,
+		OldName: m.OldName,
+		Op:      m.Op,
+		Time:    m.Time,
+		IsDir:   m.IsDir,
+		Root:    m.Root,
+	}
+}
+
+func (m message) err() error {
+	if m.Error == errLost {
+		return notify.ErrEventOverflow
+	}
+	return errors.New(m.Error)
+}
+
+// Listen listens on addr, which is either a TCP address such as
+// "localhost:7070" or a Unix socket path prefixed with "unix:".
+func Listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,377 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package remote
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/notify"
+	"github.com/gottingen/felix/vfs"
+)
+
+// newTestServer serves the events of a MemWatcher watching / recursively.
+func newTestServer(t *testing.T, opts ServerOptions) (*vfs.MemMapFs, *Server, *httptest.Server) {
+	t.Helper()
+	fs := &vfs.MemMapFs{}
+	fs.MkdirAll("/a", 0755)
+	fs.MkdirAll("/b", 0755)
+	w := notify.NewMemWatcher(fs)
+	if err := w.AddRecursive("/"); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(w, opts)
+	return fs, srv, httptest.NewServer(srv)
+}
+
+// touch creates the file name, which gives a single Create event.
+func touch(fs *vfs.MemMapFs, name string) {
+	if f, err := fs.Create(name); err == nil {
+		f.Close()
+	}
+}
+
+// lines returns the lines of the response to a GET of url.
+func lines(t *testing.T, url string, header http.Header) (<-chan string, func()) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			ch <- scanner.Text()
+		}
+	}()
+	return ch, func() { resp.Body.Close() }
+}
+
+func nextLine(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case line := <-ch:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("Took too long to wait for a line")
+	}
+	return ""
+}
+
+func nextMessage(t *testing.T, ch <-chan string) message {
+	t.Helper()
+	var m message
+	if err := json.Unmarshal([]byte(nextLine(t, ch)), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestServerNDJSON(t *testing.T) {
+	fs, srv, ts := newTestServer(t, ServerOptions{})
+	defer ts.Close()
+	defer srv.Close()
+
+	ch, stop := lines(t, ts.URL+"?tree=/a&match=/b/*.go", nil)
+	defer stop()
+	if m := nextMessage(t, ch); m.Seq != 0 || m.Op != 0 {
+		t.Errorf("Unexpected first message: %+v", m)
+	}
+	touch(fs, "/b/skipped")
+	touch(fs, "/a/file")
+	touch(fs, "/b/main.go")
+
+	got := []message{nextMessage(t, ch), nextMessage(t, ch)}
+	if got[0].Name != "/a/file" || got[0].Op != notify.Create || got[0].Seq != 2 || got[0].Root != "/" {
+		t.Errorf("Unexpected message: %+v", got[0])
+	}
+	if got[1].Name != "/b/main.go" || got[1].Seq != 3 {
+		t.Errorf("Unexpected message: %+v", got[1])
+	}
+}
+
+func TestServerSSEResume(t *testing.T) {
+	fs, srv, ts := newTestServer(t, ServerOptions{History: 2})
+	defer ts.Close()
+	defer srv.Close()
+
+	// A subscriber that saw the events up to the first.
+	first, stop := lines(t, ts.URL, nil)
+	nextMessage(t, first)
+	for _, name := range []string{"/a/1", "/a/2", "/a/3"} {
+		touch(fs, name)
+		if m := nextMessage(t, first); m.Name != name {
+			t.Fatalf("Unexpected message: %+v", m)
+		}
+	}
+	stop()
+
+	ch, stop := lines(t, ts.URL, http.Header{"Accept": {"text/event-stream"}, "Last-Event-ID": {"1"}})
+	defer stop()
+	var got []string
+	for i := 0; i < 4+3+3; i++ {
+		got = append(got, nextLine(t, ch))
+	}
+	want := []string{
+		"event: sync", "id: 3", `data: {"seq":3,"time":"0001-01-01T00:00:00Z"}`, "",
+		"id: 2", "", "",
+		"id: 3", "", "",
+	}
+	for i := range want {
+		if want[i] != "" && got[i] != want[i] {
+			t.Errorf("Line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	if !strings.HasPrefix(got[5], "data: {") || !strings.Contains(got[5], `"name":"/a/2"`) {
+		t.Errorf("Unexpected data line: %q", got[5])
+	}
+
+	// Resuming from before the kept events tells the subscriber.
+	ch, stop = lines(t, ts.URL+"?since=0", nil)
+	defer stop()
+	nextMessage(t, ch)
+	if m := nextMessage(t, ch); m.Error != errLost || m.err() != notify.ErrEventOverflow {
+		t.Errorf("Expected lost events, got %+v", m)
+	}
+	if m := nextMessage(t, ch); m.Seq != 2 {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+}
+
+func TestServerBadRequest(t *testing.T) {
+	_, srv, ts := newTestServer(t, ServerOptions{})
+	defer ts.Close()
+	defer srv.Close()
+
+	for _, query := range []string{"?since=x", "?match=[", ""} {
+		method := http.MethodGet
+		if query == "" {
+			method = http.MethodPost
+		}
+		req, _ := http.NewRequest(method, ts.URL+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("%s %q succeeded", method, query)
+		}
+	}
+}
+
+func receiveEvent(t *testing.T, w notify.Watcher) notify.Event {
+	t.Helper()
+	select {
+	case ev := <-w.EventChannel():
+		return ev
+	case err := <-w.ErrorChannel():
+		t.Fatalf("Error from client: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Took too long to wait for event")
+	}
+	return notify.Event{}
+}
+
+func TestClient(t *testing.T) {
+	before := runtime.NumGoroutine()
+	fs, srv, ts := newTestServer(t, ServerOptions{})
+
+	c, err := NewClient(ts.URL, ClientOptions{RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("/a"); err != nil {
+		t.Fatal(err)
+	}
+	// The client connects in the background; retry until the first event
+	// is seen.
+	var ev notify.Event
+	for i := 0; ev.Name == ""; i++ {
+		touch(fs, "/b/ignored")
+		touch(fs, "/a/first")
+		select {
+		case ev = <-c.EventChannel():
+		case <-time.After(20 * time.Millisecond):
+			if i == 100 {
+				t.Fatal("No event received")
+			}
+		}
+	}
+	if ev.Name != "/a/first" || ev.Root != "/" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+
+	// Changing the paths reconnects without losing events.
+	if err := c.AddRecursive("/b"); err != nil {
+		t.Fatal(err)
+	}
+	fs.MkdirAll("/b/c", 0755)
+	touch(fs, "/b/c/deep")
+	var names []string
+	for len(names) < 2 {
+		ev := receiveEvent(t, c)
+		if ev.Name != "/a/first" && ev.Name != "/b/ignored" {
+			names = append(names, ev.Name)
+		}
+	}
+	if want := []string{"/b/c", "/b/c/deep"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	if err := c.Remove("/x"); err == nil {
+		t.Error("Remove of a path not added succeeded")
+	}
+
+	c.Close()
+	for range c.EventChannel() {
+	}
+	if err := c.Add("/a"); err != ErrClosed {
+		t.Errorf("Add after Close returned %v", err)
+	}
+	srv.Close()
+	ts.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines leaked", n-before)
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "notify.sock")
+
+	fs, srv, ts := newTestServer(t, ServerOptions{})
+	ts.Close()
+	defer srv.Close()
+	l, err := Listen("unix:" + sock)
+	if err != nil {
+		t.Skipf("Unix sockets not available: %v", err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	c, err := NewClient("unix:"+sock, ClientOptions{RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.AddRecursive("/")
+	for i := 0; ; i++ {
+		touch(fs, "/a/file")
+		select {
+		case ev := <-c.EventChannel():
+			if ev.Name != "/a/file" {
+				t.Errorf("Unexpected event: %v", ev)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+			if i == 100 {
+				t.Fatal("No event received")
+			}
+		}
+	}
+}
+
+func TestClientServerRestart(t *testing.T) {
+	fs, srv, ts := newTestServer(t, ServerOptions{})
+	ts.Close()
+	var (
+		mu      sync.Mutex
+		current = srv
+	)
+	ts = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		s := current
+		mu.Unlock()
+		s.ServeHTTP(rw, r)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL, ClientOptions{RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.AddRecursive("/a")
+	for i := 0; ; i++ {
+		touch(fs, "/a/before")
+		select {
+		case <-c.EventChannel():
+		case <-time.After(20 * time.Millisecond):
+			if i == 100 {
+				t.Fatal("No event received")
+			}
+			continue
+		}
+		break
+	}
+	for _, name := range []string{"/a/1", "/a/2"} {
+		touch(fs, name)
+		for receiveEvent(t, c).Name != name {
+		}
+	}
+
+	// The new server counts from zero: the client hears of the events it
+	// missed and gets those the new server kept.
+	fs2, srv2, ts2 := newTestServer(t, ServerOptions{})
+	ts2.Close()
+	defer srv2.Close()
+	touch(fs2, "/a/after")
+	mu.Lock()
+	current = srv2
+	mu.Unlock()
+	srv.Close()
+
+	select {
+	case err := <-c.ErrorChannel():
+		if err != notify.ErrEventOverflow {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case ev := <-c.EventChannel():
+		t.Fatalf("Unexpected event before the lost events: %v", ev)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Restart not reported")
+	}
+	if ev := receiveEvent(t, c); ev.Name != "/a/after" {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+
+	// Later events follow without the loss being reported again.
+	touch(fs2, "/a/later")
+	if ev := receiveEvent(t, c); ev.Name != "/a/later" {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gottingen/felix/notify"
+	"github.com/gottingen/felix/vfs"
+)
+
+const (
+	defaultHistory = 1024
+	defaultBuffer  = 256
+)
+
+// ServerOptions configures a Server.
+type ServerOptions struct {
+	// History is the number of events kept for subscribers resuming with
+	// since. It defaults to 1024.
+	History int
+	// Buffer is the number of events a subscriber may fall behind. A
+	// subscriber further behind is sent an error and disconnected, and can
+	// resume from its last event. It defaults to 256.
+	Buffer int
+}
+
+// A Server is an http.Handler serving the events of a Watcher to any
+// number of subscribers, at whatever path it is mounted on.
+type Server struct {
+	w    notify.Watcher
+	opts ServerOptions
+
+	mu      sync.Mutex
+	seq     uint64    // Sequence number of the last event
+	history []message // Last events, oldest first
+	subs    map[*subscriber]struct{}
+	closed  bool // The channels of w are closed
+}
+
+type subscriber struct {
+	filter filter
+	ch     chan message
+	lost   bool // ch was closed because the subscriber fell behind
+}
+
+// NewServer starts serving the events of w. The Server owns the channels
+// of w; closing it closes w and ends the feeds.
+func NewServer(w notify.Watcher, opts ServerOptions) *Server {
+	if opts.History <= 0 {
+		opts.History = defaultHistory
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultBuffer
+	}
+	s := &Server{w: w, opts: opts, subs: make(map[*subscriber]struct{})}
+	go s.run()
+	return s
+}
+
+// Add, Remove and Close act on the watcher.
+func (s *Server) Add(path string) error {
+	return s.w.Add(path)
+}
+
+func (s *Server) Remove(path string) error {
+	return s.w.Remove(path)
+}
+
+func (s *Server) Close() error {
+	return s.w.Close()
+}
+
+// Serve accepts connections on l and serves the feed on them until l is
+// closed.
+func (s *Server) Serve(l net.Listener) error {
+	return http.Serve(l, s)
+}
+
+func (s *Server) run() {
+	notify.Run(context.Background(), s.w, func(ev notify.Event) error {
+		s.broadcast(ev)
+		return nil
+	}, func(err error) error {
+		s.broadcastError(err)
+		return nil
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for sub := range s.subs {
+		close(sub.ch)
+		delete(s.subs, sub)
+	}
+}
+
+func (s *Server) broadcast(ev notify.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	m := newMessage(s.seq, ev)
+	if len(s.history) == s.opts.History {
+		copy(s.history, s.history[1:])
+		s.history = s.history[:len(s.history)-1]
+	}
+	s.history = append(s.history, m)
+	for sub := range s.subs {
+		if sub.filter.match(ev) {
+			s.send(sub, m)
+		}
+	}
+}
+
+func (s *Server) broadcastError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		s.send(sub, message{Seq: s.seq, Error: err.Error()})
+	}
+}
+
+// send sends m to sub, or disconnects sub if it fell too far behind. s.mu
+// must be held.
+func (s *Server) send(sub *subscriber, m message) {
+	select {
+	case sub.ch <- m:
+	default:
+		sub.lost = true
+		close(sub.ch)
+		delete(s.subs, sub)
+	}
+}
+
+// subscribe registers a subscriber and returns the messages to send it
+// first: the current sequence number, and with since the kept events after
+// since, preceded by an error if some of them are gone. A since ahead of
+// the current sequence number was given by an earlier server: all kept
+// events are sent, as the events in between are lost.
+func (s *Server) subscribe(f filter, since uint64, resume bool) (*subscriber, []message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backlog := []message{{Seq: s.seq}}
+	if resume && since > s.seq {
+		backlog = append(backlog, message{Seq: s.seq, Error: errLost})
+		for _, m := range s.history {
+			if f.match(m.event()) {
+				backlog = append(backlog, m)
+			}
+		}
+	} else if resume && since < s.seq {
+		if len(s.history) == 0 || s.history[0].Seq > since+1 {
+			backlog = append(backlog, message{Seq: since, Error: errLost})
+		}
+		for _, m := range s.history {
+			if m.Seq > since && f.match(m.event()) {
+				backlog = append(backlog, m)
+			}
+		}
+	}
+	sub := &subscriber{filter: f, ch: make(chan message, s.opts.Buffer)}
+	if s.closed {
+		close(sub.ch)
+	} else {
+		s.subs[sub] = struct{}{}
+	}
+	return sub, backlog
+}
+
+func (s *Server) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[sub]; ok {
+		close(sub.ch)
+		delete(s.subs, sub)
+	}
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	f, err := parseFilter(query)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since, resume := query.Get("since"), false
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	var seq uint64
+	if since != "" {
+		if seq, err = strconv.ParseUint(since, 10, 64); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid sequence number %q", since), http.StatusBadRequest)
+			return
+		}
+		resume = true
+	}
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	sub, backlog := s.subscribe(f, seq, resume)
+	defer s.unsubscribe(sub)
+
+	if sse {
+		rw.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	rw.Header().Set("Cache-Control", "no-cache")
+	enc := &encoder{w: rw, sse: sse}
+	var last uint64 // Sequence number of the last message written
+	for _, m := range backlog {
+		if enc.write(m) != nil {
+			return
+		}
+		last = m.Seq
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case m, ok := <-sub.ch:
+			if !ok {
+				if sub.lost {
+					enc.write(message{Seq: last, Error: errLost})
+					flusher.Flush()
+				}
+				return
+			}
+			if enc.write(m) != nil {
+				return
+			}
+			last = m.Seq
+			flusher.Flush()
+		}
+	}
+}
+
+// encoder writes messages as newline-delimited JSON or as Server-Sent
+// Events.
+type encoder struct {
+	w   http.ResponseWriter
+	sse bool
+}
+
+func (e *encoder) write(m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !e.sse:
+		_, err = fmt.Fprintf(e.w, "%s\n", data)
+	case m.Error != "":
+		_, err = fmt.Fprintf(e.w, "event: error\ndata: %s\n\n", data)
+	case m.Op == 0:
+		_, err = fmt.Fprintf(e.w, "event: sync\nid: %d\ndata: %s\n\n", m.Seq, data)
+	default:
+		_, err = fmt.Fprintf(e.w, "id: %d\ndata: %s\n\n", m.Seq, data)
+	}
+	return err
+}
+
+// filter selects the events of a subscriber. The zero filter selects every
+// event.
+type filter struct {
+	paths, trees, patterns []string
+}
+
+func parseFilter(query map[string][]string) (filter, error) {
+	f := filter{patterns: query["match"]}
+	for _, p := range query["path"] {
+		f.paths = append(f.paths, filepath.Clean(p))
+	}
+	for _, p := range query["tree"] {
+		f.trees = append(f.trees, filepath.Clean(p))
+	}
+	for _, pattern := range f.patterns {
+		if _, err := vfs.Match(pattern, ""); err != nil {
+			return f, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return f, nil
+}
+
+// match reports whether f selects ev. Events without a name, such as a
+// Resync, concern every subscriber.
+func (f filter) match(ev notify.Event) bool {
+	if len(f.paths) == 0 && len(f.trees) == 0 && len(f.patterns) == 0 || ev.Name == "" && ev.OldName == "" {
+		return true
+	}
+	return ev.Name != "" && f.matchName(ev.Name) || ev.OldName != "" && f.matchName(ev.OldName)
+}
+
+func (f filter) matchName(name string) bool {
+	name = filepath.Clean(name)
+	for _, p := range f.paths {
+		if name == p || filepath.Dir(name) == p {
+			return true
+		}
+	}
+	for _, p := range f.trees {
+		if name == p || strings.HasPrefix(name, p+string(filepath.Separator)) || p == string(filepath.Separator) {
+			return true
+		}
+	}
+	for _, pattern := range f.patterns {
+		if ok, _ := vfs.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import "context"
+
+// Run calls handler for each event of w and errHandler for each of its
+// errors until ctx is done, a handler returns an error or the channels of w
+// are closed. It then closes w, waits for its channels to be closed and
+// returns ctx.Err(), the error of the handler, or nil. A nil errHandler
+// makes the first error of w stop Run.
+//
+// Run owns the channels of w. The handlers are called from the goroutine
+// calling Run, one at a time.
+func Run(ctx context.Context, w Watcher, handler func(Event) error, errHandler func(error) error) error {
+	if errHandler == nil {
+		errHandler = func(err error) error { return err }
+	}
+	err := run(ctx, w, handler, errHandler)
+	w.Close()
+	drain(w)
+	return err
+}
+
+func run(ctx context.Context, w Watcher, handler func(Event) error, errHandler func(error) error) error {
+	events, errs := w.EventChannel(), w.ErrorChannel()
+	for events != nil || errs != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if err := handler(ev); err != nil {
+				return err
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if err := errHandler(err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// drain discards the events and errors of a closed watcher until both of
+// its channels are closed, so that no goroutine of the watcher is left
+// blocked on a send.
+func drain(w Watcher) {
+	events, errs := w.EventChannel(), w.ErrorChannel()
+	for events != nil || errs != nil {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+}
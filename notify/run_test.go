@@ -0,0 +1,156 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+// checkGoroutines fails the test if more than the given number of
+// goroutines are still running once the ones winding down had time to.
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// runAsync starts Run and returns the channel its result is sent on.
+func runAsync(ctx context.Context, w Watcher, handler func(Event) error, errHandler func(error) error) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, w, handler, errHandler) }()
+	return done
+}
+
+func waitRun(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	return nil
+}
+
+func TestRunHandlers(t *testing.T) {
+	w := newChanWatcher()
+	var (
+		got  []Event
+		errs []error
+	)
+	done := runAsync(context.Background(), w, func(ev Event) error {
+		got = append(got, ev)
+		return nil
+	}, func(err error) error {
+		errs = append(errs, err)
+		return nil
+	})
+	w.events <- Event{Name: "a", Op: Create}
+	w.errors <- ErrEventOverflow
+	w.events <- Event{Name: "a", Op: Write}
+	w.Close()
+
+	if err := waitRun(t, done); err != nil {
+		t.Errorf("Run returned %v after the watcher was closed", err)
+	}
+	if len(got) != 2 || got[0].Op != Create || got[1].Op != Write {
+		t.Errorf("Unexpected events: %v", got)
+	}
+	if len(errs) != 1 || errs[0] != ErrEventOverflow {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	stop := errors.New("stop")
+	for _, tc := range []struct {
+		name       string
+		send       func(w *chanWatcher)
+		handler    func(Event) error
+		errHandler func(error) error
+		want       error
+	}{
+		{
+			name:    "handler",
+			send:    func(w *chanWatcher) { w.events <- Event{Name: "a"} },
+			handler: func(Event) error { return stop },
+			want:    stop,
+		},
+		{
+			name:       "errHandler",
+			send:       func(w *chanWatcher) { w.errors <- ErrEventOverflow },
+			handler:    func(Event) error { return nil },
+			errHandler: func(error) error { return stop },
+			want:       stop,
+		},
+		{
+			name:    "nil errHandler",
+			send:    func(w *chanWatcher) { w.errors <- ErrEventOverflow },
+			handler: func(Event) error { return nil },
+			want:    ErrEventOverflow,
+		},
+	} {
+		before := runtime.NumGoroutine()
+		w := newChanWatcher()
+		done := runAsync(context.Background(), w, tc.handler, tc.errHandler)
+		tc.send(w)
+		if err := waitRun(t, done); err != tc.want {
+			t.Errorf("%s: Run returned %v, want %v", tc.name, err, tc.want)
+		}
+		// Run closed the watcher.
+		if _, ok := <-w.events; ok {
+			t.Errorf("%s: watcher not closed", tc.name)
+		}
+		checkGoroutines(t, before)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	before := runtime.NumGoroutine()
+	fs := &vfs.MemMapFs{}
+	w := NewMemWatcher(fs)
+	if err := w.Add("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan Event)
+	done := runAsync(ctx, w, func(ev Event) error {
+		received <- ev
+		return nil
+	}, nil)
+	vfs.WriteFile(fs, "/file", nil, 0644)
+	if ev := <-received; ev.Name != "/file" {
+		t.Errorf("Unexpected event: %v", ev)
+	}
+
+	// Events queued when the context is cancelled are dropped, and the
+	// goroutine of the watcher ends with Run.
+	vfs.WriteFile(fs, "/other", nil, 0644)
+	cancel()
+	go func() {
+		for range received {
+		}
+	}()
+	if err := waitRun(t, done); err != context.Canceled {
+		t.Errorf("Run returned %v, want %v", err, context.Canceled)
+	}
+	close(received)
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// FileState is what a Snapshot records of a file.
+type FileState struct {
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	Hash    uint64 // Content hash, if the snapshot was taken with one
+}
+
+// StateOf returns the state of the file described by fi, without a hash.
+func StateOf(fi os.FileInfo) FileState {
+	return FileState{Size: fi.Size(), ModTime: fi.ModTime(), Mode: fi.Mode()}
+}
+
+// Snapshot is the state of a set of files, keyed by path. Watchers take
+// snapshots to find changes they could not see as events.
+type Snapshot map[string]FileState
+
+// Diff returns the events turning s into cur. Removals come first, deepest
+// path first, then creations and changes in path order. Changes in the
+// size and modification time of directories are not reported, as they
+// follow from changes of their entries.
+func (s Snapshot) Diff(cur Snapshot) []Event {
+	var removed, changed []string
+	for name := range s {
+		if _, ok := cur[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for name := range cur {
+		changed = append(changed, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	sort.Strings(changed)
+
+	var events []Event
+	for _, name := range removed {
+		events = append(events, Event{Name: name, Op: Remove, IsDir: s[name].Mode.IsDir()})
+	}
+	for _, name := range changed {
+		n := cur[name]
+		o, ok := s[name]
+		isDir := n.Mode.IsDir()
+		switch {
+		case !ok:
+			events = append(events, Event{Name: name, Op: Create, IsDir: isDir})
+		case o.Mode.IsDir() != isDir:
+			events = append(events, Event{Name: name, Op: Remove, IsDir: !isDir}, Event{Name: name, Op: Create, IsDir: isDir})
+		default:
+			var op Op
+			if !n.Mode.IsDir() && (o.Size != n.Size || !o.ModTime.Equal(n.ModTime) || o.Hash != n.Hash) {
+				op |= Write
+			}
+			if o.Mode != n.Mode {
+				op |= Chmod
+			}
+			if op != 0 {
+				events = append(events, Event{Name: name, Op: op, IsDir: isDir})
+			}
+		}
+	}
+	return events
+}
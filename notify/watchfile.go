@@ -0,0 +1,203 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+// DefaultSettle is how long a FileWatcher waits for the events of a change
+// to stop when FileWatchOptions.Settle is not set.
+const DefaultSettle = 50 * time.Millisecond
+
+// FileWatchOptions configures a FileWatcher.
+type FileWatchOptions struct {
+	// Fs is used to look the file up once its events settled. It defaults
+	// to the operating system's file system.
+	Fs vfs.Vfs
+	// Settle is how long the events of one change are collected. It must
+	// cover the gap between moving the old file away and the new one in.
+	Settle time.Duration
+	// Clock defaults to the system clock.
+	Clock Clock
+}
+
+// A FileWatcher watches a single file through the watch of its directory,
+// so that it keeps watching when the file is replaced: a watch on the file
+// itself goes away with the replaced file.
+//
+// The events for the file are collected until none arrived for the settle
+// time, and the file is then looked up again to send one event:
+//
+//	Create  the file did not exist and does now
+//	Remove  the file existed and does not any more
+//	Write   the file was written or replaced
+//	Chmod   only the attributes of the file changed
+//
+// An editor saving through a temporary file or a backup, and atomic writers
+// renaming a new file over the old one, give a single Write.
+type FileWatcher struct {
+	w      Watcher
+	path   string
+	opts   FileWatchOptions
+	exists bool // Whether the file existed when last looked up
+	events chan Event
+	errors chan error
+	done   chan struct{} // Closed by Close
+	once   sync.Once
+}
+
+// WatchFile starts watching the file at path with w, which must not be used
+// otherwise: the FileWatcher owns its channels, and closing it closes w.
+// The directory of path must exist; the file need not.
+func WatchFile(w Watcher, path string, opts FileWatchOptions) (*FileWatcher, error) {
+	if opts.Fs == nil {
+		opts.Fs = vfs.NewOsFs()
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = DefaultSettle
+	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	path = filepath.Clean(path)
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	fw := &FileWatcher{
+		w:      w,
+		path:   path,
+		opts:   opts,
+		events: make(chan Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+	_, err := opts.Fs.Stat(path)
+	fw.exists = err == nil
+	go fw.run()
+	return fw, nil
+}
+
+// Events returns the channel the events of the file are sent on. It is
+// closed once the channels of the watcher are.
+func (fw *FileWatcher) Events() <-chan Event {
+	return fw.events
+}
+
+// Errors returns the errors of the watcher.
+func (fw *FileWatcher) Errors() <-chan error {
+	return fw.errors
+}
+
+// Close closes the watcher. Events and errors not received yet are
+// dropped.
+func (fw *FileWatcher) Close() error {
+	fw.once.Do(func() { close(fw.done) })
+	return fw.w.Close()
+}
+
+func (fw *FileWatcher) run() {
+	defer close(fw.errors)
+	defer close(fw.events)
+
+	var (
+		events = fw.w.EventChannel()
+		errs   = fw.w.ErrorChannel()
+		settle Timer
+		seen   Op
+	)
+	// flush returns false if the FileWatcher was closed while sending.
+	flush := func() bool {
+		if settle != nil {
+			settle.Stop()
+			settle = nil
+		}
+		ev, ok := fw.resolve(seen)
+		seen = 0
+		if !ok {
+			return true
+		}
+		select {
+		case fw.events <- ev:
+			return true
+		case <-fw.done:
+			return false
+		}
+	}
+
+	for events != nil || errs != nil {
+		var fire <-chan time.Time
+		if settle != nil {
+			fire = settle.C()
+		}
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(ev.Name) != fw.path && (ev.OldName == "" || filepath.Clean(ev.OldName) != fw.path) {
+				continue
+			}
+			seen |= ev.Op
+			if settle != nil {
+				settle.Stop()
+			}
+			settle = fw.opts.Clock.NewTimer(fw.opts.Settle)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case fw.errors <- err:
+			case <-fw.done:
+				drain(fw.w)
+				return
+			}
+		case <-fire:
+			if !flush() {
+				drain(fw.w)
+				return
+			}
+		}
+	}
+	if seen != 0 {
+		flush()
+	}
+}
+
+// resolve looks the file up after events with the ops seen and returns the
+// event to send, if any.
+func (fw *FileWatcher) resolve(seen Op) (Event, bool) {
+	fi, err := fw.opts.Fs.Stat(fw.path)
+	exists := err == nil
+	existed := fw.exists
+	fw.exists = exists
+
+	ev := Event{Name: fw.path, Time: fw.opts.Clock.Now(), Root: fw.path}
+	if exists {
+		ev.IsDir, ev.Info = fi.IsDir(), fi
+	}
+	switch {
+	case exists && !existed:
+		ev.Op = Create
+	case !exists && existed:
+		ev.Op = Remove
+	case !exists:
+		return ev, false
+	case seen&^Chmod != 0:
+		ev.Op = Write
+	default:
+		ev.Op = Chmod
+	}
+	return ev, true
+}
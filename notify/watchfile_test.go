@@ -0,0 +1,94 @@
+// Copyright 2019 lijippy@163.com
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package notify
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gottingen/felix/vfs"
+)
+
+func TestWatchFile(t *testing.T) {
+	fs := vfs.NewMemMapFs().(*vfs.MemMapFs)
+	fs.MkdirAll("/etc", 0755)
+	vfs.WriteFile(fs, "/etc/app.conf", []byte("v1"), 0644)
+	clock := newFakeClock()
+	fw, err := WatchFile(NewMemWatcher(fs), "/etc/app.conf", FileWatchOptions{Fs: fs, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	timers := 0
+	expect := func(n int, want Op) {
+		t.Helper()
+		timers += n
+		clock.waitTimers(t, timers)
+		clock.Advance(DefaultSettle)
+		select {
+		case ev := <-fw.Events():
+			if ev.Name != "/etc/app.conf" || ev.Op != want {
+				t.Errorf("got %v, want %v", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	// An atomic writer renames a new file over the old one.
+	vfs.WriteFile(fs, "/etc/app.conf.tmp", []byte("v2"), 0644)
+	fs.Rename("/etc/app.conf.tmp", "/etc/app.conf")
+	expect(1, Write)
+
+	// An editor moves the old file to a backup and writes a new one.
+	fs.Rename("/etc/app.conf", "/etc/app.conf~")
+	vfs.WriteFile(fs, "/etc/app.conf", []byte("v3"), 0644)
+	expect(4, Write) // Rename, Create, Write for the truncation and the data
+
+	// Files next to it are not reported.
+	vfs.WriteFile(fs, "/etc/other.conf", []byte("x"), 0644)
+
+	fs.Chmod("/etc/app.conf", 0600)
+	expect(1, Chmod)
+
+	fs.Remove("/etc/app.conf")
+	expect(1, Remove)
+
+	vfs.WriteFile(fs, "/etc/app.conf", []byte("v4"), 0644)
+	expect(3, Create)
+}
+
+func TestWatchFileCloseUnread(t *testing.T) {
+	before := runtime.NumGoroutine()
+	fs := vfs.NewMemMapFs().(*vfs.MemMapFs)
+	fs.MkdirAll("/etc", 0755)
+	clock := newFakeClock()
+
+	// Neither an event nor an error nobody receives keeps Close from
+	// ending the FileWatcher.
+	w := newChanWatcher()
+	fw, err := WatchFile(w, "/etc/app.conf", FileWatchOptions{Fs: fs, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs.WriteFile(fs, "/etc/app.conf", nil, 0644)
+	w.events <- Event{Name: "/etc/app.conf", Op: Create}
+	clock.waitTimers(t, 1)
+	clock.Advance(DefaultSettle)
+	fw.Close()
+	checkGoroutines(t, before)
+
+	w = newChanWatcher()
+	if fw, err = WatchFile(w, "/etc/app.conf", FileWatchOptions{Fs: fs, Clock: clock}); err != nil {
+		t.Fatal(err)
+	}
+	w.errors <- ErrEventOverflow
+	fw.Close()
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,452 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiffOpKind identifies the filesystem call a DiffOp performs.
+type DiffOpKind int
+
+const (
+	DiffCreate DiffOpKind = iota
+	DiffMkdir
+	DiffMkdirAll
+	DiffOpenFile
+	DiffReadFile
+	DiffRemove
+	DiffRemoveAll
+	DiffRename
+	DiffStat
+	DiffChmod
+	DiffReadDir
+	diffOpKinds
+)
+
+var diffOpNames = [...]string{
+	DiffCreate:    "Create",
+	DiffMkdir:     "Mkdir",
+	DiffMkdirAll:  "MkdirAll",
+	DiffOpenFile:  "OpenFile",
+	DiffReadFile:  "ReadFile",
+	DiffRemove:    "Remove",
+	DiffRemoveAll: "RemoveAll",
+	DiffRename:    "Rename",
+	DiffStat:      "Stat",
+	DiffChmod:     "Chmod",
+	DiffReadDir:   "ReadDir",
+}
+
+func (k DiffOpKind) String() string {
+	if k < 0 || k >= diffOpKinds {
+		return fmt.Sprintf("DiffOpKind(%d)", int(k))
+	}
+	return diffOpNames[k]
+}
+
+// DiffOp is a single step of a differential test run. Create and OpenFile
+// write Data to the returned handle (if it is writable) and close it again.
+type DiffOp struct {
+	Kind    DiffOpKind
+	Path    string
+	NewPath string
+	Flag    int
+	Perm    os.FileMode
+	Data    []byte
+}
+
+func (op DiffOp) String() string {
+	switch op.Kind {
+	case DiffCreate:
+		return fmt.Sprintf("Create(%q) <- %q", op.Path, op.Data)
+	case DiffMkdir, DiffMkdirAll, DiffChmod:
+		return fmt.Sprintf("%s(%q, %#o)", op.Kind, op.Path, op.Perm)
+	case DiffOpenFile:
+		return fmt.Sprintf("OpenFile(%q, %s, %#o) <- %q", op.Path, flagString(op.Flag), op.Perm, op.Data)
+	case DiffRename:
+		return fmt.Sprintf("Rename(%q, %q)", op.Path, op.NewPath)
+	default:
+		return fmt.Sprintf("%s(%q)", op.Kind, op.Path)
+	}
+}
+
+func flagString(flag int) string {
+	var parts []string
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		parts = append(parts, "O_RDONLY")
+	case os.O_WRONLY:
+		parts = append(parts, "O_WRONLY")
+	case os.O_RDWR:
+		parts = append(parts, "O_RDWR")
+	}
+	for _, f := range []struct {
+		bit  int
+		name string
+	}{
+		{os.O_APPEND, "O_APPEND"},
+		{os.O_CREATE, "O_CREATE"},
+		{os.O_EXCL, "O_EXCL"},
+		{os.O_TRUNC, "O_TRUNC"},
+	} {
+		if flag&f.bit != 0 {
+			parts = append(parts, f.name)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// The generated operations work on a small set of names so that random
+// sequences hit existing files and directories often enough to be useful.
+// "/ab" is included to catch prefix matching on "/a".
+var (
+	diffPaths = []string{"/a", "/b", "/ab", "/a/b", "/a/c", "/b/a", "/a/b/c"}
+	diffFlags = []int{
+		os.O_RDONLY,
+		os.O_WRONLY | os.O_CREATE,
+		os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+		os.O_WRONLY | os.O_APPEND,
+		os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+		os.O_RDWR | os.O_CREATE | os.O_EXCL,
+	}
+	diffPerms = []os.FileMode{0755, 0700, 0644}
+	diffData  = []string{"", "x", "hello", "felix"}
+)
+
+// GenerateDiffOps returns n operations built from the bytes of r, which is
+// typically a *rand.Rand.
+func GenerateDiffOps(r io.Reader, n int) []DiffOp {
+	b := make([]byte, n*diffOpSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil
+	}
+	return DecodeDiffOps(b)
+}
+
+const diffOpSize = 6
+
+// DecodeDiffOps turns arbitrary bytes, e.g. a fuzzer input, into a sequence
+// of operations. Every diffOpSize bytes describe one operation; trailing
+// bytes are ignored.
+func DecodeDiffOps(data []byte) []DiffOp {
+	var ops []DiffOp
+	for ; len(data) >= diffOpSize; data = data[diffOpSize:] {
+		op := DiffOp{
+			Kind:    DiffOpKind(int(data[0]) % int(diffOpKinds)),
+			Path:    diffPaths[int(data[1])%len(diffPaths)],
+			NewPath: diffPaths[int(data[2])%len(diffPaths)],
+			Flag:    diffFlags[int(data[3])%len(diffFlags)],
+			Perm:    diffPerms[int(data[4])%len(diffPerms)],
+			Data:    []byte(diffData[int(data[5])%len(diffData)]),
+		}
+		switch op.Kind {
+		case DiffRename:
+		default:
+			op.NewPath = ""
+		}
+		switch op.Kind {
+		case DiffCreate:
+			op.Flag, op.Perm = 0, 0
+		case DiffOpenFile:
+		case DiffMkdir, DiffMkdirAll, DiffChmod:
+			op.Flag, op.Data = 0, nil
+		default:
+			op.Flag, op.Perm, op.Data = 0, 0, nil
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// EncodeDiffOps is the inverse of DecodeDiffOps for operations using the
+// generator's names, flags and data; it is used to seed fuzz corpora.
+func EncodeDiffOps(ops []DiffOp) []byte {
+	index := func(s []string, v string) byte {
+		for i, x := range s {
+			if x == v {
+				return byte(i)
+			}
+		}
+		return 0
+	}
+	var b []byte
+	for _, op := range ops {
+		var flag, perm byte
+		for i, f := range diffFlags {
+			if f == op.Flag {
+				flag = byte(i)
+			}
+		}
+		for i, p := range diffPerms {
+			if p == op.Perm {
+				perm = byte(i)
+			}
+		}
+		b = append(b, byte(op.Kind), index(diffPaths, op.Path), index(diffPaths, op.NewPath),
+			flag, perm, index(diffData, string(op.Data)))
+	}
+	return b
+}
+
+// KnownDifference declares a behaviour in which the filesystem under test
+// intentionally (or knowingly) deviates from the reference. Operations
+// matching it are skipped on both filesystems so the rest of the sequence
+// stays comparable.
+type KnownDifference struct {
+	Name string
+	// Match reports whether op, about to be applied to ref, triggers the
+	// difference. ref holds the reference state before op is applied.
+	Match func(ref Vfs, op DiffOp) bool
+}
+
+// DiffFactory returns a fresh, empty filesystem for a single run together
+// with a function that releases it.
+type DiffFactory func() (fs Vfs, cleanup func(), err error)
+
+// Differ applies operation sequences to a reference filesystem and to a
+// filesystem under test and compares results, errors and the final tree.
+type Differ struct {
+	Reference DiffFactory
+	Subject   DiffFactory
+	Known     []KnownDifference
+}
+
+// Divergence describes a difference found by a Differ.
+type Divergence struct {
+	// Ops is the minimized sequence of operations reproducing the divergence.
+	Ops []DiffOp
+	// Step is the index in Ops of the diverging operation, or len(Ops) if
+	// only the final trees differ.
+	Step int
+	Want string // reference result
+	Got  string // subject result
+}
+
+// Error returns a reproducer listing the operations, so a Divergence can be
+// reported directly by tests.
+func (d *Divergence) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "filesystems diverge after %d operation(s):\n", len(d.Ops))
+	for i, op := range d.Ops {
+		marker := "  "
+		if i == d.Step {
+			marker = "=>"
+		}
+		fmt.Fprintf(&buf, "%s %2d: %s\n", marker, i, op)
+	}
+	if d.Step == len(d.Ops) {
+		buf.WriteString("final trees differ\n")
+	}
+	fmt.Fprintf(&buf, "reference: %s\nsubject:   %s", d.Want, d.Got)
+	return buf.String()
+}
+
+// Run applies ops and returns a minimized Divergence if the filesystems
+// disagree, or nil if they do not. The error is only set if a factory fails.
+func (d *Differ) Run(ops []DiffOp) (*Divergence, error) {
+	div, err := d.run(ops)
+	if div == nil || err != nil {
+		return div, err
+	}
+	ops = d.minimize(div.prefix())
+	div, err = d.run(ops)
+	if err != nil {
+		return nil, err
+	}
+	if div == nil {
+		// Minimization only keeps diverging sequences, so this means
+		// the filesystem under test is not deterministic.
+		return nil, fmt.Errorf("vfs: divergence is not reproducible")
+	}
+	return div, nil
+}
+
+// minimize removes chunks of ops for as long as the remainder still
+// diverges, halving the chunk size down to single operations.
+func (d *Differ) minimize(ops []DiffOp) []DiffOp {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			try := append(append([]DiffOp(nil), ops[:start]...), ops[start+chunk:]...)
+			if div, err := d.run(try); err == nil && div != nil {
+				ops = div.prefix()
+				continue
+			}
+			start += chunk
+		}
+	}
+	return ops
+}
+
+// prefix returns the operations up to and including the diverging one.
+func (d *Divergence) prefix() []DiffOp {
+	if d.Step < len(d.Ops) {
+		return d.Ops[:d.Step+1]
+	}
+	return d.Ops
+}
+
+func (d *Differ) run(ops []DiffOp) (*Divergence, error) {
+	ref, refCleanup, err := d.Reference()
+	if err != nil {
+		return nil, err
+	}
+	defer refCleanup()
+	sub, subCleanup, err := d.Subject()
+	if err != nil {
+		return nil, err
+	}
+	defer subCleanup()
+
+	for i, op := range ops {
+		if d.known(ref, op) {
+			continue
+		}
+		want, got := applyDiffOp(ref, op), applyDiffOp(sub, op)
+		if want != got {
+			return &Divergence{Ops: ops, Step: i, Want: want, Got: got}, nil
+		}
+	}
+	want, got := diffTree(ref), diffTree(sub)
+	if want != got {
+		return &Divergence{Ops: ops, Step: len(ops), Want: want, Got: got}, nil
+	}
+	return nil, nil
+}
+
+func (d *Differ) known(ref Vfs, op DiffOp) bool {
+	for _, k := range d.Known {
+		if k.Match(ref, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDiffOp performs op and describes its outcome in a form that is
+// comparable between filesystems.
+func applyDiffOp(fs Vfs, op DiffOp) string {
+	switch op.Kind {
+	case DiffCreate:
+		f, err := fs.Create(op.Path)
+		if err != nil {
+			return errClass(err)
+		}
+		return writeAndClose(f, op.Data)
+	case DiffMkdir:
+		return errClass(fs.Mkdir(op.Path, op.Perm))
+	case DiffMkdirAll:
+		return errClass(fs.MkdirAll(op.Path, op.Perm))
+	case DiffOpenFile:
+		f, err := fs.OpenFile(op.Path, op.Flag, op.Perm)
+		if err != nil {
+			return errClass(err)
+		}
+		if op.Flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			return errClass(f.Close())
+		}
+		return writeAndClose(f, op.Data)
+	case DiffReadFile:
+		data, err := ReadFile(fs, op.Path)
+		if err != nil {
+			return errClass(err)
+		}
+		return fmt.Sprintf("ok %q", data)
+	case DiffRemove:
+		return errClass(fs.Remove(op.Path))
+	case DiffRemoveAll:
+		return errClass(fs.RemoveAll(op.Path))
+	case DiffRename:
+		return errClass(fs.Rename(op.Path, op.NewPath))
+	case DiffStat:
+		fi, err := fs.Stat(op.Path)
+		if err != nil {
+			return errClass(err)
+		}
+		return "ok " + describeFileInfo(fi)
+	case DiffChmod:
+		return errClass(fs.Chmod(op.Path, op.Perm))
+	case DiffReadDir:
+		list, err := ReadDir(fs, op.Path)
+		if err != nil {
+			return errClass(err)
+		}
+		names := make([]string, len(list))
+		for i, fi := range list {
+			names[i] = fi.Name()
+		}
+		return fmt.Sprintf("ok %q", names)
+	}
+	return fmt.Sprintf("unknown op %d", op.Kind)
+}
+
+func writeAndClose(f File, data []byte) string {
+	_, err := f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errClass(err)
+}
+
+// errClass reduces an error to its kind; messages and paths legitimately
+// differ between implementations.
+func errClass(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case os.IsNotExist(err):
+		return "not exist"
+	case os.IsExist(err):
+		return "exist"
+	default:
+		return "error"
+	}
+}
+
+func describeFileInfo(fi os.FileInfo) string {
+	if fi.IsDir() {
+		return "dir"
+	}
+	return fmt.Sprintf("file size=%d", fi.Size())
+}
+
+// diffTree lists every path below the root of fs with its type, its
+// permission bits and, for files, its content.
+func diffTree(fs Vfs) string {
+	var entries []string
+	Walk(fs, FilePathSeparator, func(path string, info os.FileInfo, err error) error {
+		path = filepath.ToSlash(path)
+		if path == "/" {
+			return nil
+		}
+		switch {
+		case err != nil:
+			entries = append(entries, path+" "+errClass(err))
+		case info.IsDir():
+			entries = append(entries, fmt.Sprintf("%s/ %#o", path, info.Mode().Perm()))
+		default:
+			entries = append(entries, fmt.Sprintf("%s %#o %q", path, info.Mode().Perm(), readForDiff(fs, path)))
+		}
+		return nil
+	})
+	sort.Strings(entries)
+	return "[" + strings.Join(entries, " ") + "]"
+}
+
+func readForDiff(fs Vfs, path string) string {
+	f, err := fs.Open(path)
+	if err != nil {
+		return errClass(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return errClass(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package vfs
+
+import (
+	mathrand "math/rand"
+	"testing"
+)
+
+// Fuzzing needs Go 1.18; the module supports older releases.
+
+func FuzzMemMapFsOsFs(f *testing.F) {
+	r := mathrand.New(mathrand.NewSource(3))
+	for i := 0; i < 5; i++ {
+		f.Add(EncodeDiffOps(GenerateDiffOps(r, 10)))
+	}
+	d := newMemMapFsDiffer()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		div, err := d.Run(DecodeDiffOps(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if div != nil {
+			t.Fatal(div)
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package vfs
+
+import (
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func osDiffFactory() (Vfs, func(), error) {
+	dir, err := TempDir(NewOsFs(), "", "felix-diff")
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewBasePathFs(NewOsFs(), dir), func() { os.RemoveAll(dir) }, nil
+}
+
+func memDiffFactory() (Vfs, func(), error) {
+	return NewMemMapFs(), func() {}, nil
+}
+
+func diffIsDir(fs Vfs, name string) bool {
+	ok, _ := IsDir(fs, name)
+	return ok
+}
+
+func diffExists(fs Vfs, name string) bool {
+	ok, _ := Exists(fs, name)
+	return ok
+}
+
+func diffParentMissing(fs Vfs, name string) bool {
+	return !diffIsDir(fs, filepath.Dir(name))
+}
+
+// diffNotDirComponent reports whether a parent of name is a file, in which
+// case the OS fails with ENOTDIR.
+func diffNotDirComponent(fs Vfs, name string) bool {
+	for dir := filepath.Dir(name); dir != "/"; dir = filepath.Dir(dir) {
+		if diffExists(fs, dir) && !diffIsDir(fs, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func diffCreates(op DiffOp) bool {
+	switch op.Kind {
+	case DiffCreate, DiffMkdir, DiffMkdirAll:
+		return true
+	case DiffOpenFile:
+		return op.Flag&os.O_CREATE != 0
+	}
+	return false
+}
+
+// memMapFsKnownDifferences lists where MemMapFs is known to disagree with
+// the operating system.
+var memMapFsKnownDifferences = []KnownDifference{
+	{
+		// MemMapFs creates missing parents and turns a file parent into a directory.
+		Name: "implicit-parent",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return op.Kind != DiffMkdirAll && diffCreates(op) && diffParentMissing(ref, op.Path) ||
+				op.Kind == DiffRename && diffParentMissing(ref, op.NewPath)
+		},
+	},
+	{
+		// MemMapFs reports ENOENT instead of ENOTDIR if a parent is a file.
+		Name: "not-dir-component",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return diffNotDirComponent(ref, op.Path) ||
+				op.Kind == DiffRename && diffNotDirComponent(ref, op.NewPath)
+		},
+	},
+	{
+		// MemMapFs.Remove drops a directory but leaves its children behind.
+		Name: "remove-non-empty-dir",
+		Match: func(ref Vfs, op DiffOp) bool {
+			empty, _ := IsEmpty(ref, op.Path)
+			return op.Kind == DiffRemove && diffIsDir(ref, op.Path) && !empty
+		},
+	},
+	{
+		// MemMapFs renames directories without their children and
+		// overwrites directories and non-empty targets.
+		Name: "rename-dir",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return op.Kind == DiffRename && (diffIsDir(ref, op.Path) || diffIsDir(ref, op.NewPath))
+		},
+	},
+	{
+		// MemMapFs ignores O_EXCL, allows writing to directories and
+		// opens directories and files alike.
+		Name: "open-flags",
+		Match: func(ref Vfs, op DiffOp) bool {
+			switch op.Kind {
+			case DiffOpenFile:
+				return op.Flag&os.O_EXCL != 0 && diffExists(ref, op.Path) ||
+					op.Flag&(os.O_WRONLY|os.O_RDWR) != 0 && diffIsDir(ref, op.Path)
+			case DiffCreate:
+				return diffIsDir(ref, op.Path)
+			case DiffReadFile:
+				return diffIsDir(ref, op.Path)
+			case DiffReadDir:
+				return diffExists(ref, op.Path) && !diffIsDir(ref, op.Path)
+			}
+			return false
+		},
+	},
+	{
+		// MemMapFs.Create sets the mode of the file to 0 and MkdirAll
+		// creates the missing parents with mode 0.
+		Name: "create-mode",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return op.Kind == DiffCreate ||
+				op.Kind == DiffMkdirAll && diffParentMissing(ref, op.Path)
+		},
+	},
+	{
+		// MemMapFs.MkdirAll succeeds if the name exists as a file.
+		Name: "mkdir-all-over-file",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return op.Kind == DiffMkdirAll && diffExists(ref, op.Path) && !diffIsDir(ref, op.Path)
+		},
+	},
+	{
+		// MemMapFs.Rename of a name onto itself succeeds without checking
+		// that it exists.
+		Name: "rename-to-self",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return op.Kind == DiffRename && op.Path == op.NewPath
+		},
+	},
+	{
+		// MemMapFs reports a fixed size for directories.
+		Name: "dir-size",
+		Match: func(ref Vfs, op DiffOp) bool {
+			return op.Kind == DiffStat && diffIsDir(ref, op.Path)
+		},
+	},
+}
+
+func newMemMapFsDiffer() *Differ {
+	return &Differ{
+		Reference: osDiffFactory,
+		Subject:   memDiffFactory,
+		Known:     memMapFsKnownDifferences,
+	}
+}
+
+func TestDifferMemMapFsOsFs(t *testing.T) {
+	d := newMemMapFsDiffer()
+	r := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		div, err := d.Run(GenerateDiffOps(r, 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if div != nil {
+			t.Fatal(div)
+		}
+	}
+}
+
+func TestDifferMinimizes(t *testing.T) {
+	ops := []DiffOp{
+		{Kind: DiffMkdir, Path: "/b", Perm: 0755},
+		{Kind: DiffCreate, Path: "/ab", Data: []byte("x")},
+		{Kind: DiffStat, Path: "/b"},
+		{Kind: DiffOpenFile, Path: "/b/a", Flag: os.O_WRONLY | os.O_CREATE, Perm: 0644, Data: []byte("hello")},
+		{Kind: DiffReadDir, Path: "/"},
+		{Kind: DiffRemove, Path: "/b"},
+		{Kind: DiffMkdir, Path: "/a", Perm: 0755},
+	}
+	d := &Differ{Reference: osDiffFactory, Subject: memDiffFactory}
+	for _, k := range memMapFsKnownDifferences {
+		if k.Name != "remove-non-empty-dir" {
+			d.Known = append(d.Known, k)
+		}
+	}
+	div, err := d.Run(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if div == nil {
+		t.Fatal("expected removing a non-empty directory to diverge")
+	}
+	if len(div.Ops) != 3 {
+		t.Fatalf("expected a reproducer of 3 operations, got:\n%s", div)
+	}
+	if div.Ops[0].Path != "/b" || div.Ops[1].Path != "/b/a" || div.Ops[2].Kind != DiffRemove {
+		t.Fatalf("unexpected reproducer:\n%s", div)
+	}
+
+	d.Known = memMapFsKnownDifferences
+	if div, err = d.Run(ops); err != nil || div != nil {
+		t.Fatalf("expected known differences to be skipped, got %v %v", div, err)
+	}
+}
+
+// noChmodFs ignores Chmod, which only the final trees can tell.
+type noChmodFs struct{ Vfs }
+
+func (fs noChmodFs) Chmod(name string, mode os.FileMode) error {
+	_, err := fs.Stat(name)
+	return err
+}
+
+func TestDifferComparesModes(t *testing.T) {
+	d := &Differ{
+		Reference: memDiffFactory,
+		Subject:   func() (Vfs, func(), error) { return noChmodFs{NewMemMapFs()}, func() {}, nil },
+	}
+	div, err := d.Run([]DiffOp{
+		{Kind: DiffMkdir, Path: "/a", Perm: 0755},
+		{Kind: DiffChmod, Path: "/a", Perm: 0700},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if div == nil || len(div.Ops) != 2 {
+		t.Fatalf("expected the ignored chmod to diverge, got:\n%s", div)
+	}
+}
+
+func TestDiffOpsEncoding(t *testing.T) {
+	ops := GenerateDiffOps(mathrand.New(mathrand.NewSource(2)), 30)
+	again := DecodeDiffOps(EncodeDiffOps(ops))
+	if len(again) != len(ops) {
+		t.Fatalf("got %d ops, want %d", len(again), len(ops))
+	}
+	for i := range ops {
+		if again[i].String() != ops[i].String() {
+			t.Errorf("op %d: got %s, want %s", i, again[i], ops[i])
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package vfs
+
+import (
+	"io"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ Lstater = (*FaultFs)(nil)
+
+// FaultOp is a set of operations a FaultRule applies to.
+type FaultOp uint32
+
+const (
+	FaultOpen     FaultOp = 1 << iota // Create, Open, OpenFile
+	FaultRead                         // File.Read, File.ReadAt
+	FaultWrite                        // File.Write, File.WriteAt, File.WriteString
+	FaultClose                        // File.Close
+	FaultSync                         // File.Sync
+	FaultTruncate                     // File.Truncate
+	FaultReaddir                      // File.Readdir, File.Readdirnames
+	FaultStat                         // Stat, LstatIfPossible, File.Stat
+	FaultMkdir                        // Mkdir, MkdirAll
+	FaultRemove                       // Remove, RemoveAll
+	FaultRename                       // Rename
+	FaultChmod                        // Chmod, Chtimes
+
+	FaultAll FaultOp = 1<<iota - 1
+)
+
+var faultOpNames = []string{
+	"open", "read", "write", "close", "sync", "truncate", "readdir",
+	"stat", "mkdir", "remove", "rename", "chmod",
+}
+
+func (op FaultOp) String() string {
+	var s string
+	for i, name := range faultOpNames {
+		if op&(1<<uint(i)) != 0 {
+			if s != "" {
+				s += "|"
+			}
+			s += name
+		}
+	}
+	return s
+}
+
+// FaultRule describes when and how a FaultFs misbehaves.
+//
+// A rule matches a call if the operation is in Ops and the (cleaned) path
+// matches the Path glob. Of the matching calls, the rule fires on the Nth
+// one only if Nth is set, and otherwise with the given Probability, or on
+// every call if Probability is 0.
+//
+// When a rule fires, the call is delayed by Delay and then, in this order
+// of precedence, performs a short read or write (Short), tears the data
+// written through the handle on Close (Torn) or fails with Err. A rule with
+// only a Delay slows calls down without failing them.
+type FaultRule struct {
+	Name        string
+	Ops         FaultOp
+	Path        string
+	Nth         int
+	Probability float64
+
+	Err   error
+	Short bool
+	Torn  bool
+	Delay time.Duration
+}
+
+// FaultRecord is an entry in the log of injected faults.
+type FaultRecord struct {
+	Rule  string
+	Op    FaultOp
+	Path  string
+	Err   error
+	Short bool
+	Torn  bool
+	Delay time.Duration
+	Time  time.Time
+}
+
+type faultRuleState struct {
+	FaultRule
+	calls int
+}
+
+// The FaultFs wraps a filesystem and injects errors, short reads and
+// writes, torn writes and delays according to a set of rules. Rules can be
+// changed at any time and every injected fault is recorded.
+//
+// Errors are returned as *os.PathError wrapping the rule's Err, e.g.
+// syscall.EIO, syscall.ENOSPC or syscall.EPERM.
+type FaultFs struct {
+	source Vfs
+
+	mu      sync.Mutex
+	rules   []*faultRuleState
+	records []FaultRecord
+	rand    *mathrand.Rand
+}
+
+func NewFaultFs(source Vfs, rules ...FaultRule) *FaultFs {
+	f := &FaultFs{source: source, rand: mathrand.New(mathrand.NewSource(time.Now().UnixNano()))}
+	f.SetRules(rules...)
+	return f
+}
+
+// Seed makes the probabilistic rules deterministic.
+func (f *FaultFs) Seed(seed int64) {
+	f.mu.Lock()
+	f.rand = mathrand.New(mathrand.NewSource(seed))
+	f.mu.Unlock()
+}
+
+// AddRule appends a rule. Rules are evaluated in the order they were added
+// and the first one firing wins.
+func (f *FaultFs) AddRule(r FaultRule) {
+	f.mu.Lock()
+	f.rules = append(f.rules, &faultRuleState{FaultRule: r})
+	f.mu.Unlock()
+}
+
+// RemoveRule removes all rules with the given name.
+func (f *FaultFs) RemoveRule(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := f.rules[:0]
+	for _, r := range f.rules {
+		if r.Name != name {
+			rules = append(rules, r)
+		}
+	}
+	f.rules = rules
+}
+
+// SetRules replaces all rules, resetting their call counters.
+func (f *FaultFs) SetRules(rules ...FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+	for _, r := range rules {
+		f.rules = append(f.rules, &faultRuleState{FaultRule: r})
+	}
+}
+
+// Faults returns the faults injected so far.
+func (f *FaultFs) Faults() []FaultRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FaultRecord(nil), f.records...)
+}
+
+// ResetFaults clears the fault log.
+func (f *FaultFs) ResetFaults() {
+	f.mu.Lock()
+	f.records = nil
+	f.mu.Unlock()
+}
+
+// fault returns (a copy of) the rule firing for the call, if any, after
+// recording it and sleeping for its delay. short and torn say whether the
+// caller is able to perform the respective kind of fault; Short and Torn are
+// cleared in the returned rule if it cannot.
+func (f *FaultFs) fault(op FaultOp, name string, short, torn bool) *FaultRule {
+	return f.faultPaths(op, []string{name}, short, torn)
+}
+
+// faultPaths is fault for a call on several paths, such as Rename. A rule
+// matches the call if its Path matches any of them.
+func (f *FaultFs) faultPaths(op FaultOp, names []string, short, torn bool) *FaultRule {
+	var name string
+
+	f.mu.Lock()
+	var rule *FaultRule
+	for _, r := range f.rules {
+		if r.Ops&op == 0 {
+			continue
+		}
+		name = filepath.Clean(names[0])
+		if r.Path != "" {
+			matched := false
+			for _, n := range names {
+				if ok, _ := filepath.Match(r.Path, filepath.Clean(n)); ok {
+					name, matched = filepath.Clean(n), true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		r.calls++
+		if r.Nth > 0 && r.calls != r.Nth {
+			continue
+		}
+		if r.Nth == 0 && r.Probability > 0 && f.rand.Float64() >= r.Probability {
+			continue
+		}
+		rule = &r.FaultRule
+		break
+	}
+	if rule == nil {
+		f.mu.Unlock()
+		return nil
+	}
+	// Work on a copy; the caller must not see later changes to the rule.
+	r := *rule
+	r.Short = rule.Short && short
+	r.Torn = rule.Torn && torn && !r.Short
+	rec := FaultRecord{Rule: r.Name, Op: op, Path: name, Err: r.Err, Short: r.Short, Torn: r.Torn, Delay: r.Delay, Time: time.Now()}
+	if r.Short && op == FaultRead {
+		// Short reads are not errors.
+		rec.Err = nil
+	}
+	f.records = append(f.records, rec)
+	f.mu.Unlock()
+
+	if r.Delay > 0 {
+		time.Sleep(r.Delay)
+	}
+	return &r
+}
+
+// check returns the error to inject for a call that can only fail.
+func (f *FaultFs) check(op FaultOp, opName, name string) error {
+	if r := f.fault(op, name, false, false); r != nil && r.Err != nil {
+		return &os.PathError{Op: opName, Path: name, Err: r.Err}
+	}
+	return nil
+}
+
+func (f *FaultFs) Name() string {
+	return "FaultFs"
+}
+
+func (f *FaultFs) Create(name string) (File, error) {
+	if err := f.check(FaultOpen, "create", name); err != nil {
+		return nil, err
+	}
+	file, err := f.source.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.newFile(file, name), nil
+}
+
+func (f *FaultFs) Mkdir(name string, perm os.FileMode) error {
+	if err := f.check(FaultMkdir, "mkdir", name); err != nil {
+		return err
+	}
+	return f.source.Mkdir(name, perm)
+}
+
+func (f *FaultFs) MkdirAll(name string, perm os.FileMode) error {
+	if err := f.check(FaultMkdir, "mkdir", name); err != nil {
+		return err
+	}
+	return f.source.MkdirAll(name, perm)
+}
+
+func (f *FaultFs) Open(name string) (File, error) {
+	if err := f.check(FaultOpen, "open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.source.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.newFile(file, name), nil
+}
+
+func (f *FaultFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := f.check(FaultOpen, "open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.source.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f.newFile(file, name), nil
+}
+
+func (f *FaultFs) Remove(name string) error {
+	if err := f.check(FaultRemove, "remove", name); err != nil {
+		return err
+	}
+	return f.source.Remove(name)
+}
+
+func (f *FaultFs) RemoveAll(path string) error {
+	if err := f.check(FaultRemove, "remove_all", path); err != nil {
+		return err
+	}
+	return f.source.RemoveAll(path)
+}
+
+func (f *FaultFs) Rename(oldname, newname string) error {
+	if r := f.faultPaths(FaultRename, []string{oldname, newname}, false, false); r != nil && r.Err != nil {
+		return &os.PathError{Op: "rename", Path: oldname, Err: r.Err}
+	}
+	return f.source.Rename(oldname, newname)
+}
+
+func (f *FaultFs) Stat(name string) (os.FileInfo, error) {
+	if err := f.check(FaultStat, "stat", name); err != nil {
+		return nil, err
+	}
+	return f.source.Stat(name)
+}
+
+func (f *FaultFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if err := f.check(FaultStat, "lstat", name); err != nil {
+		return nil, false, err
+	}
+	if lsf, ok := f.source.(Lstater); ok {
+		return lsf.LstatIfPossible(name)
+	}
+	fi, err := f.source.Stat(name)
+	return fi, false, err
+}
+
+func (f *FaultFs) Chmod(name string, mode os.FileMode) error {
+	if err := f.check(FaultChmod, "chmod", name); err != nil {
+		return err
+	}
+	return f.source.Chmod(name, mode)
+}
+
+func (f *FaultFs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.check(FaultChmod, "chtimes", name); err != nil {
+		return err
+	}
+	return f.source.Chtimes(name, atime, mtime)
+}
+
+// FaultFile is the File returned by a FaultFs.
+type FaultFile struct {
+	File
+	fs   *FaultFs
+	name string
+	size int64 // size when opened, -1 if unknown
+}
+
+func (f *FaultFs) newFile(file File, name string) *FaultFile {
+	size := int64(-1)
+	if fi, err := file.Stat(); err == nil && !fi.IsDir() {
+		size = fi.Size()
+	}
+	return &FaultFile{File: file, fs: f, name: name, size: size}
+}
+
+func (f *FaultFile) check(op FaultOp, opName string) error {
+	return f.fs.check(op, opName, f.name)
+}
+
+func (f *FaultFile) Read(p []byte) (int, error) {
+	if r := f.fs.fault(FaultRead, f.name, true, false); r != nil {
+		if r.Short {
+			return f.File.Read(p[:shortLen(len(p))])
+		}
+		if r.Err != nil {
+			return 0, &os.PathError{Op: "read", Path: f.name, Err: r.Err}
+		}
+	}
+	return f.File.Read(p)
+}
+
+func (f *FaultFile) ReadAt(p []byte, off int64) (int, error) {
+	if r := f.fs.fault(FaultRead, f.name, true, false); r != nil {
+		if r.Short {
+			return f.File.ReadAt(p[:shortLen(len(p))], off)
+		}
+		if r.Err != nil {
+			return 0, &os.PathError{Op: "read", Path: f.name, Err: r.Err}
+		}
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// shortLen is the length transferred by a short read or write of n bytes:
+// half of them, but at least one so that callers looping until all bytes
+// are transferred make progress.
+func shortLen(n int) int {
+	return (n + 1) / 2
+}
+
+// shortWriteErr is the error of a short write: the rule's error if it has
+// one, io.ErrShortWrite otherwise.
+func (f *FaultFile) shortWriteErr(r *FaultRule) error {
+	if r.Err != nil {
+		return &os.PathError{Op: "write", Path: f.name, Err: r.Err}
+	}
+	return io.ErrShortWrite
+}
+
+func (f *FaultFile) Write(p []byte) (int, error) {
+	if r := f.fs.fault(FaultWrite, f.name, true, false); r != nil {
+		if r.Short {
+			n, err := f.File.Write(p[:shortLen(len(p))])
+			if err == nil && n < len(p) {
+				err = f.shortWriteErr(r)
+			}
+			return n, err
+		}
+		if r.Err != nil {
+			return 0, &os.PathError{Op: "write", Path: f.name, Err: r.Err}
+		}
+	}
+	return f.File.Write(p)
+}
+
+func (f *FaultFile) WriteAt(p []byte, off int64) (int, error) {
+	if r := f.fs.fault(FaultWrite, f.name, true, false); r != nil {
+		if r.Short {
+			n, err := f.File.WriteAt(p[:shortLen(len(p))], off)
+			if err == nil && n < len(p) {
+				err = f.shortWriteErr(r)
+			}
+			return n, err
+		}
+		if r.Err != nil {
+			return 0, &os.PathError{Op: "write", Path: f.name, Err: r.Err}
+		}
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *FaultFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// Close closes the file. A torn write keeps only the first half of the
+// data the file grew by since it was opened, as if the system crashed
+// while flushing it.
+func (f *FaultFile) Close() error {
+	r := f.fs.fault(FaultClose, f.name, false, true)
+	if r == nil {
+		return f.File.Close()
+	}
+	if r.Torn && f.size >= 0 {
+		if fi, err := f.File.Stat(); err == nil && fi.Size() > f.size {
+			f.File.Truncate(f.size + (fi.Size()-f.size)/2)
+		}
+	}
+	err := f.File.Close()
+	if r.Err != nil {
+		return &os.PathError{Op: "close", Path: f.name, Err: r.Err}
+	}
+	return err
+}
+
+func (f *FaultFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.check(FaultReaddir, "readdir"); err != nil {
+		return nil, err
+	}
+	return f.File.Readdir(count)
+}
+
+func (f *FaultFile) Readdirnames(n int) ([]string, error) {
+	if err := f.check(FaultReaddir, "readdir"); err != nil {
+		return nil, err
+	}
+	return f.File.Readdirnames(n)
+}
+
+func (f *FaultFile) Stat() (os.FileInfo, error) {
+	if err := f.check(FaultStat, "stat"); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *FaultFile) Sync() error {
+	if err := f.check(FaultSync, "sync"); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *FaultFile) Truncate(size int64) error {
+	if err := f.check(FaultTruncate, "truncate"); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,166 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultFsError(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs(), FaultRule{Name: "eio", Ops: FaultOpen, Path: "/data/*.log", Err: syscall.EIO})
+	fs.MkdirAll("/data", 0755)
+
+	if _, err := fs.Create("/data/a.log"); err == nil || err.(*os.PathError).Err != syscall.EIO {
+		t.Fatalf("expected EIO, got %v", err)
+	}
+	f, err := fs.Create("/data/a.txt")
+	if err != nil {
+		t.Fatalf("unmatched path failed: %v", err)
+	}
+	f.Close()
+
+	faults := fs.Faults()
+	if len(faults) != 1 || faults[0].Rule != "eio" || faults[0].Op != FaultOpen || faults[0].Path != "/data/a.log" {
+		t.Fatalf("unexpected fault log: %+v", faults)
+	}
+
+	fs.RemoveRule("eio")
+	if _, err := fs.Create("/data/a.log"); err != nil {
+		t.Fatalf("removed rule still fires: %v", err)
+	}
+}
+
+func TestFaultFsNth(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs())
+	fs.AddRule(FaultRule{Name: "enospc", Ops: FaultWrite, Nth: 3, Err: syscall.ENOSPC})
+
+	f, _ := fs.Create("/file")
+	for i := 1; i <= 4; i++ {
+		_, err := f.Write([]byte("x"))
+		if i == 3 {
+			if err == nil || err.(*os.PathError).Err != syscall.ENOSPC {
+				t.Errorf("write %d: expected ENOSPC, got %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("write %d: %v", i, err)
+		}
+	}
+	f.Close()
+	if n := len(fs.Faults()); n != 1 {
+		t.Errorf("expected 1 fault, got %d", n)
+	}
+}
+
+func TestFaultFsProbability(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs(), FaultRule{Name: "eperm", Ops: FaultStat, Probability: 0.5, Err: syscall.EPERM})
+	fs.Seed(1)
+	WriteFile(fs, "/file", []byte("data"), 0644)
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := fs.Stat("/file"); err != nil {
+			failed++
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Errorf("expected about half of the calls to fail, got %d", failed)
+	}
+	if len(fs.Faults()) != failed {
+		t.Errorf("recorded %d faults for %d failures", len(fs.Faults()), failed)
+	}
+}
+
+func TestFaultFsShortIO(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs(), FaultRule{Name: "short", Ops: FaultRead | FaultWrite, Short: true})
+
+	f, _ := fs.Create("/file")
+	n, err := f.Write([]byte("12345678"))
+	if n != 4 || err != io.ErrShortWrite {
+		t.Errorf("short write: got %d, %v", n, err)
+	}
+	f.Seek(0, io.SeekStart)
+	buf := make([]byte, 4)
+	n, err = f.Read(buf)
+	if n != 2 || err != nil {
+		t.Errorf("short read: got %d, %v", n, err)
+	}
+	f.Close()
+
+	for _, rec := range fs.Faults() {
+		if !rec.Short {
+			t.Errorf("expected short fault, got %+v", rec)
+		}
+	}
+}
+
+func TestFaultFsShortIOProgress(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs(), FaultRule{Name: "short", Ops: FaultRead | FaultWrite, Short: true})
+
+	// Callers transferring a byte at a time still make progress.
+	f, _ := fs.Create("/file")
+	for _, b := range []byte("abc") {
+		if n, err := f.Write([]byte{b}); n != 1 || err != nil {
+			t.Fatalf("one byte write: got %d, %v", n, err)
+		}
+	}
+	f.Seek(0, io.SeekStart)
+	data, err := ioutil.ReadAll(io.LimitReader(f, 3))
+	if err != nil || string(data) != "abc" {
+		t.Errorf("read got %q, %v", data, err)
+	}
+	f.Close()
+}
+
+func TestFaultFsRenameTarget(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs(), FaultRule{Name: "eperm", Ops: FaultRename, Path: "/protected/*", Err: syscall.EPERM})
+	fs.MkdirAll("/protected", 0755)
+	WriteFile(fs, "/file", nil, 0644)
+
+	if err := fs.Rename("/file", "/protected/file"); err == nil {
+		t.Fatal("rename onto a protected path succeeded")
+	}
+	if faults := fs.Faults(); len(faults) != 1 || faults[0].Path != "/protected/file" {
+		t.Errorf("unexpected fault log: %+v", faults)
+	}
+	if err := fs.Rename("/file", "/other"); err != nil {
+		t.Errorf("unmatched rename failed: %v", err)
+	}
+}
+
+func TestFaultFsTornClose(t *testing.T) {
+	base := NewMemMapFs()
+	WriteFile(base, "/file", []byte("head"), 0644)
+	fs := NewFaultFs(base, FaultRule{Name: "torn", Ops: FaultClose, Torn: true, Err: syscall.EIO})
+
+	f, _ := fs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte("12345678"))
+	if err := f.Close(); err == nil {
+		t.Error("expected torn close to fail")
+	}
+
+	data, _ := ReadFile(base, "/file")
+	if string(data) != "head1234" {
+		t.Errorf("expected half of the appended data to survive, got %q", data)
+	}
+	if faults := fs.Faults(); len(faults) != 1 || !faults[0].Torn {
+		t.Errorf("unexpected fault log: %+v", faults)
+	}
+}
+
+func TestFaultFsDelay(t *testing.T) {
+	fs := NewFaultFs(NewMemMapFs(), FaultRule{Name: "slow", Ops: FaultMkdir, Delay: 20 * time.Millisecond})
+
+	start := time.Now()
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("delay-only rule failed the call: %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("call was not delayed")
+	}
+	if ok, _ := IsDir(fs, "/dir"); !ok {
+		t.Error("directory was not created")
+	}
+}
@@ -0,0 +1,499 @@
+package vfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var _ Lstater = (*InstrumentedFs)(nil)
+
+// LatencyBuckets are the upper bounds of the latency histograms kept by an
+// InstrumentedFs.
+var LatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts calls by duration. Counts[i] is the number of
+// calls that took at most Buckets[i] (and longer than Buckets[i-1]); the
+// last element counts calls longer than all buckets.
+type LatencyHistogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Buckets = LatencyBuckets
+		h.Counts = make([]uint64, len(h.Buckets)+1)
+	}
+	i := sort.Search(len(h.Buckets), func(i int) bool { return d <= h.Buckets[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// MethodMetrics are the metrics of a single Vfs or File method.
+type MethodMetrics struct {
+	Calls   uint64
+	Errors  uint64
+	Latency LatencyHistogram
+}
+
+// MetricsSnapshot is a point-in-time copy of the metrics of an
+// InstrumentedFs. File methods are reported with a "File." prefix.
+type MetricsSnapshot struct {
+	Layer        string
+	Methods      map[string]MethodMetrics
+	BytesRead    uint64
+	BytesWritten uint64
+	// Errors counts failed calls by errno name, e.g. "ENOENT".
+	Errors map[string]uint64
+}
+
+// MetricsCollector receives metrics in a shape matching Prometheus const
+// metrics, so an InstrumentedFs can back a prometheus.Collector without
+// this package depending on the client library.
+type MetricsCollector interface {
+	Counter(name, help string, labels map[string]string, value float64)
+	// Histogram gets cumulative bucket counts keyed by upper bound in
+	// seconds, as prometheus.MustNewConstHistogram expects.
+	Histogram(name, help string, labels map[string]string, count uint64, sum float64, buckets map[float64]uint64)
+}
+
+// The InstrumentedFs wraps a filesystem and counts calls, errors, bytes
+// transferred through its files and call latencies. The layer name is used
+// to tell the metrics of stacked filesystems apart.
+type InstrumentedFs struct {
+	source Vfs
+	layer  string
+
+	mu           sync.Mutex
+	methods      map[string]*MethodMetrics
+	errors       map[string]uint64
+	bytesRead    uint64
+	bytesWritten uint64
+}
+
+// NewInstrumentedFs wraps source. If layer is empty, source.Name() is used.
+func NewInstrumentedFs(source Vfs, layer string) *InstrumentedFs {
+	if layer == "" {
+		layer = source.Name()
+	}
+	return &InstrumentedFs{
+		source:  source,
+		layer:   layer,
+		methods: make(map[string]*MethodMetrics),
+		errors:  make(map[string]uint64),
+	}
+}
+
+func (m *InstrumentedFs) observe(method string, start time.Time, err error) {
+	d := time.Since(start)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm := m.methods[method]
+	if mm == nil {
+		mm = &MethodMetrics{}
+		m.methods[method] = mm
+	}
+	mm.Calls++
+	mm.Latency.observe(d)
+	// io.EOF ends reads and directory listings; it is not a failure.
+	if err != nil && err != io.EOF {
+		mm.Errors++
+		m.errors[errnoName(err)]++
+	}
+}
+
+func (m *InstrumentedFs) observeIO(method string, start time.Time, read bool, n int, err error) {
+	m.observe(method, start, err)
+	if n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	if read {
+		m.bytesRead += uint64(n)
+	} else {
+		m.bytesWritten += uint64(n)
+	}
+	m.mu.Unlock()
+}
+
+var errnoNames = map[syscall.Errno]string{
+	syscall.EACCES:    "EACCES",
+	syscall.EBADF:     "EBADF",
+	syscall.EEXIST:    "EEXIST",
+	syscall.EINVAL:    "EINVAL",
+	syscall.EIO:       "EIO",
+	syscall.EISDIR:    "EISDIR",
+	syscall.EMFILE:    "EMFILE",
+	syscall.ENOENT:    "ENOENT",
+	syscall.ENOSPC:    "ENOSPC",
+	syscall.ENOTDIR:   "ENOTDIR",
+	syscall.ENOTEMPTY: "ENOTEMPTY",
+	syscall.EPERM:     "EPERM",
+	syscall.EROFS:     "EROFS",
+}
+
+// errnoName classifies err by the errno it carries. Errors without an errno,
+// e.g. those of MemMapFs, are mapped by their os.Is* class.
+func errnoName(err error) string {
+	cause := err
+	switch e := err.(type) {
+	case *os.PathError:
+		cause = e.Err
+	case *os.LinkError:
+		cause = e.Err
+	case *os.SyscallError:
+		cause = e.Err
+	}
+	if errno, ok := cause.(syscall.Errno); ok {
+		if name, ok := errnoNames[errno]; ok {
+			return name
+		}
+		return "errno " + strconv.Itoa(int(errno))
+	}
+	switch {
+	case os.IsNotExist(err):
+		return "ENOENT"
+	case os.IsExist(err):
+		return "EEXIST"
+	case os.IsPermission(err):
+		return "EPERM"
+	}
+	return "other"
+}
+
+// Snapshot returns a copy of the current metrics.
+func (m *InstrumentedFs) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Layer:        m.layer,
+		Methods:      make(map[string]MethodMetrics, len(m.methods)),
+		BytesRead:    m.bytesRead,
+		BytesWritten: m.bytesWritten,
+		Errors:       make(map[string]uint64, len(m.errors)),
+	}
+	for name, mm := range m.methods {
+		c := *mm
+		c.Latency.Buckets = append([]time.Duration(nil), mm.Latency.Buckets...)
+		c.Latency.Counts = append([]uint64(nil), mm.Latency.Counts...)
+		s.Methods[name] = c
+	}
+	for name, n := range m.errors {
+		s.Errors[name] = n
+	}
+	return s
+}
+
+// Collect passes the current metrics to c.
+func (m *InstrumentedFs) Collect(c MetricsCollector) {
+	s := m.Snapshot()
+	layer := map[string]string{"layer": s.Layer}
+	with := func(k, v string) map[string]string {
+		return map[string]string{"layer": s.Layer, k: v}
+	}
+
+	// Samples of a metric family have to be contiguous in the text format.
+	methods := sortedMethods(s.Methods)
+	for _, name := range methods {
+		c.Counter("felix_vfs_calls_total", "Number of filesystem calls.", with("method", name), float64(s.Methods[name].Calls))
+	}
+	for _, name := range methods {
+		c.Counter("felix_vfs_call_errors_total", "Number of failed filesystem calls.", with("method", name), float64(s.Methods[name].Errors))
+	}
+	for _, name := range methods {
+		h := s.Methods[name].Latency
+		buckets := make(map[float64]uint64, len(h.Buckets))
+		var cum uint64
+		for i, b := range h.Buckets {
+			cum += h.Counts[i]
+			buckets[b.Seconds()] = cum
+		}
+		c.Histogram("felix_vfs_call_duration_seconds", "Latency of filesystem calls.", with("method", name),
+			h.Count, h.Sum.Seconds(), buckets)
+	}
+	c.Counter("felix_vfs_read_bytes_total", "Bytes read from files.", layer, float64(s.BytesRead))
+	c.Counter("felix_vfs_written_bytes_total", "Bytes written to files.", layer, float64(s.BytesWritten))
+	errnos := make([]string, 0, len(s.Errors))
+	for name := range s.Errors {
+		errnos = append(errnos, name)
+	}
+	sort.Strings(errnos)
+	for _, name := range errnos {
+		c.Counter("felix_vfs_errors_total", "Number of failed filesystem calls by errno.", with("errno", name), float64(s.Errors[name]))
+	}
+}
+
+func sortedMethods(m map[string]MethodMetrics) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WritePrometheus writes the current metrics in the Prometheus text
+// exposition format.
+func (m *InstrumentedFs) WritePrometheus(w io.Writer) error {
+	p := &promWriter{w: bufio.NewWriter(w), seen: make(map[string]bool)}
+	m.Collect(p)
+	return p.w.Flush()
+}
+
+type promWriter struct {
+	w    *bufio.Writer
+	seen map[string]bool
+}
+
+func (p *promWriter) header(name, help, typ string) {
+	if p.seen[name] {
+		return
+	}
+	p.seen[name] = true
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func promLabels(labels map[string]string, extra ...string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(pairs)
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (p *promWriter) Counter(name, help string, labels map[string]string, value float64) {
+	p.header(name, help, "counter")
+	fmt.Fprintf(p.w, "%s%s %s\n", name, promLabels(labels), promFloat(value))
+}
+
+func (p *promWriter) Histogram(name, help string, labels map[string]string, count uint64, sum float64, buckets map[float64]uint64) {
+	p.header(name, help, "histogram")
+	bounds := make([]float64, 0, len(buckets))
+	for b := range buckets {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+	for _, b := range bounds {
+		fmt.Fprintf(p.w, "%s_bucket%s %d\n", name, promLabels(labels, "le", promFloat(b)), buckets[b])
+	}
+	fmt.Fprintf(p.w, "%s_bucket%s %d\n", name, promLabels(labels, "le", "+Inf"), count)
+	fmt.Fprintf(p.w, "%s_sum%s %s\n", name, promLabels(labels), promFloat(sum))
+	fmt.Fprintf(p.w, "%s_count%s %d\n", name, promLabels(labels), count)
+}
+
+func (m *InstrumentedFs) Name() string {
+	return "InstrumentedFs"
+}
+
+func (m *InstrumentedFs) wrap(f File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &InstrumentedFile{File: f, fs: m}, nil
+}
+
+func (m *InstrumentedFs) Create(name string) (File, error) {
+	start := time.Now()
+	f, err := m.source.Create(name)
+	m.observe("Create", start, err)
+	return m.wrap(f, err)
+}
+
+func (m *InstrumentedFs) Open(name string) (File, error) {
+	start := time.Now()
+	f, err := m.source.Open(name)
+	m.observe("Open", start, err)
+	return m.wrap(f, err)
+}
+
+func (m *InstrumentedFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	start := time.Now()
+	f, err := m.source.OpenFile(name, flag, perm)
+	m.observe("OpenFile", start, err)
+	return m.wrap(f, err)
+}
+
+func (m *InstrumentedFs) Mkdir(name string, perm os.FileMode) error {
+	start := time.Now()
+	err := m.source.Mkdir(name, perm)
+	m.observe("Mkdir", start, err)
+	return err
+}
+
+func (m *InstrumentedFs) MkdirAll(path string, perm os.FileMode) error {
+	start := time.Now()
+	err := m.source.MkdirAll(path, perm)
+	m.observe("MkdirAll", start, err)
+	return err
+}
+
+func (m *InstrumentedFs) Remove(name string) error {
+	start := time.Now()
+	err := m.source.Remove(name)
+	m.observe("Remove", start, err)
+	return err
+}
+
+func (m *InstrumentedFs) RemoveAll(path string) error {
+	start := time.Now()
+	err := m.source.RemoveAll(path)
+	m.observe("RemoveAll", start, err)
+	return err
+}
+
+func (m *InstrumentedFs) Rename(oldname, newname string) error {
+	start := time.Now()
+	err := m.source.Rename(oldname, newname)
+	m.observe("Rename", start, err)
+	return err
+}
+
+func (m *InstrumentedFs) Stat(name string) (os.FileInfo, error) {
+	start := time.Now()
+	fi, err := m.source.Stat(name)
+	m.observe("Stat", start, err)
+	return fi, err
+}
+
+func (m *InstrumentedFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	start := time.Now()
+	if lsf, ok := m.source.(Lstater); ok {
+		fi, lstat, err := lsf.LstatIfPossible(name)
+		m.observe("LstatIfPossible", start, err)
+		return fi, lstat, err
+	}
+	fi, err := m.source.Stat(name)
+	m.observe("LstatIfPossible", start, err)
+	return fi, false, err
+}
+
+func (m *InstrumentedFs) Chmod(name string, mode os.FileMode) error {
+	start := time.Now()
+	err := m.source.Chmod(name, mode)
+	m.observe("Chmod", start, err)
+	return err
+}
+
+func (m *InstrumentedFs) Chtimes(name string, atime, mtime time.Time) error {
+	start := time.Now()
+	err := m.source.Chtimes(name, atime, mtime)
+	m.observe("Chtimes", start, err)
+	return err
+}
+
+// InstrumentedFile is the File returned by an InstrumentedFs.
+type InstrumentedFile struct {
+	File
+	fs *InstrumentedFs
+}
+
+func (f *InstrumentedFile) Close() error {
+	start := time.Now()
+	err := f.File.Close()
+	f.fs.observe("File.Close", start, err)
+	return err
+}
+
+func (f *InstrumentedFile) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.File.Read(p)
+	f.fs.observeIO("File.Read", start, true, n, err)
+	return n, err
+}
+
+func (f *InstrumentedFile) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.ReadAt(p, off)
+	f.fs.observeIO("File.ReadAt", start, true, n, err)
+	return n, err
+}
+
+func (f *InstrumentedFile) Seek(offset int64, whence int) (int64, error) {
+	start := time.Now()
+	pos, err := f.File.Seek(offset, whence)
+	f.fs.observe("File.Seek", start, err)
+	return pos, err
+}
+
+func (f *InstrumentedFile) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.File.Write(p)
+	f.fs.observeIO("File.Write", start, false, n, err)
+	return n, err
+}
+
+func (f *InstrumentedFile) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.WriteAt(p, off)
+	f.fs.observeIO("File.WriteAt", start, false, n, err)
+	return n, err
+}
+
+func (f *InstrumentedFile) WriteString(s string) (int, error) {
+	start := time.Now()
+	n, err := f.File.WriteString(s)
+	f.fs.observeIO("File.WriteString", start, false, n, err)
+	return n, err
+}
+
+func (f *InstrumentedFile) Readdir(count int) ([]os.FileInfo, error) {
+	start := time.Now()
+	list, err := f.File.Readdir(count)
+	f.fs.observe("File.Readdir", start, err)
+	return list, err
+}
+
+func (f *InstrumentedFile) Readdirnames(n int) ([]string, error) {
+	start := time.Now()
+	names, err := f.File.Readdirnames(n)
+	f.fs.observe("File.Readdirnames", start, err)
+	return names, err
+}
+
+func (f *InstrumentedFile) Stat() (os.FileInfo, error) {
+	start := time.Now()
+	fi, err := f.File.Stat()
+	f.fs.observe("File.Stat", start, err)
+	return fi, err
+}
+
+func (f *InstrumentedFile) Sync() error {
+	start := time.Now()
+	err := f.File.Sync()
+	f.fs.observe("File.Sync", start, err)
+	return err
+}
+
+func (f *InstrumentedFile) Truncate(size int64) error {
+	start := time.Now()
+	err := f.File.Truncate(size)
+	f.fs.observe("File.Truncate", start, err)
+	return err
+}
@@ -0,0 +1,110 @@
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestInstrumentedFsCounts(t *testing.T) {
+	fs := NewInstrumentedFs(NewMemMapFs(), "")
+
+	WriteFile(fs, "/file", []byte("hello felix"), 0644)
+	data, _ := ReadFile(fs, "/file")
+	f, _ := fs.Open("/file")
+	f.ReadAt(make([]byte, 5), 6)
+	f.Close()
+	fs.Stat("/missing")
+	fs.Remove("/missing")
+
+	s := fs.Snapshot()
+	if s.Layer != "MemMapFS" {
+		t.Errorf("layer defaults to the source name, got %q", s.Layer)
+	}
+	if s.Methods["OpenFile"].Calls != 1 || s.Methods["Open"].Calls != 2 || s.Methods["File.Close"].Calls != 3 {
+		t.Errorf("unexpected call counts: %+v", s.Methods)
+	}
+	if s.BytesWritten != 11 || s.BytesRead != uint64(len(data))+5 {
+		t.Errorf("unexpected byte counts: read %d, written %d", s.BytesRead, s.BytesWritten)
+	}
+	if s.Methods["File.Read"].Errors != 0 {
+		t.Error("EOF counted as an error")
+	}
+	if s.Methods["Stat"].Errors != 1 || s.Methods["Remove"].Errors != 1 || s.Errors["ENOENT"] != 2 {
+		t.Errorf("unexpected errors: %+v %+v", s.Methods, s.Errors)
+	}
+	if h := s.Methods["Stat"].Latency; h.Count != 1 || len(h.Counts) != len(LatencyBuckets)+1 {
+		t.Errorf("unexpected latency histogram: %+v", h)
+	}
+
+	// Snapshots don't share the histogram slices with the live metrics.
+	h := s.Methods["Stat"].Latency
+	h.Buckets[0], h.Counts[0] = 0, 42
+	if h := fs.Snapshot().Methods["Stat"].Latency; h.Buckets[0] == 0 || h.Counts[0] == 42 || LatencyBuckets[0] == 0 {
+		t.Errorf("snapshot shares the live histogram: %+v", h)
+	}
+}
+
+func TestInstrumentedFsErrno(t *testing.T) {
+	fs := NewInstrumentedFs(NewReadOnlyFs(NewMemMapFs()), "ro")
+	fs.Mkdir("/dir", 0755)
+	if n := fs.Snapshot().Errors["EPERM"]; n != 1 {
+		t.Errorf("expected one EPERM, got %d", n)
+	}
+	if errnoName(&os.PathError{Op: "open", Path: "/x", Err: syscall.ENOSPC}) != "ENOSPC" {
+		t.Error("errno not unwrapped from *os.PathError")
+	}
+}
+
+func TestInstrumentedFsLstater(t *testing.T) {
+	osFs := NewOsFs()
+	dir, err := TempDir(osFs, "", "felix-instrumented")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer osFs.RemoveAll(dir)
+	WriteFile(osFs, filepath.Join(dir, "file"), []byte("x"), 0644)
+	if err := os.Symlink(filepath.Join(dir, "file"), filepath.Join(dir, "link")); err != nil {
+		t.Skip(err)
+	}
+
+	var fs Vfs = NewInstrumentedFs(NewBasePathFs(osFs, dir), "base")
+	lstater, ok := fs.(Lstater)
+	if !ok {
+		t.Fatal("InstrumentedFs does not implement Lstater")
+	}
+	fi, lstat, err := lstater.LstatIfPossible("/link")
+	if err != nil || !lstat || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the symlink itself, got %v %v %v", fi, lstat, err)
+	}
+}
+
+func TestInstrumentedFsPrometheus(t *testing.T) {
+	fs := NewInstrumentedFs(NewMemMapFs(), "mem")
+	WriteFile(fs, "/file", []byte("abc"), 0644)
+	fs.Stat("/missing")
+
+	var buf bytes.Buffer
+	if err := fs.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE felix_vfs_calls_total counter\n",
+		`felix_vfs_calls_total{layer="mem",method="OpenFile"} 1`,
+		`felix_vfs_written_bytes_total{layer="mem"} 3`,
+		`felix_vfs_errors_total{errno="ENOENT",layer="mem"} 1`,
+		`felix_vfs_call_duration_seconds_bucket{layer="mem",method="Stat",le="+Inf"} 1`,
+		`felix_vfs_call_duration_seconds_count{layer="mem",method="Stat"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "# TYPE felix_vfs_calls_total") != 1 {
+		t.Error("metric header repeated")
+	}
+}
@@ -7,10 +7,77 @@ import (
 	"strings"
 )
 
+// Match reports whether name matches the shell pattern. The syntax is the
+// same as in filepath.Match, with one addition: a path element "**" matches
+// zero or more path elements, so **/node_modules matches node_modules in any
+// directory and a/** matches a and everything below it.
+//
+// The only possible returned error is filepath.ErrBadPattern, when pattern
+// is malformed.
+func Match(pattern, name string) (matched bool, err error) {
+	if !hasDoubleStar(pattern) {
+		return filepath.Match(pattern, name)
+	}
+	elems := splitPath(pattern)
+	for _, elem := range elems {
+		if elem == "**" {
+			continue
+		}
+		if _, err := filepath.Match(elem, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchElems(elems, splitPath(name)), nil
+}
+
+// matchElems matches the path elements of a valid pattern with those of a
+// name.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, string(filepath.Separator))
+}
+
+// hasDoubleStar reports whether pattern has a "**" path element.
+func hasDoubleStar(pattern string) bool {
+	for _, elem := range splitPath(pattern) {
+		if elem == "**" {
+			return true
+		}
+	}
+	return false
+}
+
 // Glob returns the names of all files matching pattern or nil
 // if there is no matching file. The syntax of patterns is the same
-// as in Match. The pattern may describe hierarchical names such as
-// /usr/*/bin/ed (assuming the Separator is '/').
+// as in filepath.Match: unlike in Match, "**" is the same as "*" and
+// does not match across directories. The pattern may describe
+// hierarchical names such as /usr/*/bin/ed (assuming the Separator is '/').
 //
 // Glob ignores file system errors such as I/O errors reading directories.
 // The only possible returned error is ErrBadPattern, when pattern
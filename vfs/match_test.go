@@ -168,3 +168,62 @@ func TestGlobError(t *testing.T) {
 	}
 }
 
+
+func TestMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "a/main.go", false},
+		{"**/node_modules", "node_modules", true},
+		{"**/node_modules", "a/b/node_modules", true},
+		{"**/node_modules", "a/node_modules/b", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/b/c", true},
+		{"a/**/c", "a/b/d", false},
+		{"/src/**/*.go", "/src/x/y.go", true},
+		{"/src/**/*.go", "/other/x/y.go", false},
+		{"**/.git/**", "/repo/.git/objects/ab", true},
+	} {
+		pattern, name := filepath.FromSlash(tt.pattern), filepath.FromSlash(tt.name)
+		match, err := Match(pattern, name)
+		if err != nil {
+			t.Errorf("Match(%#q, %#q) error: %s", pattern, name, err)
+			continue
+		}
+		if match != tt.match {
+			t.Errorf("Match(%#q, %#q) = %v want %v", pattern, name, match, tt.match)
+		}
+	}
+	if _, err := Match("**/[", "a"); err != filepath.ErrBadPattern {
+		t.Errorf("expected ErrBadPattern, got %v", err)
+	}
+}
+
+func TestGlobDoubleStar(t *testing.T) {
+	defer RemoveAllTestFiles(t)
+	var testDir string
+	for i, fs := range Fss {
+		if i == 0 {
+			testDir = setupGlobDirRoot(t, fs)
+		} else {
+			setupGlobDirReusePath(t, fs, testDir)
+		}
+	}
+
+	// Unlike in Match, "**" is a plain "*" that stays in one directory.
+	want := []string{filepath.Join(testDir, "globs", "submatcher")}
+	for _, fs := range Fss {
+		matches, err := Glob(fs, filepath.Join(testDir, "**", "*matcher"))
+		if err != nil {
+			t.Errorf("Glob error: %s", err)
+			continue
+		}
+		if len(matches) != len(want) || matches[0] != want[0] {
+			t.Errorf("Glob = %#v want %#v", matches, want)
+		}
+	}
+}
@@ -20,6 +20,27 @@ type File struct {
 	closed       bool
 	readOnly     bool
 	fileData     *FileData
+	onChange     func(*File, Change)
+}
+
+// Change is a change made through a File, as reported to OnChange.
+type Change int
+
+const (
+	ChangeWrite Change = iota + 1 // Data was written or truncated
+	ChangeClose                   // A writable handle was closed
+)
+
+// OnChange sets fn to be called after each change made through the handle.
+// fn is called without any lock held.
+func (f *File) OnChange(fn func(*File, Change)) {
+	f.onChange = fn
+}
+
+func (f *File) changed(c Change) {
+	if f.onChange != nil {
+		f.onChange(f, c)
+	}
 }
 
 func NewFileHandle(data *FileData) *File {
@@ -100,6 +121,9 @@ func (f *File) Close() error {
 		setModTime(f.fileData, time.Now())
 	}
 	f.fileData.Unlock()
+	if !f.readOnly {
+		f.changed(ChangeClose)
+	}
 	return nil
 }
 
@@ -199,6 +223,7 @@ func (f *File) Truncate(size int64) error {
 		f.fileData.data = f.fileData.data[0:size]
 	}
 	setModTime(f.fileData, time.Now())
+	f.changed(ChangeWrite)
 	return nil
 }
 
@@ -223,6 +248,7 @@ func (f *File) Write(b []byte) (n int, err error) {
 	}
 	n = len(b)
 	cur := atomic.LoadInt64(&f.at)
+	defer f.changed(ChangeWrite)
 	f.fileData.Lock()
 	defer f.fileData.Unlock()
 	diff := cur - int64(len(f.fileData.data))
@@ -6,8 +6,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gottingen/felix/vfs/mem"
@@ -17,6 +19,106 @@ type MemMapFs struct {
 	mu   sync.RWMutex
 	data map[string]*mem.FileData
 	init sync.Once
+
+	changes []MemChange // Changes not yet delivered, guarded by mu
+
+	subMu       sync.Mutex // Serializes delivery to subscribers
+	subscribers map[int]func(MemChange)
+	nextSub     int
+	subscribed  int32
+}
+
+// MemOp is the kind of a MemChange.
+type MemOp int
+
+const (
+	MemCreate     MemOp = iota + 1
+	MemWrite            // Data was written or truncated
+	MemCloseWrite       // A handle opened for writing was closed
+	MemRemove
+	MemRename
+	MemChmod
+	MemChtimes
+)
+
+// MemChange is a change made to a MemMapFs.
+type MemChange struct {
+	Op      MemOp
+	Name    string
+	OldName string // The previous name, for MemRename
+	IsDir   bool
+}
+
+// Subscribe registers fn to be called after every change made to the
+// filesystem, in the order the changes were made. fn is called by the
+// goroutine making the change before the call making it returns, and must
+// not change the filesystem itself. The returned function cancels the
+// subscription.
+func (m *MemMapFs) Subscribe(fn func(MemChange)) (cancel func()) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if m.subscribers == nil {
+		m.subscribers = make(map[int]func(MemChange))
+	}
+	id := m.nextSub
+	m.nextSub++
+	m.subscribers[id] = fn
+	atomic.AddInt32(&m.subscribed, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.subMu.Lock()
+			delete(m.subscribers, id)
+			m.subMu.Unlock()
+			atomic.AddInt32(&m.subscribed, -1)
+		})
+	}
+}
+
+// record queues a change for delivery by notifyChanges. m.mu must be held
+// for writing.
+func (m *MemMapFs) record(op MemOp, name, oldName string, isDir bool) {
+	if atomic.LoadInt32(&m.subscribed) == 0 {
+		return
+	}
+	m.changes = append(m.changes, MemChange{Op: op, Name: name, OldName: oldName, IsDir: isDir})
+}
+
+// notifyChanges delivers the queued changes. m.mu must not be held.
+func (m *MemMapFs) notifyChanges() {
+	if atomic.LoadInt32(&m.subscribed) == 0 {
+		return
+	}
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.mu.Lock()
+	changes := m.changes
+	m.changes = nil
+	m.mu.Unlock()
+	for _, c := range changes {
+		for _, fn := range m.subscribers {
+			fn(c)
+		}
+	}
+}
+
+// handleChanged reports the changes made through a file handle.
+func (m *MemMapFs) handleChanged(f *mem.File, c mem.Change) {
+	op := MemWrite
+	if c == mem.ChangeClose {
+		op = MemCloseWrite
+	}
+	m.mu.Lock()
+	m.record(op, f.Name(), "", false)
+	m.mu.Unlock()
+	m.notifyChanges()
+}
+
+func (m *MemMapFs) newFileHandle(f *mem.FileData) *mem.File {
+	h := mem.NewFileHandle(f)
+	h.OnChange(m.handleChanged)
+	return h
 }
 
 func NewMemMapFs() Vfs {
@@ -38,11 +140,18 @@ func (*MemMapFs) Name() string { return "MemMapFS" }
 func (m *MemMapFs) Create(name string) (File, error) {
 	name = normalizePath(name)
 	m.mu.Lock()
+	_, existed := m.getData()[name]
 	file := mem.CreateFile(name)
 	m.getData()[name] = file
 	m.registerWithParent(file)
+	if existed {
+		m.record(MemWrite, name, "", false)
+	} else {
+		m.record(MemCreate, name, "", false)
+	}
 	m.mu.Unlock()
-	return mem.NewFileHandle(file), nil
+	m.notifyChanges()
+	return m.newFileHandle(file), nil
 }
 
 func (m *MemMapFs) unRegisterWithParent(fileName string) error {
@@ -109,6 +218,7 @@ func (m *MemMapFs) lockfreeMkdir(name string, perm os.FileMode) error {
 		item := mem.CreateDir(name)
 		m.getData()[name] = item
 		m.registerWithParent(item)
+		m.record(MemCreate, name, "", true)
 	}
 	return nil
 }
@@ -127,9 +237,10 @@ func (m *MemMapFs) Mkdir(name string, perm os.FileMode) error {
 	item := mem.CreateDir(name)
 	m.getData()[name] = item
 	m.registerWithParent(item)
+	mem.SetMode(item, perm|os.ModeDir)
+	m.record(MemCreate, name, "", true)
 	m.mu.Unlock()
-
-	m.Chmod(name, perm|os.ModeDir)
+	m.notifyChanges()
 
 	return nil
 }
@@ -170,7 +281,7 @@ func (m *MemMapFs) Open(name string) (File, error) {
 func (m *MemMapFs) openWrite(name string) (File, error) {
 	f, err := m.open(name)
 	if f != nil {
-		return mem.NewFileHandle(f), err
+		return m.newFileHandle(f), err
 	}
 	return nil, err
 }
@@ -225,7 +336,7 @@ func (m *MemMapFs) OpenFile(name string, flag int, perm os.FileMode) (File, erro
 		}
 	}
 	if chmod {
-		m.Chmod(name, perm)
+		m.chmod(name, perm)
 	}
 	return file, nil
 }
@@ -234,14 +345,16 @@ func (m *MemMapFs) Remove(name string) error {
 	name = normalizePath(name)
 
 	m.mu.Lock()
+	defer m.notifyChanges()
 	defer m.mu.Unlock()
 
-	if _, ok := m.getData()[name]; ok {
+	if f, ok := m.getData()[name]; ok {
 		err := m.unRegisterWithParent(name)
 		if err != nil {
 			return &os.PathError{Op: "remove", Path: name, Err: err}
 		}
 		delete(m.getData(), name)
+		m.record(MemRemove, name, "", mem.GetFileInfo(f).IsDir())
 	} else {
 		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
 	}
@@ -254,18 +367,25 @@ func (m *MemMapFs) RemoveAll(path string) error {
 	m.unRegisterWithParent(path)
 	m.mu.Unlock()
 
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	for p, _ := range m.getData() {
-		if strings.HasPrefix(p, path) {
-			m.mu.RUnlock()
-			m.mu.Lock()
-			delete(m.getData(), p)
-			m.mu.Unlock()
-			m.mu.RLock()
+	m.mu.Lock()
+	prefix := path
+	if !strings.HasSuffix(prefix, FilePathSeparator) {
+		prefix += FilePathSeparator
+	}
+	var removed []string
+	for p := range m.getData() {
+		if p == path || strings.HasPrefix(p, prefix) {
+			removed = append(removed, p)
 		}
 	}
+	// Children go before their parents.
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	for _, p := range removed {
+		m.record(MemRemove, p, "", mem.GetFileInfo(m.getData()[p]).IsDir())
+		delete(m.getData(), p)
+	}
+	m.mu.Unlock()
+	m.notifyChanges()
 	return nil
 }
 
@@ -288,7 +408,9 @@ func (m *MemMapFs) Rename(oldname, newname string) error {
 		mem.ChangeFileName(fileData, newname)
 		m.getData()[newname] = fileData
 		m.registerWithParent(fileData)
+		m.record(MemRename, newname, oldname, mem.GetFileInfo(fileData).IsDir())
 		m.mu.Unlock()
+		m.notifyChanges()
 		m.mu.RLock()
 	} else {
 		return &os.PathError{Op: "rename", Path: oldname, Err: ErrFileNotFound}
@@ -306,6 +428,20 @@ func (m *MemMapFs) Stat(name string) (os.FileInfo, error) {
 }
 
 func (m *MemMapFs) Chmod(name string, mode os.FileMode) error {
+	if err := m.chmod(name, mode); err != nil {
+		return err
+	}
+	name = normalizePath(name)
+	m.mu.Lock()
+	if f, ok := m.getData()[name]; ok {
+		m.record(MemChmod, name, "", mem.GetFileInfo(f).IsDir())
+	}
+	m.mu.Unlock()
+	m.notifyChanges()
+	return nil
+}
+
+func (m *MemMapFs) chmod(name string, mode os.FileMode) error {
 	name = normalizePath(name)
 
 	m.mu.RLock()
@@ -334,7 +470,9 @@ func (m *MemMapFs) Chtimes(name string, atime time.Time, mtime time.Time) error
 
 	m.mu.Lock()
 	mem.SetModTime(f, mtime)
+	m.record(MemChtimes, name, "", mem.GetFileInfo(f).IsDir())
 	m.mu.Unlock()
+	m.notifyChanges()
 
 	return nil
 }
@@ -451,3 +451,50 @@ func TestMemFsUnexpectedEOF(t *testing.T) {
 	}
 }
 
+
+func TestMemFsSubscribe(t *testing.T) {
+	t.Parallel()
+
+	fs := &MemMapFs{}
+	var changes []MemChange
+	cancel := fs.Subscribe(func(c MemChange) {
+		changes = append(changes, c)
+	})
+
+	fs.MkdirAll("/a/b", 0755)
+	f, _ := fs.OpenFile("/a/b/file", os.O_CREATE|os.O_WRONLY, 0644)
+	f.Write([]byte("data"))
+	f.Close()
+	fs.Chmod("/a/b/file", 0600)
+	fs.Rename("/a/b/file", "/a/file")
+	fs.Mkdir("/a/bc", 0755)
+	fs.RemoveAll("/a/b")
+	fs.Remove("/a/file")
+
+	want := []MemChange{
+		{Op: MemCreate, Name: "/a", IsDir: true},
+		{Op: MemCreate, Name: "/a/b", IsDir: true},
+		{Op: MemCreate, Name: "/a/b/file"},
+		{Op: MemWrite, Name: "/a/b/file"},
+		{Op: MemCloseWrite, Name: "/a/b/file"},
+		{Op: MemChmod, Name: "/a/b/file"},
+		{Op: MemRename, Name: "/a/file", OldName: "/a/b/file"},
+		{Op: MemCreate, Name: "/a/bc", IsDir: true},
+		{Op: MemRemove, Name: "/a/b", IsDir: true},
+		{Op: MemRemove, Name: "/a/file"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes %v, want %v", len(changes), changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d: got %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+
+	cancel()
+	fs.Mkdir("/c", 0755)
+	if len(changes) != len(want) {
+		t.Errorf("change delivered after cancel: %+v", changes[len(want):])
+	}
+}
@@ -0,0 +1,494 @@
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Lstater = (*RecordingFs)(nil)
+
+// Record is a single call logged by a RecordingFs. Calls on files refer to
+// the handle by the File id assigned when it was opened.
+type Record struct {
+	Seq     uint64      `json:"seq"`
+	Op      string      `json:"op"`
+	File    uint64      `json:"file,omitempty"`
+	Path    string      `json:"path,omitempty"`
+	NewPath string      `json:"new_path,omitempty"`
+	Flag    int         `json:"flag,omitempty"`
+	Perm    os.FileMode `json:"perm,omitempty"`
+	Off     int64       `json:"off,omitempty"`
+	Whence  int         `json:"whence,omitempty"`
+	// Size is the buffer length of reads and writes, the count of Readdir
+	// and Readdirnames and the size passed to Truncate.
+	Size  int64      `json:"size,omitempty"`
+	Data  []byte     `json:"data,omitempty"`
+	Atime *time.Time `json:"atime,omitempty"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+
+	// N is the byte count of reads and writes and the position returned
+	// by Seek.
+	N       int64  `json:"n,omitempty"`
+	Result  string `json:"result,omitempty"`
+	ErrKind string `json:"err_kind"`
+	Err     string `json:"err,omitempty"`
+
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// outcome is the part of a record compared by Replay.
+func (r *Record) outcome() string {
+	s := fmt.Sprintf("%s n=%d", r.ErrKind, r.N)
+	if r.Result != "" {
+		s += " " + r.Result
+	}
+	return s
+}
+
+// The RecordingFs logs every call on the filesystem and the files opened
+// through it as JSON lines, one Record per call. The log can be re-executed
+// against another filesystem with Replay.
+//
+// Written data is only logged if recordData is set; otherwise Replay writes
+// zero bytes of the same length.
+type RecordingFs struct {
+	source     Vfs
+	recordData bool
+
+	mu     sync.Mutex
+	enc    *json.Encoder
+	seq    uint64
+	files  uint64
+	logErr error
+}
+
+func NewRecordingFs(source Vfs, log io.Writer, recordData bool) *RecordingFs {
+	return &RecordingFs{source: source, recordData: recordData, enc: json.NewEncoder(log)}
+}
+
+// Err returns the first error encountered writing the log.
+func (r *RecordingFs) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.logErr
+}
+
+func (r *RecordingFs) nextFile() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files++
+	return r.files
+}
+
+func (r *RecordingFs) log(rec *Record, start time.Time, err error) {
+	rec.Start = start
+	rec.Duration = time.Since(start)
+	rec.ErrKind = errClass(err)
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	rec.Seq = r.seq
+	if err := r.enc.Encode(rec); err != nil && r.logErr == nil {
+		r.logErr = err
+	}
+}
+
+func (r *RecordingFs) openFile(rec *Record, start time.Time, f File, err error) (File, error) {
+	if err != nil {
+		r.log(rec, start, err)
+		return nil, err
+	}
+	rec.File = r.nextFile()
+	r.log(rec, start, nil)
+	return &RecordingFile{File: f, fs: r, id: rec.File}, nil
+}
+
+func (r *RecordingFs) Name() string {
+	return "RecordingFs"
+}
+
+func (r *RecordingFs) Create(name string) (File, error) {
+	start := time.Now()
+	f, err := r.source.Create(name)
+	return r.openFile(&Record{Op: "Create", Path: name}, start, f, err)
+}
+
+func (r *RecordingFs) Open(name string) (File, error) {
+	start := time.Now()
+	f, err := r.source.Open(name)
+	return r.openFile(&Record{Op: "Open", Path: name}, start, f, err)
+}
+
+func (r *RecordingFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	start := time.Now()
+	f, err := r.source.OpenFile(name, flag, perm)
+	return r.openFile(&Record{Op: "OpenFile", Path: name, Flag: flag, Perm: perm}, start, f, err)
+}
+
+func (r *RecordingFs) Mkdir(name string, perm os.FileMode) error {
+	start := time.Now()
+	err := r.source.Mkdir(name, perm)
+	r.log(&Record{Op: "Mkdir", Path: name, Perm: perm}, start, err)
+	return err
+}
+
+func (r *RecordingFs) MkdirAll(path string, perm os.FileMode) error {
+	start := time.Now()
+	err := r.source.MkdirAll(path, perm)
+	r.log(&Record{Op: "MkdirAll", Path: path, Perm: perm}, start, err)
+	return err
+}
+
+func (r *RecordingFs) Remove(name string) error {
+	start := time.Now()
+	err := r.source.Remove(name)
+	r.log(&Record{Op: "Remove", Path: name}, start, err)
+	return err
+}
+
+func (r *RecordingFs) RemoveAll(path string) error {
+	start := time.Now()
+	err := r.source.RemoveAll(path)
+	r.log(&Record{Op: "RemoveAll", Path: path}, start, err)
+	return err
+}
+
+func (r *RecordingFs) Rename(oldname, newname string) error {
+	start := time.Now()
+	err := r.source.Rename(oldname, newname)
+	r.log(&Record{Op: "Rename", Path: oldname, NewPath: newname}, start, err)
+	return err
+}
+
+func (r *RecordingFs) Stat(name string) (os.FileInfo, error) {
+	start := time.Now()
+	fi, err := r.source.Stat(name)
+	r.log(&Record{Op: "Stat", Path: name, Result: fileInfoResult(fi, err)}, start, err)
+	return fi, err
+}
+
+func (r *RecordingFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	var (
+		fi    os.FileInfo
+		lstat bool
+		err   error
+	)
+	start := time.Now()
+	if lsf, ok := r.source.(Lstater); ok {
+		fi, lstat, err = lsf.LstatIfPossible(name)
+	} else {
+		fi, err = r.source.Stat(name)
+	}
+	r.log(&Record{Op: "LstatIfPossible", Path: name, Result: fileInfoResult(fi, err)}, start, err)
+	return fi, lstat, err
+}
+
+func (r *RecordingFs) Chmod(name string, mode os.FileMode) error {
+	start := time.Now()
+	err := r.source.Chmod(name, mode)
+	r.log(&Record{Op: "Chmod", Path: name, Perm: mode}, start, err)
+	return err
+}
+
+func (r *RecordingFs) Chtimes(name string, atime, mtime time.Time) error {
+	start := time.Now()
+	err := r.source.Chtimes(name, atime, mtime)
+	r.log(&Record{Op: "Chtimes", Path: name, Atime: &atime, Mtime: &mtime}, start, err)
+	return err
+}
+
+func fileInfoResult(fi os.FileInfo, err error) string {
+	if err != nil {
+		return ""
+	}
+	return describeFileInfo(fi)
+}
+
+func namesResult(names []string) string {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return fmt.Sprintf("%q", names)
+}
+
+// RecordingFile is the File returned by a RecordingFs.
+type RecordingFile struct {
+	File
+	fs *RecordingFs
+	id uint64
+}
+
+func (f *RecordingFile) record(op string) *Record {
+	return &Record{Op: "File." + op, File: f.id}
+}
+
+func (f *RecordingFile) Close() error {
+	start := time.Now()
+	err := f.File.Close()
+	f.fs.log(f.record("Close"), start, err)
+	return err
+}
+
+func (f *RecordingFile) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.File.Read(p)
+	rec := f.record("Read")
+	rec.Size, rec.N = int64(len(p)), int64(n)
+	f.fs.log(rec, start, err)
+	return n, err
+}
+
+func (f *RecordingFile) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.ReadAt(p, off)
+	rec := f.record("ReadAt")
+	rec.Size, rec.Off, rec.N = int64(len(p)), off, int64(n)
+	f.fs.log(rec, start, err)
+	return n, err
+}
+
+func (f *RecordingFile) Seek(offset int64, whence int) (int64, error) {
+	start := time.Now()
+	pos, err := f.File.Seek(offset, whence)
+	rec := f.record("Seek")
+	rec.Off, rec.Whence, rec.N = offset, whence, pos
+	f.fs.log(rec, start, err)
+	return pos, err
+}
+
+func (f *RecordingFile) write(op string, p []byte, off int64, write func() (int, error)) (int, error) {
+	start := time.Now()
+	n, err := write()
+	rec := f.record(op)
+	rec.Size, rec.Off, rec.N = int64(len(p)), off, int64(n)
+	if f.fs.recordData {
+		rec.Data = p
+	}
+	f.fs.log(rec, start, err)
+	return n, err
+}
+
+func (f *RecordingFile) Write(p []byte) (int, error) {
+	return f.write("Write", p, 0, func() (int, error) { return f.File.Write(p) })
+}
+
+func (f *RecordingFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.write("WriteAt", p, off, func() (int, error) { return f.File.WriteAt(p, off) })
+}
+
+func (f *RecordingFile) WriteString(s string) (int, error) {
+	return f.write("WriteString", []byte(s), 0, func() (int, error) { return f.File.WriteString(s) })
+}
+
+func (f *RecordingFile) Readdir(count int) ([]os.FileInfo, error) {
+	start := time.Now()
+	list, err := f.File.Readdir(count)
+	names := make([]string, len(list))
+	for i, fi := range list {
+		names[i] = fi.Name()
+	}
+	rec := f.record("Readdir")
+	rec.Size, rec.N, rec.Result = int64(count), int64(len(list)), namesResult(names)
+	f.fs.log(rec, start, err)
+	return list, err
+}
+
+func (f *RecordingFile) Readdirnames(n int) ([]string, error) {
+	start := time.Now()
+	names, err := f.File.Readdirnames(n)
+	rec := f.record("Readdirnames")
+	rec.Size, rec.N, rec.Result = int64(n), int64(len(names)), namesResult(names)
+	f.fs.log(rec, start, err)
+	return names, err
+}
+
+func (f *RecordingFile) Stat() (os.FileInfo, error) {
+	start := time.Now()
+	fi, err := f.File.Stat()
+	rec := f.record("Stat")
+	rec.Result = fileInfoResult(fi, err)
+	f.fs.log(rec, start, err)
+	return fi, err
+}
+
+func (f *RecordingFile) Sync() error {
+	start := time.Now()
+	err := f.File.Sync()
+	f.fs.log(f.record("Sync"), start, err)
+	return err
+}
+
+func (f *RecordingFile) Truncate(size int64) error {
+	start := time.Now()
+	err := f.File.Truncate(size)
+	rec := f.record("Truncate")
+	rec.Size = size
+	f.fs.log(rec, start, err)
+	return err
+}
+
+// ReplayDivergence is a call whose outcome during Replay differs from the
+// recorded one.
+type ReplayDivergence struct {
+	Seq  uint64
+	Op   string
+	Want string
+	Got  string
+}
+
+func (d ReplayDivergence) String() string {
+	return fmt.Sprintf("#%d %s: recorded %s, replayed %s", d.Seq, d.Op, d.Want, d.Got)
+}
+
+// Replay re-executes a log written by a RecordingFs against fs and returns
+// the calls whose outcome (error kind, byte count or position and result
+// summary) differs. Files left open by the trace are closed. The error is
+// only set if the log cannot be decoded.
+func Replay(fs Vfs, log io.Reader) ([]ReplayDivergence, error) {
+	files := make(map[uint64]File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var divs []ReplayDivergence
+	dec := json.NewDecoder(log)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return divs, nil
+		} else if err != nil {
+			return divs, err
+		}
+		got := replayRecord(fs, files, &rec)
+		if want := rec.outcome(); got != want {
+			divs = append(divs, ReplayDivergence{Seq: rec.Seq, Op: rec.Op, Want: want, Got: got})
+		}
+	}
+}
+
+// replayRecord performs the call described by rec and returns its outcome
+// in the form of Record.outcome.
+func replayRecord(fs Vfs, files map[uint64]File, rec *Record) string {
+	res := Record{}
+	var err error
+
+	open := func(f File, e error) {
+		err = e
+		if e == nil {
+			files[rec.File] = f
+		}
+	}
+
+	var f File
+	if strings.HasPrefix(rec.Op, "File.") {
+		var ok bool
+		if f, ok = files[rec.File]; !ok {
+			return fmt.Sprintf("no open file #%d", rec.File)
+		}
+	}
+
+	data := rec.Data
+	if data == nil && rec.Size > 0 {
+		data = make([]byte, rec.Size)
+	}
+
+	switch rec.Op {
+	case "Create":
+		open(fs.Create(rec.Path))
+	case "Open":
+		open(fs.Open(rec.Path))
+	case "OpenFile":
+		open(fs.OpenFile(rec.Path, rec.Flag, rec.Perm))
+	case "Mkdir":
+		err = fs.Mkdir(rec.Path, rec.Perm)
+	case "MkdirAll":
+		err = fs.MkdirAll(rec.Path, rec.Perm)
+	case "Remove":
+		err = fs.Remove(rec.Path)
+	case "RemoveAll":
+		err = fs.RemoveAll(rec.Path)
+	case "Rename":
+		err = fs.Rename(rec.Path, rec.NewPath)
+	case "Stat":
+		var fi os.FileInfo
+		fi, err = fs.Stat(rec.Path)
+		res.Result = fileInfoResult(fi, err)
+	case "LstatIfPossible":
+		var fi os.FileInfo
+		fi, err = lstatIfPossible(fs, rec.Path)
+		res.Result = fileInfoResult(fi, err)
+	case "Chmod":
+		err = fs.Chmod(rec.Path, rec.Perm)
+	case "Chtimes":
+		var atime, mtime time.Time
+		if rec.Atime != nil {
+			atime = *rec.Atime
+		}
+		if rec.Mtime != nil {
+			mtime = *rec.Mtime
+		}
+		err = fs.Chtimes(rec.Path, atime, mtime)
+
+	case "File.Close":
+		err = f.Close()
+		delete(files, rec.File)
+	case "File.Read":
+		var n int
+		n, err = f.Read(make([]byte, rec.Size))
+		res.N = int64(n)
+	case "File.ReadAt":
+		var n int
+		n, err = f.ReadAt(make([]byte, rec.Size), rec.Off)
+		res.N = int64(n)
+	case "File.Seek":
+		res.N, err = f.Seek(rec.Off, rec.Whence)
+	case "File.Write":
+		var n int
+		n, err = f.Write(data)
+		res.N = int64(n)
+	case "File.WriteAt":
+		var n int
+		n, err = f.WriteAt(data, rec.Off)
+		res.N = int64(n)
+	case "File.WriteString":
+		var n int
+		n, err = f.WriteString(string(data))
+		res.N = int64(n)
+	case "File.Readdir":
+		var list []os.FileInfo
+		list, err = f.Readdir(int(rec.Size))
+		names := make([]string, len(list))
+		for i, fi := range list {
+			names[i] = fi.Name()
+		}
+		res.N, res.Result = int64(len(list)), namesResult(names)
+	case "File.Readdirnames":
+		var names []string
+		names, err = f.Readdirnames(int(rec.Size))
+		res.N, res.Result = int64(len(names)), namesResult(names)
+	case "File.Stat":
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		res.Result = fileInfoResult(fi, err)
+	case "File.Sync":
+		err = f.Sync()
+	case "File.Truncate":
+		err = f.Truncate(rec.Size)
+	default:
+		return fmt.Sprintf("unknown op %q", rec.Op)
+	}
+
+	res.ErrKind = errClass(err)
+	return res.outcome()
+}
@@ -0,0 +1,129 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// recordSession performs a few typical calls on fs.
+func recordSession(t *testing.T, fs Vfs) {
+	if err := fs.MkdirAll("/app/conf", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("/app/conf/app.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("name: felix\n")
+	f.Write([]byte("debug: true\n"))
+	f.Close()
+
+	f, err = fs.Open("/app/conf/app.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	f.Read(buf)
+	f.Seek(6, io.SeekStart)
+	f.ReadAt(buf[:4], 6)
+	f.Close()
+
+	fs.Rename("/app/conf/app.yaml", "/app/conf/app.yml")
+	fs.Stat("/app/conf/app.yaml")
+	d, _ := fs.Open("/app/conf")
+	d.Readdirnames(-1)
+	d.Close()
+	fs.Remove("/app/missing")
+}
+
+func TestRecordingFsLog(t *testing.T) {
+	var log bytes.Buffer
+	fs := NewRecordingFs(NewMemMapFs(), &log, true)
+	recordSession(t, fs)
+	if err := fs.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	var first, write, last Record
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[3]), &write)
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+
+	if first.Seq != 1 || first.Op != "MkdirAll" || first.Path != "/app/conf" || first.ErrKind != "ok" {
+		t.Errorf("unexpected first record: %+v", first)
+	}
+	if write.Op != "File.Write" || write.File != 1 || string(write.Data) != "debug: true\n" || write.N != 12 {
+		t.Errorf("unexpected write record: %+v", write)
+	}
+	if last.Op != "Remove" || last.ErrKind != "not exist" || last.Err == "" {
+		t.Errorf("unexpected last record: %+v", last)
+	}
+	if first.Start.IsZero() {
+		t.Error("start time not recorded")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var log bytes.Buffer
+	recordSession(t, NewRecordingFs(NewMemMapFs(), &log, false))
+
+	divs, err := Replay(NewMemMapFs(), bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divs) != 0 {
+		t.Fatalf("unexpected divergences: %v", divs)
+	}
+
+	osFs := NewTempOsBaseFs(t)
+	defer CleanupTempDirs(t)
+	divs, err = Replay(osFs, bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divs) != 0 {
+		t.Fatalf("unexpected divergences on OsFs: %v", divs)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	var log bytes.Buffer
+	recordSession(t, NewRecordingFs(NewMemMapFs(), &log, false))
+
+	fs := NewMemMapFs()
+	fs.MkdirAll("/app/conf", 0755)
+	fs.Chmod("/app/conf", 0755)
+	ro := NewReadOnlyFs(fs)
+
+	divs, err := Replay(ro, bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divs) == 0 {
+		t.Fatal("expected divergences on a read only filesystem")
+	}
+	if divs[0].Op != "MkdirAll" || divs[0].Want != "ok n=0" || divs[0].Got != "error n=0" {
+		t.Errorf("unexpected first divergence: %v", divs[0])
+	}
+	for _, d := range divs {
+		if d.Op == "File.Write" && !strings.Contains(d.Got, "no open file") {
+			t.Errorf("expected writes to refer to a missing handle: %v", d)
+		}
+	}
+}
+
+func TestReplayBadLog(t *testing.T) {
+	if _, err := Replay(NewMemMapFs(), strings.NewReader("{not json")); err == nil {
+		t.Error("expected decode error")
+	}
+	var log bytes.Buffer
+	json.NewEncoder(&log).Encode(Record{Seq: 1, Op: "Mkdir", Path: "/x", Perm: os.ModePerm, ErrKind: "ok"})
+	if divs, err := Replay(NewMemMapFs(), &log); err != nil || len(divs) != 0 {
+		t.Errorf("hand written log: %v %v", divs, err)
+	}
+}
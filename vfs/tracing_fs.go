@@ -0,0 +1,388 @@
+package vfs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ Lstater = (*TracingFs)(nil)
+
+// Span describes a single call traced by a TracingFs. Calls made by a
+// wrapped filesystem on traced layers below it become child spans, so a
+// trace shows which layer of a stack served a call.
+type Span struct {
+	ID      uint64
+	Parent  uint64 // 0 for calls not made from within another traced call
+	Depth   int
+	Fs      string // Name() of the traced filesystem
+	Op      string // method name, with a "File." prefix for file methods
+	Path    string
+	NewPath string
+	Flag    int
+	Perm    os.FileMode
+
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// Tracer receives the spans of a TracingFs. StartSpan is called before the
+// traced call, EndSpan after it with Duration and Err set. Both are called
+// on the goroutine making the call.
+type Tracer interface {
+	StartSpan(s *Span)
+	EndSpan(s *Span)
+}
+
+var spanIDs uint64
+
+// A Trace nests the spans of the TracingFs layers of one filesystem stack:
+// a call made by a layer while serving a call on another layer becomes its
+// child. The Vfs interface has no way to pass the span of a call down to
+// the next layer, so the open spans are kept by goroutine and concurrent
+// calls nest independently. A layer serving a call on another goroutine
+// starts a new span tree there.
+type Trace struct {
+	tracer Tracer
+
+	mu   sync.Mutex
+	open map[uint64][]*Span // Spans started and not ended yet, outermost first (key: goroutine id)
+}
+
+func NewTrace(tracer Tracer) *Trace {
+	return &Trace{tracer: tracer, open: make(map[uint64][]*Span)}
+}
+
+// goroutineID returns the id of the calling goroutine.
+func goroutineID() uint64 {
+	var buf [32]byte
+	n := runtime.Stack(buf[:], false)
+	s := strings.TrimPrefix(string(buf[:n]), "goroutine ")
+	if i := strings.IndexByte(s, ' '); i > 0 {
+		id, _ := strconv.ParseUint(s[:i], 10, 64)
+		return id
+	}
+	return 0
+}
+
+// Wrap returns a TracingFs for source whose spans nest with those of the
+// other layers wrapped by the trace.
+func (tr *Trace) Wrap(source Vfs) *TracingFs {
+	return &TracingFs{source: source, trace: tr}
+}
+
+// The TracingFs reports every call on the filesystem and the files opened
+// through it to a Tracer. Wrap each layer of a filesystem stack with the
+// same Trace to see how calls are resolved, e.g.
+//
+//	tr := NewTrace(tracer)
+//	fs := tr.Wrap(NewCopyOnWriteFs(tr.Wrap(base), tr.Wrap(layer)))
+type TracingFs struct {
+	source Vfs
+	trace  *Trace
+}
+
+// NewTracingFs traces the calls on source alone, without nesting them in
+// the spans of other layers.
+func NewTracingFs(source Vfs, tracer Tracer) *TracingFs {
+	return NewTrace(tracer).Wrap(source)
+}
+
+func (t *TracingFs) start(op, path string) *Span {
+	s := &Span{
+		ID:    atomic.AddUint64(&spanIDs, 1),
+		Fs:    t.source.Name(),
+		Op:    op,
+		Path:  path,
+		Start: time.Now(),
+	}
+	tr, gid := t.trace, goroutineID()
+	tr.mu.Lock()
+	stack := tr.open[gid]
+	if n := len(stack); n > 0 {
+		s.Parent = stack[n-1].ID
+		s.Depth = n
+	}
+	tr.open[gid] = append(stack, s)
+	tr.mu.Unlock()
+	tr.tracer.StartSpan(s)
+	return s
+}
+
+func (t *TracingFs) end(s *Span, err error) {
+	s.Duration = time.Since(s.Start)
+	s.Err = err
+	tr, gid := t.trace, goroutineID()
+	tr.mu.Lock()
+	stack := tr.open[gid]
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i] == s {
+			stack = append(stack[:i], stack[i+1:]...)
+			break
+		}
+	}
+	if len(stack) == 0 {
+		delete(tr.open, gid)
+	} else {
+		tr.open[gid] = stack
+	}
+	tr.mu.Unlock()
+	tr.tracer.EndSpan(s)
+}
+
+func (t *TracingFs) wrap(f File, name string, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &TracingFile{File: f, fs: t, name: name}, nil
+}
+
+func (t *TracingFs) Name() string {
+	return "TracingFs"
+}
+
+func (t *TracingFs) Create(name string) (File, error) {
+	s := t.start("Create", name)
+	f, err := t.source.Create(name)
+	t.end(s, err)
+	return t.wrap(f, name, err)
+}
+
+func (t *TracingFs) Open(name string) (File, error) {
+	s := t.start("Open", name)
+	f, err := t.source.Open(name)
+	t.end(s, err)
+	return t.wrap(f, name, err)
+}
+
+func (t *TracingFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	s := t.start("OpenFile", name)
+	s.Flag, s.Perm = flag, perm
+	f, err := t.source.OpenFile(name, flag, perm)
+	t.end(s, err)
+	return t.wrap(f, name, err)
+}
+
+func (t *TracingFs) Mkdir(name string, perm os.FileMode) error {
+	s := t.start("Mkdir", name)
+	s.Perm = perm
+	err := t.source.Mkdir(name, perm)
+	t.end(s, err)
+	return err
+}
+
+func (t *TracingFs) MkdirAll(path string, perm os.FileMode) error {
+	s := t.start("MkdirAll", path)
+	s.Perm = perm
+	err := t.source.MkdirAll(path, perm)
+	t.end(s, err)
+	return err
+}
+
+func (t *TracingFs) Remove(name string) error {
+	s := t.start("Remove", name)
+	err := t.source.Remove(name)
+	t.end(s, err)
+	return err
+}
+
+func (t *TracingFs) RemoveAll(path string) error {
+	s := t.start("RemoveAll", path)
+	err := t.source.RemoveAll(path)
+	t.end(s, err)
+	return err
+}
+
+func (t *TracingFs) Rename(oldname, newname string) error {
+	s := t.start("Rename", oldname)
+	s.NewPath = newname
+	err := t.source.Rename(oldname, newname)
+	t.end(s, err)
+	return err
+}
+
+func (t *TracingFs) Stat(name string) (os.FileInfo, error) {
+	s := t.start("Stat", name)
+	fi, err := t.source.Stat(name)
+	t.end(s, err)
+	return fi, err
+}
+
+func (t *TracingFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	s := t.start("LstatIfPossible", name)
+	if lsf, ok := t.source.(Lstater); ok {
+		fi, lstat, err := lsf.LstatIfPossible(name)
+		t.end(s, err)
+		return fi, lstat, err
+	}
+	fi, err := t.source.Stat(name)
+	t.end(s, err)
+	return fi, false, err
+}
+
+func (t *TracingFs) Chmod(name string, mode os.FileMode) error {
+	s := t.start("Chmod", name)
+	s.Perm = mode
+	err := t.source.Chmod(name, mode)
+	t.end(s, err)
+	return err
+}
+
+func (t *TracingFs) Chtimes(name string, atime, mtime time.Time) error {
+	s := t.start("Chtimes", name)
+	err := t.source.Chtimes(name, atime, mtime)
+	t.end(s, err)
+	return err
+}
+
+// TracingFile is the File returned by a TracingFs. Its spans carry the name
+// the file was opened with.
+type TracingFile struct {
+	File
+	fs   *TracingFs
+	name string
+}
+
+func (f *TracingFile) Close() error {
+	s := f.fs.start("File.Close", f.name)
+	err := f.File.Close()
+	f.fs.end(s, err)
+	return err
+}
+
+func (f *TracingFile) Read(p []byte) (int, error) {
+	s := f.fs.start("File.Read", f.name)
+	n, err := f.File.Read(p)
+	f.fs.end(s, err)
+	return n, err
+}
+
+func (f *TracingFile) ReadAt(p []byte, off int64) (int, error) {
+	s := f.fs.start("File.ReadAt", f.name)
+	n, err := f.File.ReadAt(p, off)
+	f.fs.end(s, err)
+	return n, err
+}
+
+func (f *TracingFile) Seek(offset int64, whence int) (int64, error) {
+	s := f.fs.start("File.Seek", f.name)
+	pos, err := f.File.Seek(offset, whence)
+	f.fs.end(s, err)
+	return pos, err
+}
+
+func (f *TracingFile) Write(p []byte) (int, error) {
+	s := f.fs.start("File.Write", f.name)
+	n, err := f.File.Write(p)
+	f.fs.end(s, err)
+	return n, err
+}
+
+func (f *TracingFile) WriteAt(p []byte, off int64) (int, error) {
+	s := f.fs.start("File.WriteAt", f.name)
+	n, err := f.File.WriteAt(p, off)
+	f.fs.end(s, err)
+	return n, err
+}
+
+func (f *TracingFile) WriteString(str string) (int, error) {
+	s := f.fs.start("File.WriteString", f.name)
+	n, err := f.File.WriteString(str)
+	f.fs.end(s, err)
+	return n, err
+}
+
+func (f *TracingFile) Readdir(count int) ([]os.FileInfo, error) {
+	s := f.fs.start("File.Readdir", f.name)
+	list, err := f.File.Readdir(count)
+	f.fs.end(s, err)
+	return list, err
+}
+
+func (f *TracingFile) Readdirnames(n int) ([]string, error) {
+	s := f.fs.start("File.Readdirnames", f.name)
+	names, err := f.File.Readdirnames(n)
+	f.fs.end(s, err)
+	return names, err
+}
+
+func (f *TracingFile) Stat() (os.FileInfo, error) {
+	s := f.fs.start("File.Stat", f.name)
+	fi, err := f.File.Stat()
+	f.fs.end(s, err)
+	return fi, err
+}
+
+func (f *TracingFile) Sync() error {
+	s := f.fs.start("File.Sync", f.name)
+	err := f.File.Sync()
+	f.fs.end(s, err)
+	return err
+}
+
+func (f *TracingFile) Truncate(size int64) error {
+	s := f.fs.start("File.Truncate", f.name)
+	err := f.File.Truncate(size)
+	f.fs.end(s, err)
+	return err
+}
+
+// LogTracer writes one JSON line per finished span.
+type LogTracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewLogTracer(w io.Writer) *LogTracer {
+	return &LogTracer{enc: json.NewEncoder(w)}
+}
+
+type logSpan struct {
+	ID       uint64  `json:"id"`
+	Parent   uint64  `json:"parent,omitempty"`
+	Depth    int     `json:"depth"`
+	Fs       string  `json:"fs"`
+	Op       string  `json:"op"`
+	Path     string  `json:"path,omitempty"`
+	NewPath  string  `json:"new_path,omitempty"`
+	Flags    string  `json:"flags,omitempty"`
+	Perm     string  `json:"perm,omitempty"`
+	Start    string  `json:"start"`
+	Duration float64 `json:"duration_us"`
+	Err      string  `json:"err,omitempty"`
+}
+
+func (l *LogTracer) StartSpan(s *Span) {}
+
+func (l *LogTracer) EndSpan(s *Span) {
+	ls := logSpan{
+		ID:       s.ID,
+		Parent:   s.Parent,
+		Depth:    s.Depth,
+		Fs:       s.Fs,
+		Op:       s.Op,
+		Path:     s.Path,
+		NewPath:  s.NewPath,
+		Start:    s.Start.Format(time.RFC3339Nano),
+		Duration: float64(s.Duration) / float64(time.Microsecond),
+	}
+	if s.Op == "OpenFile" {
+		ls.Flags = flagString(s.Flag)
+	}
+	if s.Perm != 0 {
+		ls.Perm = "0" + strconv.FormatUint(uint64(s.Perm.Perm()), 8)
+	}
+	if s.Err != nil {
+		ls.Err = s.Err.Error()
+	}
+	l.mu.Lock()
+	l.enc.Encode(ls)
+	l.mu.Unlock()
+}
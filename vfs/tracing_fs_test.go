@@ -0,0 +1,184 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type spanCollector struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (c *spanCollector) StartSpan(s *Span) {}
+
+func (c *spanCollector) EndSpan(s *Span) {
+	c.mu.Lock()
+	c.spans = append(c.spans, *s)
+	c.mu.Unlock()
+}
+
+func (c *spanCollector) find(fs, op string) *Span {
+	for i := range c.spans {
+		if c.spans[i].Fs == fs && c.spans[i].Op == op {
+			return &c.spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTracingFsNested(t *testing.T) {
+	c := &spanCollector{}
+	base := NewMemMapFs()
+	WriteFile(base, "/file", []byte("data"), 0644)
+	tr := NewTrace(c)
+	fs := tr.Wrap(NewCopyOnWriteFs(tr.Wrap(NewReadOnlyFs(base)), tr.Wrap(NewMemMapFs())))
+
+	f, err := fs.OpenFile("/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	outer := c.find("CopyOnWriteFs", "OpenFile")
+	if outer == nil || outer.Depth != 0 || outer.Parent != 0 {
+		t.Fatalf("unexpected top level span: %+v", outer)
+	}
+	inner := c.find("ReadOnlyFilter", "OpenFile")
+	if inner == nil {
+		t.Fatalf("no span for the base layer: %+v", c.spans)
+	}
+	if inner.Parent != outer.ID || inner.Depth != 1 {
+		t.Errorf("base layer span is not a child of the outer span: %+v", inner)
+	}
+	if inner.Duration > outer.Duration {
+		t.Errorf("child outlasted its parent")
+	}
+
+	closed := c.find("CopyOnWriteFs", "File.Close")
+	if closed == nil || closed.Path != "/file" || closed.Depth != 0 {
+		t.Errorf("unexpected close span: %+v", closed)
+	}
+}
+
+// gateFs holds its Stat calls until all of n callers made one.
+type gateFs struct {
+	Vfs
+	wg *sync.WaitGroup
+}
+
+func (g gateFs) Stat(name string) (os.FileInfo, error) {
+	g.wg.Done()
+	g.wg.Wait()
+	return g.Vfs.Stat(name)
+}
+
+func TestTracingFsNestedAcrossGoroutines(t *testing.T) {
+	const n = 8
+	c := &spanCollector{}
+	tr := NewTrace(c)
+	wg := &sync.WaitGroup{}
+	wg.Add(n)
+	fs := tr.Wrap(gateFs{tr.Wrap(NewMemMapFs()), wg})
+
+	// Concurrent calls, all open at once, each get their own children.
+	var done sync.WaitGroup
+	for i := 0; i < n; i++ {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			fs.Stat("/" + strconv.Itoa(i))
+		}(i)
+	}
+	done.Wait()
+
+	outer := make(map[string]uint64)
+	for _, s := range c.spans {
+		if s.Fs == "TracingFs" {
+			if s.Parent != 0 || s.Depth != 0 {
+				t.Errorf("top level span with a parent: %+v", s)
+			}
+			outer[s.Path] = s.ID
+		}
+	}
+	for _, s := range c.spans {
+		if s.Fs != "MemMapFS" {
+			continue
+		}
+		if id, ok := outer[s.Path]; !ok || s.Parent != id || s.Depth != 1 {
+			t.Errorf("span is not a child of the call on %s (%d): %+v", s.Path, id, s)
+		}
+	}
+	if len(c.spans) != 2*n {
+		t.Errorf("got %d spans, want %d", len(c.spans), 2*n)
+	}
+
+	// Layers traced separately do not nest.
+	c.spans = nil
+	NewTracingFs(NewTracingFs(NewMemMapFs(), c), c).Stat("/")
+	for _, s := range c.spans {
+		if s.Parent != 0 {
+			t.Errorf("unexpected parent: %+v", s)
+		}
+	}
+}
+
+func TestTracingFsError(t *testing.T) {
+	c := &spanCollector{}
+	fs := NewTracingFs(NewMemMapFs(), c)
+	if _, err := fs.Stat("/missing"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := fs.Rename("/missing", "/other"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(c.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(c.spans))
+	}
+	for _, s := range c.spans {
+		if s.Err == nil || s.Depth != 0 {
+			t.Errorf("unexpected span: %+v", s)
+		}
+	}
+	if c.spans[1].NewPath != "/other" {
+		t.Errorf("rename target not recorded: %+v", c.spans[1])
+	}
+}
+
+func TestLogTracer(t *testing.T) {
+	var buf bytes.Buffer
+	fs := NewTracingFs(NewMemMapFs(), NewLogTracer(&buf))
+	f, err := fs.OpenFile("/file", os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	open := lines[0]
+	if open["op"] != "OpenFile" || open["fs"] != "MemMapFS" || open["path"] != "/file" || open["perm"] != "0640" {
+		t.Errorf("unexpected open line: %v", open)
+	}
+	if open["flags"] != flagString(os.O_CREATE|os.O_WRONLY) {
+		t.Errorf("unexpected flags: %v", open["flags"])
+	}
+	if lines[1]["op"] != "File.Write" || lines[2]["op"] != "File.Close" {
+		t.Errorf("unexpected file lines: %v", lines[1:])
+	}
+}